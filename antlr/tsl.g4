@@ -107,8 +107,10 @@ whereExpr : DOT WHERE LPAREN (STRING|STRING_LIST|EMPTY_LIST|IDENT) RPAREN
 // - as window or cumulative
 // - as arithmetic operation
 // - as simple operation
+// - as calendar operation
 // - as complex operation
 seriesOperations : samplingOperations
+    | calendarOperation
     | groupOperation
     | groupByOperation
     | windowOperation
@@ -123,7 +125,7 @@ samplingOperations: prefixSampling sampleParam? sampleParam? sampleParam? RPAREN
     ;
 
 // Optionals sampling params 
-sampleParam: fillSampling | COMMA spanSampling | COMMA countSampling | relativeSampling
+sampleParam: fillSampling | COMMA spanSampling | COMMA countSampling | relativeSampling | timezoneSampling
     ;
 
 // Sampling fill param
@@ -138,6 +140,10 @@ fillMethod:FILL LPAREN (NUMBER | DURATIONVAL | STRING | TRUE | FALSE | IDENT ) R
 relativeSampling: COMMA ('relative' '=')? relative=(TRUE | FALSE | IDENT) 
     ;
 
+// Sampling timezone param (an IANA timezone name)
+timezoneSampling: COMMA 'tz' '=' tz=(STRING | IDENT)
+    ;
+
 // Sampling count param
 countSampling: ('count' '=')? count=NUMBER
     ;
@@ -177,7 +183,8 @@ arithmeticOperationWithParam: DOT arithmeticOperatorWithParam LPAREN value=(NUMB
 
 // Arithmetic operator with a single number parameter
 arithmeticOperatorWithParam: (ADDSERIES | SUBSERIES | MULSERIES | DIVSERIES | LOGN | EQUAL | NOTEQUAL | GREATERTHAN | GREATEROREQUAL | LESSTHAN 
-    | LESSOREQUAL | MAXWITH | MINWITH | TOPN | BOTTOMN | SHRINK | TIMESCALE | KEEPFIRSTVALUES | KEEPLASTVALUES | KEEPFIRSTVALUE | KEEPLASTVALUE )
+    | LESSOREQUAL | MAXWITH | MINWITH | TOPN | BOTTOMN | SHRINK | TIMESCALE | KEEPFIRSTVALUES | KEEPLASTVALUES | KEEPFIRSTVALUE | KEEPLASTVALUE
+    | POW | MOD )
     ;
 
 // Simple operations
@@ -185,8 +192,17 @@ simpleOperation: DOT simpleOperator LPAREN RPAREN
     ;
 
 // Operator that does not require a parameter
-simpleOperator: ABS | CEIL | CUMULATIVESUM | FLOOR | FINITE | RESETS | ROUND | LN | LOG2 | LOG10 | SQRT | DAY | WEEKDAY | HOUR | MINUTE 
-    | MONTH | YEAR | TIMESTAMP | SORT | SORTDESC | KEEPFIRSTVALUES | KEEPLASTVALUES | KEEPFIRSTVALUE | KEEPLASTVALUE | TOLONG | TOBOOLEAN | TODOUBLE | TOSTRING
+simpleOperator: ABS | CEIL | CUMULATIVESUM | FLOOR | FINITE | RESETS | ROUND | LN | LOG2 | LOG10 | SQRT
+    | TIMESTAMP | SORT | SORTDESC | KEEPFIRSTVALUES | KEEPLASTVALUES | KEEPFIRSTVALUE | KEEPLASTVALUE | TOLONG | TOBOOLEAN | TODOUBLE | TOSTRING
+    | EXP | SIN | COS | TAN | SGN
+    ;
+
+// Calendar operations with an optional timezone
+calendarOperation: DOT calendarOperator LPAREN (('tz' '=')? tz=(STRING|IDENT))? RPAREN
+    ;
+
+// Operator replacing values by a calendar element of their tick
+calendarOperator: DAY | WEEKDAY | HOUR | MINUTE | MONTH | YEAR
     ;
 
 // Operation with a single string parameter
@@ -205,6 +221,10 @@ stringOperator: ADDNAMEPREFIX | ADDNAMESUFFIX | RENAME | RENAMEBY | RENAMETEMPLA
 // - topNBy and bottomNBy
 // - removeLabels / renameLabelKey / renameLabelValue
 // - timeclip / timesplit / timemodulo
+// - histogramQuantile / histogramFraction
+// - deriv / predictLinear / holtWinters / forecast
+// - zscore / outliers / bands
+// - clamp
 complexOperation: DOT RATE LPAREN (DURATIONVAL|IDENT)? RPAREN
     | DOT SHIFT LPAREN (DURATIONVAL|IDENT) RPAREN
     | DOT (ANDL|ORL) LPAREN (TRUE|FALSE) RPAREN
@@ -216,6 +236,16 @@ complexOperation: DOT RATE LPAREN (DURATIONVAL|IDENT)? RPAREN
     | DOT TIMECLIP LPAREN (NUMBER|IDENT|NOW|STRING) COMMA (NUMBER|IDENT|DURATIONVAL|STRING) RPAREN
     | DOT TIMEMODULO LPAREN (NUMBER|IDENT) COMMA (STRING|IDENT) RPAREN
     | DOT TIMESPLIT LPAREN (NUMBER|DURATIONVAL|NOW|IDENT) COMMA (NUMBER|IDENT) COMMA (STRING|IDENT) RPAREN
+    | DOT HISTOGRAMQUANTILE LPAREN (NUMBER|IDENT) RPAREN
+    | DOT HISTOGRAMFRACTION LPAREN (NUMBER|IDENT) COMMA (NUMBER|IDENT) RPAREN
+    | DOT DERIV LPAREN (DURATIONVAL|IDENT)? RPAREN
+    | DOT PREDICTLINEAR LPAREN (DURATIONVAL|IDENT) (COMMA (DURATIONVAL|IDENT))? RPAREN
+    | DOT HOLTWINTERS LPAREN (NUMBER|IDENT) COMMA (NUMBER|IDENT) (COMMA (DURATIONVAL|IDENT))? RPAREN
+    | DOT FORECAST LPAREN (DURATIONVAL|IDENT) RPAREN
+    | DOT ZSCORE LPAREN (DURATIONVAL|IDENT)? RPAREN
+    | DOT OUTLIERS LPAREN (STRING|IDENT) COMMA (NUMBER|IDENT) (COMMA (TRUE|FALSE|IDENT))? RPAREN
+    | DOT BANDS LPAREN (DURATIONVAL|IDENT) COMMA (NUMBER|IDENT) RPAREN
+    | DOT CLAMP LPAREN (NUMBER|IDENT) COMMA (NUMBER|IDENT) RPAREN
     | DOT QUANTIZE LPAREN (STRING|IDENT) COMMA (('[' WS* (NUMBER|IDENT) (COMMA (NUMBER|IDENT))* WS* ']')|EMPTY_LIST|NUMBER|IDENT|) (COMMA (DURATIONVAL|IDENT))? RPAREN
     ;
 
@@ -233,8 +263,8 @@ limitOperatorList : limitOperator LPAREN (STRING_LIST|EMPTY_LIST|STRING|IDENT) R
     | limitOperator LPAREN RPAREN groupLimitOperatorList*
     ;
 
-// Group method as computed in PromQL
-groupLimitOperatorList : DOT groupLimitOperator LPAREN RPAREN
+// Group method as computed in PromQL, with the optional labels to copy from the "one" side
+groupLimitOperatorList : DOT groupLimitOperator LPAREN ((STRING|IDENT) (COMMA (STRING|IDENT))*)? RPAREN
     ;
 
 // Valid group methods
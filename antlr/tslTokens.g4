@@ -38,18 +38,23 @@ ADDNAMEPREFIX:     'addPrefix';
 ADDSERIES:         'add';
 ANDL:              'and';
 ATTRIBUTEPOLICY:   'attributePolicy';
+BANDS:             'bands';
 BOTTOMN:           'bottomN';
 BOTTOMNBY:         'bottomNBy';
 CEIL:              'ceil';
+CLAMP:             'clamp';
 CONNECT:           'connect';
+COS:               'cos';
 COUNT:             'count';
 CREATE:            'create';
 CUMULATIVE:        'cumulative';
 CUMULATIVESUM:     'cumulativeSum';
 DAY:               'day';
 DELTA:             'delta';
+DERIV:             'deriv';
 DIVSERIES:         'div';
 EQUAL:             'equal';
+EXP:               'exp';
 FILL:              'fill';
 FILTERBYLABELS:    'filterByLabels';
 FILTERBYNAME:      'filterByName';
@@ -57,6 +62,7 @@ FILTERBYLASTVALUE: 'filterByLastValue';
 FINITE:            'finite';
 FIRST:             'first';
 FLOOR:             'floor';
+FORECAST:          'forecast';
 FROM:              'from';
 GREATEROREQUAL:    'greaterOrEqual';
 GREATERTHAN:       'greaterThan';
@@ -65,6 +71,9 @@ GROUPLEFT:         'groupLeft';
 GROUPRIGHT:        'groupRight';
 GROUPBY:           'groupBy';
 GROUPWITHOUT:      'groupWithout';
+HISTOGRAMFRACTION: 'histogramFraction';
+HISTOGRAMQUANTILE: 'histogramQuantile';
+HOLTWINTERS:       'holtWinters';
 HOUR:              'hour';
 IGNORING:          'ignoring';
 JOIN:              'join';
@@ -88,6 +97,7 @@ MEDIAN:            'median';
 MIN:               'min';
 MINWITH:           'minWith';
 MINUTE:            'minute';
+MOD:               'mod';
 MONTH:             'month';
 MULSERIES:         'mul';
 NEGMASK:           'negmask';
@@ -96,7 +106,10 @@ NOW:               'now';
 NAMES:             'names';
 ON:                'on';
 ORL:               'or';
+OUTLIERS:          'outliers';
 PERCENTILE:        'percentile';
+POW:               'pow';
+PREDICTLINEAR:     'predictLinear';
 PROM:              'prom';
 PROMETHEUS:        'prometheus';
 QUANTIZE:          'quantize';
@@ -117,8 +130,10 @@ SELECTORS:         'selectors';
 SERIES:            'series';
 SETLABELS:         'setLabels';
 SETVALUES:         'setValues';
+SGN:               'sgn';
 SHIFT:             'shift';
 SHRINK:            'shrink';
+SIN:               'sin';
 SORT:              'sort';
 SORTBY:            'sortBy';
 SORTDESC:          'sortDesc';
@@ -129,6 +144,7 @@ STDVAR:            'stdvar';
 STORE:             'store';
 SUBSERIES:         'sub';
 SUM:               'sum';
+TAN:               'tan';
 TOBOOLEAN:         'toboolean';
 TODOUBLE:          'todouble';
 TOLONG:            'tolong';
@@ -145,6 +161,7 @@ WEEKDAY:           'weekday';
 WHERE:             'where';
 WINDOW:            'window';
 YEAR:              'year';
+ZSCORE:            'zscore';
 
 // Floating-point literals
 
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/ovh/tsl/proxy"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	explainToken         string
+	explainQueryRange    string
+	explainSamplersCount string
+	explainTimezone      string
+)
+
+func init() {
+	explainCmd.Flags().StringVarP(&explainToken, "token", "t", "", "default token of the statements")
+	explainCmd.Flags().StringVar(&explainQueryRange, "query-range", "", "query range, as the TSL-Query-Range header")
+	explainCmd.Flags().StringVar(&explainSamplersCount, "samplers", "", "samplers count, as the TSL-Samplers header")
+	explainCmd.Flags().StringVar(&explainTimezone, "timezone", "", "default timezone, as the TSL-Timezone header")
+	RootCmd.AddCommand(explainCmd)
+}
+
+var explainCmd = &cobra.Command{
+	Use:   "explain [file]",
+	Short: "Print the execution plan of a TSL query read from a file or the standard input",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		input := os.Stdin
+		if len(args) == 1 {
+			file, err := os.Open(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer file.Close()
+			input = file
+		}
+
+		query, err := ioutil.ReadAll(input)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		params := map[string]string{
+			"TSL-Query-Range": explainQueryRange,
+			"TSL-Samplers":    explainSamplersCount,
+			"TSL-Timezone":    explainTimezone,
+		}
+
+		plans, err := proxy.ExplainQueries(string(query), explainToken, viper.GetBool("tsl.warp10.authenticate"), params)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		res, err := json.MarshalIndent(plans, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(res))
+	},
+}
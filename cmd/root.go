@@ -123,9 +123,51 @@ var RootCmd = &cobra.Command{
 
 		promRegistry := prometheus.NewRegistry()
 
+		// Load backend pools and start their health checks
+		if err := proxy.LoadPools(); err != nil {
+			log.Fatal(err)
+		}
+
+		// Load the Prometheus queries result cache
+		if err := proxy.LoadCache(promRegistry); err != nil {
+			log.Fatal(err)
+		}
+
+		// Authenticate queries with a JWT mapped to a tenant back-ends
+		queryMiddlewares := []echo.MiddlewareFunc{}
+		authMiddlewares := []echo.MiddlewareFunc{}
+		if viper.GetBool("tsl.auth.jwt.enabled") {
+			jwt, err := middlewares.JWT()
+			if err != nil {
+				log.Fatal(err)
+			}
+			queryMiddlewares = append(queryMiddlewares, jwt)
+			authMiddlewares = append(authMiddlewares, jwt)
+		}
+
+		// Limit the queries rates, concurrency and daily quotas per token and per IP
+		if viper.IsSet("tsl.limits") {
+			queryMiddlewares = append(queryMiddlewares, middlewares.RateLimit(middlewares.NewMemoryStore(), promRegistry))
+		}
+
 		// Register handler(s) for path(s)
 		tsl := proxy.NewProxyTSL(promRegistry)
-		r.POST("/v0/query", tsl.Query)
+		r.POST("/v0/query", tsl.Query, queryMiddlewares...)
+		r.POST("/v0/explain", tsl.Explain, queryMiddlewares...)
+		r.POST("/v0/grafana/query", tsl.GrafanaQuery, queryMiddlewares...)
+		r.GET("/v0/federate", tsl.Federate, queryMiddlewares...)
+
+		// Streams are limited by their own open streams limits
+		r.GET("/v0/stream", tsl.Stream, authMiddlewares...)
+		r.POST("/v0/stream", tsl.Stream, authMiddlewares...)
+
+		// Asynchronous query jobs, only their submission is rate limited
+		jobs := proxy.NewJobQueue(promRegistry)
+		r.POST("/v0/jobs", jobs.Submit, queryMiddlewares...)
+		r.GET("/v0/jobs/:id", jobs.Status, authMiddlewares...)
+		r.GET("/v0/jobs/:id/progress", jobs.Progress, authMiddlewares...)
+		r.GET("/v0/jobs/:id/result", jobs.Result, authMiddlewares...)
+		r.DELETE("/v0/jobs/:id", jobs.Cancel, authMiddlewares...)
 
 		// Use of a Prometheus custon registry to record TSL metrics
 		r.Any("/metrics", echo.WrapHandler(promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{})))
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/ovh/tsl/proxy"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var rulesOnce bool
+
+func init() {
+	rulesCmd.Flags().BoolVar(&rulesOnce, "once", false, "evaluate each rule group once and exit")
+	RootCmd.AddCommand(rulesCmd)
+}
+
+var rulesCmd = &cobra.Command{
+	Use:   "rules file...",
+	Short: "Evaluate TSL recording and alerting rules read from YAML rules files",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		// Load backend pools and start their health checks
+		if err := proxy.LoadPools(); err != nil {
+			log.Fatal(err)
+		}
+
+		groups, err := proxy.LoadRuleGroups(args)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if rulesOnce {
+			now := time.Now().UTC()
+			for _, group := range groups {
+				group.Evaluate(now)
+			}
+			return
+		}
+
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for _, group := range groups {
+			wg.Add(1)
+			go func(group *proxy.RuleGroup) {
+				defer wg.Done()
+				group.Run(stop)
+			}(group)
+		}
+		log.Infof("Evaluating %d rule groups", len(groups))
+
+		// Wait for interrupt signal to stop the rules evaluation
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, os.Interrupt)
+		<-quit
+
+		close(stop)
+		wg.Wait()
+	},
+}
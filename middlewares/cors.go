@@ -15,8 +15,8 @@ func cors(ctx echo.Context, next echo.HandlerFunc) error {
 	ctx.Response().Header().Set("Access-Control-Allow-Origin", origin)
 	ctx.Response().Header().Set("Access-Control-Allow-Credentials", "true")
 	ctx.Response().Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	ctx.Response().Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Origin, X-Warp10-Elapsed, X-Warp10-Error-Line, X-Warp10-Error-Message, X-Warp10-Fetched, X-Warp10-Ops, TSL-Line-Start, TSL-Query-Range, TSL-Samplers")
-	ctx.Response().Header().Set("Access-Control-Expose-Headers", "X-Warp10-Elapsed, X-Warp10-Error-Line, X-Warp10-Error-Message, X-Warp10-Fetched, X-Warp10-Ops, TSL-Line-Start, TSL-Query-Range, TSL-Samplers")
+	ctx.Response().Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Origin, X-Warp10-Elapsed, X-Warp10-Error-Line, X-Warp10-Error-Message, X-Warp10-Fetched, X-Warp10-Ops, TSL-Line-Start, TSL-Query-Range, TSL-Samplers, TSL-Timezone")
+	ctx.Response().Header().Set("Access-Control-Expose-Headers", "X-Warp10-Elapsed, X-Warp10-Error-Line, X-Warp10-Error-Message, X-Warp10-Fetched, X-Warp10-Ops, TSL-Line-Start, TSL-Query-Range, TSL-Samplers, TSL-Timezone")
 
 	if ctx.Request().Method == http.MethodOptions {
 		return ctx.NoContent(http.StatusOK)
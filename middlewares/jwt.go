@@ -0,0 +1,157 @@
+package middlewares
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/ovh/tsl/tsl"
+	"github.com/spf13/viper"
+)
+
+const (
+	// TenantKey is the context key of the tenant authenticated by a JWT
+	TenantKey = "tenant"
+
+	defaultJWTAlgorithm = "HS256"
+	defaultTenantClaim  = "tenant"
+)
+
+// jwtVerifier checks the signature and the claims of a JWT
+type jwtVerifier struct {
+	algorithm         string
+	key               interface{}
+	claim             string
+	requireExpiration bool
+	issuer            string
+	audience          string
+}
+
+func (verifier *jwtVerifier) authenticate(ctx echo.Context, next echo.HandlerFunc) error {
+	s := strings.SplitN(ctx.Request().Header.Get("Authorization"), " ", 2)
+	if len(s) != 2 || !strings.EqualFold(s[0], "Bearer") {
+		return ctx.JSON(http.StatusUnauthorized, tsl.NewError(errors.New("expects a Bearer JWT authorization")))
+	}
+
+	claims, err := verifier.verify(s[1])
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, tsl.NewError(fmt.Errorf("invalid JWT: %v", err)))
+	}
+
+	// Use the subject when the token doesn't hold a tenant
+	tenant, _ := claims[verifier.claim].(string)
+	if tenant == "" {
+		tenant, _ = claims["sub"].(string)
+	}
+	if tenant == "" {
+		return ctx.JSON(http.StatusUnauthorized, tsl.NewError(fmt.Errorf("JWT expects a %q or a \"sub\" claim", verifier.claim)))
+	}
+
+	ctx.Set(TenantKey, tenant)
+	return next(ctx)
+}
+
+// Parse a JWT, returns its claims when its signature, its dates, its issuer and its audience are valid
+func (verifier *jwtVerifier) verify(token string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != verifier.algorithm {
+			return nil, fmt.Errorf("unexpected signing method %q", token.Method.Alg())
+		}
+		return verifier.key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The dates are only checked when set: a token without expiration would be valid forever
+	if verifier.requireExpiration && !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("expects an \"exp\" expiration claim")
+	}
+	if verifier.issuer != "" && !claims.VerifyIssuer(verifier.issuer, true) {
+		return nil, fmt.Errorf("expects the %q issuer", verifier.issuer)
+	}
+	if verifier.audience != "" && !hasAudience(claims, verifier.audience) {
+		return nil, fmt.Errorf("expects the %q audience", verifier.audience)
+	}
+	return claims, nil
+}
+
+// Check if the audience claim of a JWT, a string or a list of strings, holds an audience
+func hasAudience(claims jwt.MapClaims, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, item := range aud {
+			if item == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Load the JWT verification key of a signing algorithm
+func loadJWTKey(algorithm string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(algorithm, "HS"):
+		secret := viper.GetString("tsl.auth.jwt.secret")
+		if secret == "" {
+			return nil, fmt.Errorf("JWT %s algorithm expects a secret", algorithm)
+		}
+		return []byte(secret), nil
+
+	case strings.HasPrefix(algorithm, "RS"):
+		pem, err := ioutil.ReadFile(viper.GetString("tsl.auth.jwt.publicKey"))
+		if err != nil {
+			return nil, fmt.Errorf("JWT %s algorithm expects a public key file: %v", algorithm, err)
+		}
+		return jwt.ParseRSAPublicKeyFromPEM(pem)
+	}
+
+	return nil, fmt.Errorf("unsupported JWT algorithm %q, expects a HS or a RS one", algorithm)
+}
+
+// JWT middleware
+// authenticate requests with a JWT and set the tenant of its claims in the context
+func JWT() (echo.MiddlewareFunc, error) {
+	algorithm := defaultJWTAlgorithm
+	if viper.IsSet("tsl.auth.jwt.algorithm") {
+		algorithm = strings.ToUpper(viper.GetString("tsl.auth.jwt.algorithm"))
+	}
+	if jwt.GetSigningMethod(algorithm) == nil {
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", algorithm)
+	}
+
+	key, err := loadJWTKey(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier := &jwtVerifier{
+		algorithm:         algorithm,
+		key:               key,
+		claim:             defaultTenantClaim,
+		requireExpiration: true,
+		issuer:            viper.GetString("tsl.auth.jwt.issuer"),
+		audience:          viper.GetString("tsl.auth.jwt.audience"),
+	}
+	if viper.IsSet("tsl.auth.jwt.claim") {
+		verifier.claim = viper.GetString("tsl.auth.jwt.claim")
+	}
+	if viper.IsSet("tsl.auth.jwt.requireExpiration") {
+		verifier.requireExpiration = viper.GetBool("tsl.auth.jwt.requireExpiration")
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			return verifier.authenticate(ctx, next)
+		}
+	}, nil
+}
@@ -0,0 +1,165 @@
+package middlewares
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/spf13/viper"
+)
+
+// Authenticate a request with a JWT, returns the response status and the authenticated tenant
+func authenticateJWT(t *testing.T, token string) (int, string) {
+	t.Helper()
+
+	middleware, err := JWT()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tenant := ""
+	handler := middleware(func(ctx echo.Context) error {
+		tenant, _ = ctx.Get(TenantKey).(string)
+		return ctx.NoContent(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v0/query", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	if err := handler(echo.New().NewContext(req, rec)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return rec.Code, tenant
+}
+
+// Sign claims with a signing method and a key
+func signJWT(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return token
+}
+
+func TestJWTHS(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("tsl.auth.jwt.secret", "my-secret")
+
+	expires := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name     string
+		token    string
+		expected int
+	}{
+		{"valid", signJWT(t, jwt.SigningMethodHS256, []byte("my-secret"), jwt.MapClaims{"tenant": "team-a", "exp": expires}), http.StatusOK},
+		{"expired", signJWT(t, jwt.SigningMethodHS256, []byte("my-secret"), jwt.MapClaims{"tenant": "team-a", "exp": time.Now().Add(-time.Minute).Unix()}), http.StatusUnauthorized},
+		{"missing exp", signJWT(t, jwt.SigningMethodHS256, []byte("my-secret"), jwt.MapClaims{"tenant": "team-a"}), http.StatusUnauthorized},
+		{"wrong signature", signJWT(t, jwt.SigningMethodHS256, []byte("other-secret"), jwt.MapClaims{"tenant": "team-a", "exp": expires}), http.StatusUnauthorized},
+		{"other algorithm", signJWT(t, jwt.SigningMethodHS512, []byte("my-secret"), jwt.MapClaims{"tenant": "team-a", "exp": expires}), http.StatusUnauthorized},
+		{"missing tenant", signJWT(t, jwt.SigningMethodHS256, []byte("my-secret"), jwt.MapClaims{"exp": expires}), http.StatusUnauthorized},
+		{"not a JWT", "my-secret", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		status, tenant := authenticateJWT(t, test.token)
+		if status != test.expected {
+			t.Errorf("%s: expected a %d status, got %d", test.name, test.expected, status)
+		}
+		if status == http.StatusOK && tenant != "team-a" {
+			t.Errorf("%s: expected the team-a tenant, got %q", test.name, tenant)
+		}
+	}
+
+	// The expiration can be optional
+	viper.Set("tsl.auth.jwt.requireExpiration", false)
+	if status, _ := authenticateJWT(t, signJWT(t, jwt.SigningMethodHS256, []byte("my-secret"), jwt.MapClaims{"sub": "team-a"})); status != http.StatusOK {
+		t.Errorf("expected a token without expiration to be valid when it's optional, got %d", status)
+	}
+}
+
+func TestJWTRS(t *testing.T) {
+	defer viper.Reset()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})
+
+	file, err := ioutil.TempFile("", "tsl-jwt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(file.Name())
+	file.Write(publicPEM)
+	file.Close()
+
+	viper.Set("tsl.auth.jwt.algorithm", "RS256")
+	viper.Set("tsl.auth.jwt.publicKey", file.Name())
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	claims := jwt.MapClaims{"tenant": "team-a", "exp": time.Now().Add(time.Hour).Unix()}
+	tests := []struct {
+		name     string
+		token    string
+		expected int
+	}{
+		{"valid", signJWT(t, jwt.SigningMethodRS256, key, claims), http.StatusOK},
+		{"wrong signature", signJWT(t, jwt.SigningMethodRS256, otherKey, claims), http.StatusUnauthorized},
+
+		// An HS token signed with the public key, known by the clients, isn't verified as a HS one
+		{"algorithm confusion", signJWT(t, jwt.SigningMethodHS256, publicPEM, claims), http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		if status, _ := authenticateJWT(t, test.token); status != test.expected {
+			t.Errorf("%s: expected a %d status, got %d", test.name, test.expected, status)
+		}
+	}
+}
+
+func TestJWTIssuerAndAudience(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("tsl.auth.jwt.secret", "my-secret")
+	viper.Set("tsl.auth.jwt.issuer", "https://auth.example.com")
+	viper.Set("tsl.auth.jwt.audience", "tsl")
+
+	expires := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name     string
+		claims   jwt.MapClaims
+		expected int
+	}{
+		{"valid", jwt.MapClaims{"sub": "team-a", "exp": expires, "iss": "https://auth.example.com", "aud": "tsl"}, http.StatusOK},
+		{"audience list", jwt.MapClaims{"sub": "team-a", "exp": expires, "iss": "https://auth.example.com", "aud": []string{"grafana", "tsl"}}, http.StatusOK},
+		{"wrong issuer", jwt.MapClaims{"sub": "team-a", "exp": expires, "iss": "https://other.example.com", "aud": "tsl"}, http.StatusUnauthorized},
+		{"missing issuer", jwt.MapClaims{"sub": "team-a", "exp": expires, "aud": "tsl"}, http.StatusUnauthorized},
+		{"wrong audience", jwt.MapClaims{"sub": "team-a", "exp": expires, "iss": "https://auth.example.com", "aud": []string{"grafana"}}, http.StatusUnauthorized},
+		{"missing audience", jwt.MapClaims{"sub": "team-a", "exp": expires, "iss": "https://auth.example.com"}, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		if status, _ := authenticateJWT(t, signJWT(t, jwt.SigningMethodHS256, []byte("my-secret"), test.claims)); status != test.expected {
+			t.Errorf("%s: expected a %d status, got %d", test.name, test.expected, status)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package middlewares
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/ovh/tsl/tsl"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+const (
+	tokenScope = "token"
+	ipScope    = "ip"
+
+	rateReason       = "rate"
+	concurrentReason = "concurrent"
+	quotaReason      = "quota"
+
+	storeSweepInterval = time.Minute
+)
+
+// LimitStore stores the rate limiting state of each client key
+type LimitStore interface {
+	// Check a token is left in a key bucket refilled at rate per second up to burst, returns the delay before a token is available when empty
+	Available(key string, rate float64, burst int, now time.Time) (bool, time.Duration)
+	// Take a token in a key bucket refilled at rate per second up to burst, returns the delay before a token is available when empty
+	Take(key string, rate float64, burst int, now time.Time) (bool, time.Duration)
+	// Check a key daily quota isn't reached, returns the delay before the quota reset when reached
+	Remaining(key string, quota int64, now time.Time) (bool, time.Duration)
+	// Count a request in a key daily quota, returns the delay before the quota reset when reached
+	Consume(key string, quota int64, now time.Time) (bool, time.Duration)
+	// Acquire a key concurrent query slot
+	Acquire(key string, limit int) bool
+	// Release a key concurrent query slot
+	Release(key string)
+}
+
+// limits of a client scope, a zero limit is disabled
+type limits struct {
+	scope      string
+	rate       float64
+	burst      int
+	concurrent int
+	daily      int64
+}
+
+// Load the limits of a client scope
+func loadLimits(scope string) limits {
+	key := "tsl.limits." + scope
+	scopeLimits := limits{
+		scope:      scope,
+		rate:       viper.GetFloat64(key + ".rate"),
+		burst:      viper.GetInt(key + ".burst"),
+		concurrent: viper.GetInt(key + ".concurrent"),
+		daily:      viper.GetInt64(key + ".daily"),
+	}
+	if scopeLimits.burst <= 0 {
+		scopeLimits.burst = int(math.Max(1, math.Ceil(scopeLimits.rate)))
+	}
+	return scopeLimits
+}
+
+// Get the key of a client in a scope, empty when the request doesn't belong to the scope
+func limitKey(ctx echo.Context, scope string) string {
+	if scope == ipScope {
+		return ipScope + ":" + clientIP(ctx.Request())
+	}
+
+	if tenant, ok := ctx.Get(TenantKey).(string); ok {
+		return "tenant:" + tenant
+	}
+
+	authorization := ctx.Request().Header.Get("Authorization")
+	if authorization == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%x", tokenScope, sha256.Sum256([]byte(authorization)))
+}
+
+// ClientKey get the key identifying a request client: its tenant, its token or its IP
+func ClientKey(ctx echo.Context) string {
+	if key := limitKey(ctx, tokenScope); key != "" {
+		return key
+	}
+	return limitKey(ctx, ipScope)
+}
+
+// Get the IP of a request client: its connection address, or the last address forwarded by the trusted proxies
+// in the X-Forwarded-For or X-Real-IP headers when it connects through one of them
+func clientIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	proxies := viper.GetStringSlice("tsl.limits.trustedProxies")
+	if !isTrustedProxy(ip, proxies) {
+		return ip
+	}
+
+	// Each proxy appends the address it received the request from
+	forwarded := strings.Split(req.Header.Get(echo.HeaderXForwardedFor), ",")
+	for index := len(forwarded) - 1; index >= 0; index-- {
+		address := strings.TrimSpace(forwarded[index])
+		if address == "" {
+			continue
+		}
+		ip = address
+		if !isTrustedProxy(ip, proxies) {
+			return ip
+		}
+	}
+
+	if realIP := req.Header.Get(echo.HeaderXRealIP); realIP != "" {
+		return realIP
+	}
+	return ip
+}
+
+// Check if an IP belongs to the trusted proxies networks
+func isTrustedProxy(ip string, proxies []string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		_, network, err := net.ParseCIDR(proxy)
+		if err == nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimiter checks the limits of each client scope of a request
+type rateLimiter struct {
+	store      LimitStore
+	scopes     []limits
+	rejections *prometheus.CounterVec
+}
+
+func (limiter *rateLimiter) reject(ctx echo.Context, scope string, reason string, retryAfter time.Duration) error {
+	limiter.rejections.With(prometheus.Labels{"scope": scope, "reason": reason}).Inc()
+
+	ctx.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds())))))
+	return ctx.JSON(http.StatusTooManyRequests, tsl.NewError(fmt.Errorf("too many requests: %s %s limit reached", scope, reason)))
+}
+
+func (limiter *rateLimiter) limit(ctx echo.Context, next echo.HandlerFunc) error {
+	now := time.Now()
+
+	acquired := []string{}
+	defer func() {
+		for _, key := range acquired {
+			limiter.store.Release(key)
+		}
+	}()
+
+	keys := make([]string, len(limiter.scopes))
+	for index, scopeLimits := range limiter.scopes {
+		keys[index] = limitKey(ctx, scopeLimits.scope)
+	}
+
+	// Check all scopes before taking anything, a request rejected by a scope doesn't count in the others
+	for index, scopeLimits := range limiter.scopes {
+		key := keys[index]
+		if key == "" {
+			continue
+		}
+
+		if scopeLimits.rate > 0 {
+			if ok, retryAfter := limiter.store.Available(key, scopeLimits.rate, scopeLimits.burst, now); !ok {
+				return limiter.reject(ctx, scopeLimits.scope, rateReason, retryAfter)
+			}
+		}
+
+		if scopeLimits.daily > 0 {
+			if ok, retryAfter := limiter.store.Remaining(key, scopeLimits.daily, now); !ok {
+				return limiter.reject(ctx, scopeLimits.scope, quotaReason, retryAfter)
+			}
+		}
+	}
+
+	for index, scopeLimits := range limiter.scopes {
+		if keys[index] == "" || scopeLimits.concurrent <= 0 {
+			continue
+		}
+		if !limiter.store.Acquire(keys[index], scopeLimits.concurrent) {
+			return limiter.reject(ctx, scopeLimits.scope, concurrentReason, time.Second)
+		}
+		acquired = append(acquired, keys[index])
+	}
+
+	// Another request may have taken the last token or quota since the check
+	for index, scopeLimits := range limiter.scopes {
+		key := keys[index]
+		if key == "" {
+			continue
+		}
+
+		if scopeLimits.rate > 0 {
+			if ok, retryAfter := limiter.store.Take(key, scopeLimits.rate, scopeLimits.burst, now); !ok {
+				return limiter.reject(ctx, scopeLimits.scope, rateReason, retryAfter)
+			}
+		}
+
+		if scopeLimits.daily > 0 {
+			if ok, retryAfter := limiter.store.Consume(key, scopeLimits.daily, now); !ok {
+				return limiter.reject(ctx, scopeLimits.scope, quotaReason, retryAfter)
+			}
+		}
+	}
+
+	return next(ctx)
+}
+
+// RateLimit middleware
+// enforce the per token and per IP request rates, concurrent queries and daily quotas
+func RateLimit(store LimitStore, promRegistry *prometheus.Registry) echo.MiddlewareFunc {
+	limiter := &rateLimiter{
+		store:  store,
+		scopes: []limits{loadLimits(tokenScope), loadLimits(ipScope)},
+	}
+
+	limiter.rejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tsl",
+		Subsystem: "controller",
+		Name:      "rejections",
+		Help:      "Number of request rejected by the rate limits.",
+	}, []string{"scope", "reason"})
+	promRegistry.MustRegister(limiter.rejections)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			return limiter.limit(ctx, next)
+		}
+	}
+}
+
+// MemoryStore is an in-memory LimitStore using token buckets
+type MemoryStore struct {
+	mutex      sync.Mutex
+	buckets    map[string]*bucket
+	quotas     map[string]*quota
+	concurrent map[string]int
+	lastSweep  time.Time
+}
+
+type bucket struct {
+	tokens float64
+	burst  int
+	rate   float64
+	last   time.Time
+}
+
+type quota struct {
+	day   time.Time
+	count int64
+}
+
+// NewMemoryStore is creating an empty in-memory limit store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:    make(map[string]*bucket),
+		quotas:     make(map[string]*quota),
+		concurrent: make(map[string]int),
+		lastSweep:  time.Now(),
+	}
+}
+
+// Check a token is left in a key bucket
+func (store *MemoryStore) Available(key string, rate float64, burst int, now time.Time) (bool, time.Duration) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.refill(key, rate, burst, now)
+}
+
+// Take a token in a key bucket
+func (store *MemoryStore) Take(key string, rate float64, burst int, now time.Time) (bool, time.Duration) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	ok, retryAfter := store.refill(key, rate, burst, now)
+	if ok {
+		store.buckets[key].tokens--
+	}
+	return ok, retryAfter
+}
+
+// Refill a key bucket, returns whether a token is left and otherwise the delay before one is, must be called with the store lock
+func (store *MemoryStore) refill(key string, rate float64, burst int, now time.Time) (bool, time.Duration) {
+	store.sweep(now)
+
+	keyBucket, ok := store.buckets[key]
+	if !ok {
+		keyBucket = &bucket{tokens: float64(burst), burst: burst, rate: rate, last: now}
+		store.buckets[key] = keyBucket
+	}
+
+	keyBucket.tokens = math.Min(float64(burst), keyBucket.tokens+now.Sub(keyBucket.last).Seconds()*rate)
+	keyBucket.last = now
+
+	if keyBucket.tokens < 1 {
+		return false, time.Duration((1 - keyBucket.tokens) / rate * float64(time.Second))
+	}
+	return true, 0
+}
+
+// Check a key daily quota isn't reached
+func (store *MemoryStore) Remaining(key string, limit int64, now time.Time) (bool, time.Duration) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.dailyQuota(key, limit, now)
+}
+
+// Consume a key daily quota, reset each day at midnight UTC
+func (store *MemoryStore) Consume(key string, limit int64, now time.Time) (bool, time.Duration) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	ok, retryAfter := store.dailyQuota(key, limit, now)
+	if ok {
+		store.quotas[key].count++
+	}
+	return ok, retryAfter
+}
+
+// Get a key quota of the day, returns whether it isn't reached and otherwise the delay before its reset, must be called with the store lock
+func (store *MemoryStore) dailyQuota(key string, limit int64, now time.Time) (bool, time.Duration) {
+	store.sweep(now)
+
+	day := now.UTC().Truncate(24 * time.Hour)
+	keyQuota, ok := store.quotas[key]
+	if !ok || !keyQuota.day.Equal(day) {
+		keyQuota = &quota{day: day}
+		store.quotas[key] = keyQuota
+	}
+
+	if keyQuota.count >= limit {
+		return false, day.Add(24 * time.Hour).Sub(now)
+	}
+	return true, 0
+}
+
+// Acquire a key concurrent query slot
+func (store *MemoryStore) Acquire(key string, limit int) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.concurrent[key] >= limit {
+		return false
+	}
+	store.concurrent[key]++
+	return true
+}
+
+// Release a key concurrent query slot
+func (store *MemoryStore) Release(key string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.concurrent[key]--
+	if store.concurrent[key] <= 0 {
+		delete(store.concurrent, key)
+	}
+}
+
+// Remove the full buckets and the past days quotas, must be called with the store lock
+func (store *MemoryStore) sweep(now time.Time) {
+	if now.Sub(store.lastSweep) < storeSweepInterval {
+		return
+	}
+	store.lastSweep = now
+
+	for key, keyBucket := range store.buckets {
+		if keyBucket.tokens+now.Sub(keyBucket.last).Seconds()*keyBucket.rate >= float64(keyBucket.burst) {
+			delete(store.buckets, key)
+		}
+	}
+
+	day := now.UTC().Truncate(24 * time.Hour)
+	for key, keyQuota := range store.quotas {
+		if !keyQuota.day.Equal(day) {
+			delete(store.quotas, key)
+		}
+	}
+}
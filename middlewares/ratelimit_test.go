@@ -0,0 +1,92 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+func TestClientIP(t *testing.T) {
+	defer viper.Reset()
+
+	tests := []struct {
+		proxies   []string
+		remote    string
+		forwarded string
+		realIP    string
+		expected  string
+	}{
+		{nil, "192.0.2.1:1234", "203.0.113.1", "203.0.113.2", "192.0.2.1"},
+		{[]string{"10.0.0.0/8"}, "192.0.2.1:1234", "203.0.113.1", "", "192.0.2.1"},
+		{[]string{"10.0.0.0/8"}, "10.0.0.1:1234", "203.0.113.1", "", "203.0.113.1"},
+		{[]string{"10.0.0.0/8"}, "10.0.0.1:1234", "198.51.100.1, 203.0.113.1, 10.0.0.2", "", "203.0.113.1"},
+		{[]string{"10.0.0.0/8"}, "10.0.0.1:1234", "", "203.0.113.2", "203.0.113.2"},
+		{[]string{"10.0.0.0/8"}, "10.0.0.1:1234", "", "", "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		viper.Set("tsl.limits.trustedProxies", test.proxies)
+
+		req := httptest.NewRequest(http.MethodPost, "/v0/query", nil)
+		req.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			req.Header.Set(echo.HeaderXForwardedFor, test.forwarded)
+		}
+		if test.realIP != "" {
+			req.Header.Set(echo.HeaderXRealIP, test.realIP)
+		}
+
+		if ip := clientIP(req); ip != test.expected {
+			t.Errorf("%s forwarding %q: expected %s, got %s", test.remote, test.forwarded, test.expected, ip)
+		}
+	}
+}
+
+func TestRateLimitChecksAllScopes(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("tsl.limits.token.rate", 100)
+	viper.Set("tsl.limits.ip.daily", 1)
+
+	store := NewMemoryStore()
+	handler := RateLimit(store, prometheus.NewRegistry())(func(ctx echo.Context) error {
+		return ctx.NoContent(http.StatusOK)
+	})
+
+	e := echo.New()
+	statuses := []int{}
+	for run := 0; run < 3; run++ {
+		rec := httptest.NewRecorder()
+		if err := handler(e.NewContext(authorizedRequest(), rec)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		statuses = append(statuses, rec.Code)
+	}
+
+	if statuses[0] != http.StatusOK || statuses[1] != http.StatusTooManyRequests || statuses[2] != http.StatusTooManyRequests {
+		t.Fatalf("expected the IP quota to reject the requests after the first one, got %v", statuses)
+	}
+
+	// The requests rejected by the IP quota didn't take the token bucket tokens
+	now := time.Now()
+	key := limitKey(e.NewContext(authorizedRequest(), nil), tokenScope)
+	for taken := 0; taken < 99; taken++ {
+		if ok, _ := store.Take(key, 100, 100, now); !ok {
+			t.Fatalf("expected 99 tokens left after a single accepted request, got %d", taken)
+		}
+	}
+	if ok, _ := store.Available(key, 100, 100, now); ok {
+		t.Error("expected the token bucket to be empty")
+	}
+}
+
+func authorizedRequest() *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/v0/query", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set(echo.HeaderAuthorization, "Bearer TOKEN")
+	return req
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ovh/tsl/tsl"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/viper"
+)
+
+// Get the cost estimation parser of the configured back-ends
+func costParser() tsl.ProtoParser {
+	return warpParser("admission", 0)
+}
+
+// Check the estimated cost of a query statements against the admission thresholds,
+// down-sampling their samplers above the buckets threshold when enabled
+func admitQuery(statements []*tsl.Instruction, now time.Time) error {
+	if !viper.IsSet("tsl.admission") {
+		return nil
+	}
+
+	protoParser := costParser()
+	defaultType := viper.GetString("tsl.default.type")
+
+	maxSelects := viper.GetInt("tsl.admission.maxSelects")
+	maxRange := time.Duration(0)
+	if viper.IsSet("tsl.admission.maxRange") {
+		duration, err := model.ParseDuration(viper.GetString("tsl.admission.maxRange"))
+		if err != nil {
+			return fmt.Errorf("unvalid admission maxRange: %v", err)
+		}
+		maxRange = time.Duration(duration)
+	}
+	maxLastPoints := viper.GetInt64("tsl.admission.maxLastPoints")
+	maxBuckets := viper.GetInt64("tsl.admission.maxBuckets")
+	allowSelectAll := !viper.IsSet("tsl.admission.allowSelectAll") || viper.GetBool("tsl.admission.allowSelectAll")
+
+	selects := 0
+	lastPoints := int64(0)
+	for index, instruction := range statements {
+		if maxBuckets > 0 && viper.GetBool("tsl.admission.downSample") {
+			protoParser.DownSample(instruction, now, defaultType, maxBuckets)
+		}
+
+		cost := protoParser.EstimateCost(*instruction, now, defaultType)
+		selects += cost.Selects
+		lastPoints += cost.LastPoints
+
+		if cost.SelectAll > 0 && !allowSelectAll {
+			return fmt.Errorf("query rejected: statement %d selects all metrics, select a metric name", index+1)
+		}
+		if maxRange > 0 && cost.UnknownRange {
+			return fmt.Errorf("query rejected: statement %d time range can't be estimated, use a from with dates or a last duration below the maximum of %v", index+1, maxRange)
+		}
+		if maxRange > 0 && cost.Range > maxRange.Seconds() {
+			return fmt.Errorf("query rejected: statement %d time range of %v exceeds the maximum of %v", index+1, time.Duration(cost.Range*float64(time.Second)), maxRange)
+		}
+		if maxBuckets > 0 && cost.Buckets > maxBuckets {
+			return fmt.Errorf("query rejected: statement %d samples %d buckets per series, exceeds the maximum of %d, use a larger span", index+1, cost.Buckets, maxBuckets)
+		}
+	}
+
+	if maxSelects > 0 && selects > maxSelects {
+		return fmt.Errorf("query rejected: %d selects exceeds the maximum of %d", selects, maxSelects)
+	}
+	if maxLastPoints > 0 && lastPoints > maxLastPoints {
+		return fmt.Errorf("query rejected: %d last values per series exceeds the maximum of %d", lastPoints, maxLastPoints)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ovh/tsl/tsl"
+	"github.com/spf13/viper"
+)
+
+func admissionStatements(t *testing.T, query string) []*tsl.Instruction {
+	t.Helper()
+
+	parser, err := tsl.NewParser(strings.NewReader(query), "http://127.0.0.1:8080", "TOKEN", 0, "", "", []string{"start"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	parsed, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %v", query, err)
+	}
+	return parsed.Statements
+}
+
+func TestAdmitQuery(t *testing.T) {
+	defer viper.Reset()
+
+	viper.Set("tsl.default.type", tsl.WARP.String())
+	viper.Set("tsl.admission.maxSelects", 2)
+	viper.Set("tsl.admission.maxRange", "1d")
+	viper.Set("tsl.admission.maxLastPoints", 100)
+	viper.Set("tsl.admission.maxBuckets", 1000)
+	viper.Set("tsl.admission.allowSelectAll", false)
+
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{`select("cpu").last(1h)`, ""},
+		{`select("cpu").last(100)`, ""},
+		{`select("cpu").names()`, ""},
+		{`select(*).last(1h)`, "query rejected: statement 1 selects all metrics"},
+		{`select("cpu").last(2d)`, "query rejected: statement 1 time range of 48h0m0s exceeds the maximum of 24h0m0s"},
+		{`select("cpu").from(start)`, "query rejected: statement 1 time range can't be estimated"},
+		{`select("cpu")`, "query rejected: statement 1 time range can't be estimated"},
+		{`add(select("a").last(1h), select("b").from(start))`, "query rejected: statement 1 time range can't be estimated"},
+		{`select("cpu").last(1d).sampleBy(1m, max)`, "query rejected: statement 1 samples 1440 buckets per series, exceeds the maximum of 1000"},
+		{"select(\"a\").last(1h)\nselect(\"b\").last(1h)\nselect(\"c\").last(1h)", "query rejected: 3 selects exceeds the maximum of 2"},
+		{"select(\"a\").last(60)\nselect(\"b\").last(60)", "query rejected: 120 last values per series exceeds the maximum of 100"},
+	}
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		err := admitQuery(admissionStatements(t, test.query), now)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.query, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%s: expected a %q error, got %v", test.query, test.err, err)
+		}
+	}
+}
+
+func TestAdmitQueryDownSample(t *testing.T) {
+	defer viper.Reset()
+
+	viper.Set("tsl.default.type", tsl.WARP.String())
+	viper.Set("tsl.admission.maxBuckets", 1000)
+	viper.Set("tsl.admission.downSample", true)
+
+	statements := admissionStatements(t, `select("cpu").last(1d).sampleBy(1m, max)`)
+	if err := admitQuery(statements, time.Now()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	protoParser := costParser()
+	if cost := protoParser.EstimateCost(*statements[0], time.Now(), tsl.WARP.String()); cost.Buckets > 1000 {
+		t.Errorf("expected a down-sampling to at most 1000 buckets, got %d", cost.Buckets)
+	}
+}
+
+func TestAdmitQueryWithoutRange(t *testing.T) {
+	defer viper.Reset()
+
+	// Without maxRange, a select whose range can't be estimated is admitted
+	viper.Set("tsl.default.type", tsl.WARP.String())
+	viper.Set("tsl.admission.maxSelects", 2)
+
+	if err := admitQuery(admissionStatements(t, `select("cpu").from(start)`), time.Now()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
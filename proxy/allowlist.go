@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ovh/tsl/tsl"
+	"github.com/spf13/viper"
+)
+
+// TokenPermission lists the back-ends a token is allowed to query
+type TokenPermission struct {
+	Token    string   `mapstructure:"token"`
+	Backends []string `mapstructure:"backends"`
+}
+
+// permissionError is an error raised when a query uses a back-end it isn't allowed to
+type permissionError struct {
+	err error
+}
+
+func (e *permissionError) Error() string {
+	return e.err.Error()
+}
+
+// Get the HTTP status of an error raised when preparing a query, forbidden for a permission error
+func queryErrorStatus(err error) int {
+	if _, isPermissionError := err.(*permissionError); isPermissionError {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// Check that each back-end used by an instruction can be queried by the request token or tenant
+func checkConnect(instruction tsl.Instruction, token string, tenant *Tenant) error {
+	permissions := []TokenPermission{}
+	if err := viper.UnmarshalKey("tsl.connect.permissions", &permissions); err != nil {
+		return err
+	}
+
+	for _, backendInstruction := range instruction.GetBackendInstructions() {
+		api := backendInstruction.GetConnectAPI()
+
+		if backendInstruction.GetConnectType() != "" && viper.IsSet("tsl.connect.enabled") && !viper.GetBool("tsl.connect.enabled") {
+			return &permissionError{err: errors.New("connect is disabled, queries can only use the default backend")}
+		}
+
+		if !isConfiguredEndpoint(api) && !isAllowedEndpoint(api) {
+			return &permissionError{err: fmt.Errorf("backend %q is not allowed", api)}
+		}
+
+		if tenant != nil && !contains(tenant.endpoints(), api) {
+			return &permissionError{err: fmt.Errorf("backend %q is not allowed for tenant %q", api, tenant.Name)}
+		}
+
+		for _, permission := range permissions {
+			if permission.Token == token && !contains(permission.Backends, api) {
+				return &permissionError{err: fmt.Errorf("backend %q is not allowed for this token", api)}
+			}
+		}
+	}
+	return nil
+}
+
+// Get the back-end type of an instruction
+func getBackendType(instruction tsl.Instruction) string {
+	backend := instruction.GetConnectType()
+	if backend == "" {
+		backend = viper.GetString("tsl.default.type")
+	}
+	if backend == tsl.PROM.String() {
+		backend = tsl.PROMETHEUS.String()
+	}
+	return backend
+}
+
+// Check if a back-end endpoint can be executed for a back-end type
+func isExecutableEndpoint(backendType string, api string) bool {
+	return contains(configuredEndpoints(backendType), api) || isAllowedEndpoint(api)
+}
+
+// Check if an endpoint is the default one, a configured one or a pool
+func isConfiguredEndpoint(api string) bool {
+	return api == viper.GetString("tsl.default.endpoint") ||
+		contains(configuredEndpoints(tsl.WARP.String()), api) ||
+		contains(configuredEndpoints(tsl.PROMETHEUS.String()), api)
+}
+
+// Check if an endpoint matches the allowlist schemes, and its hosts or networks
+func isAllowedEndpoint(api string) bool {
+	hosts := viper.GetStringSlice("tsl.connect.allowlist.hosts")
+	cidrs := viper.GetStringSlice("tsl.connect.allowlist.cidrs")
+	if len(hosts) == 0 && len(cidrs) == 0 {
+		return false
+	}
+
+	endpoint, err := url.Parse(api)
+	if err != nil || endpoint.Hostname() == "" {
+		return false
+	}
+
+	schemes := []string{"http", "https"}
+	if viper.IsSet("tsl.connect.allowlist.schemes") {
+		schemes = viper.GetStringSlice("tsl.connect.allowlist.schemes")
+	}
+	if !contains(schemes, endpoint.Scheme) {
+		return false
+	}
+
+	host := strings.ToLower(endpoint.Hostname())
+	if isAllowedHost(host) {
+		return true
+	}
+
+	if len(cidrs) == 0 {
+		return false
+	}
+
+	// The addresses of a host name are checked when dialed, as they may change once resolved
+	if ip := net.ParseIP(host); ip != nil {
+		return inNetworks(ip, cidrs)
+	}
+	return true
+}
+
+// Check if an endpoint is set in the configuration, as back-end, pool endpoint or sink
+func isTrustedEndpoint(api string) bool {
+	if isConfiguredEndpoint(api) || contains(viper.GetStringSlice("tsl.store.remoteWrite"), api) {
+		return true
+	}
+
+	for _, key := range []string{"tsl.rules.warp10.endpoint", "tsl.rules.remoteWrite.url", "tsl.rules.alertmanager.url"} {
+		if api == viper.GetString(key) {
+			return true
+		}
+	}
+
+	for _, pool := range pools {
+		for _, endpoint := range pool.endpoints {
+			if endpoint.url == api {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Get the HTTP client of an endpoint, the endpoints allowed by the allowlist being checked when dialed
+func backendClient(api string) *http.Client {
+	if isTrustedEndpoint(api) {
+		return http.DefaultClient
+	}
+	return allowlistClient
+}
+
+// HTTP client of the endpoints allowed by the allowlist, checking the dialed addresses and the redirects
+var allowlistClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:           dialAllowed,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	},
+	CheckRedirect: checkAllowedRedirect,
+}
+
+// Dial an allowed endpoint, the addresses of a host not listed in the allowlist hosts must belong to its networks
+func dialAllowed(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !isAllowedHost(host) {
+		cidrs := viper.GetStringSlice("tsl.connect.allowlist.cidrs")
+		dialer.Control = func(network string, address string, conn syscall.RawConn) error {
+			ip, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if parsed := net.ParseIP(ip); parsed == nil || !inNetworks(parsed, cidrs) {
+				return fmt.Errorf("address %s of host %q is not allowed", ip, host)
+			}
+			return nil
+		}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// Check a redirect of an allowed endpoint targets an allowed endpoint
+func checkAllowedRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if !isAllowedEndpoint(req.URL.String()) {
+		return fmt.Errorf("redirect to host %q is not allowed", req.URL.Hostname())
+	}
+	return nil
+}
+
+// Check if a host is listed in the allowlist hosts
+func isAllowedHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range viper.GetStringSlice("tsl.connect.allowlist.hosts") {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if an IP belongs to one of the networks
+func inNetworks(ip net.IP, cidrs []string) bool {
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
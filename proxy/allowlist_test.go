@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/ovh/tsl/tsl"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// Get a local Warp 10 endpoint by its host name, to be resolved when dialed
+func localhostEndpoint(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+
+	endpoint, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected server URL: %v", err)
+	}
+	return "http://localhost:" + endpoint.Port()
+}
+
+func TestAllowlistDialedAddresses(t *testing.T) {
+	defer viper.Reset()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+	api := localhostEndpoint(t, server)
+
+	// The host name is allowed by a network, its loopback address doesn't belong to
+	viper.Set("tsl.connect.allowlist.cidrs", []string{"10.0.0.0/8"})
+	if !isAllowedEndpoint(api) {
+		t.Fatalf("expected %s to be checked when dialed", api)
+	}
+	if _, err := execWarp(&Request{Body: "NOW"}, api, context.Background()); err == nil || !strings.Contains(err.Error(), "is not allowed") {
+		t.Errorf("expected the dialed address to be rejected, got %v", err)
+	}
+
+	viper.Set("tsl.connect.allowlist.cidrs", []string{"127.0.0.0/8", "::1/128"})
+	if _, err := execWarp(&Request{Body: "NOW"}, api, context.Background()); err != nil {
+		t.Errorf("expected the dialed address to be allowed, got %v", err)
+	}
+
+	// A literal address is checked at once
+	viper.Set("tsl.connect.allowlist.cidrs", []string{"10.0.0.0/8"})
+	if isAllowedEndpoint(server.URL) {
+		t.Errorf("expected %s not to be allowed", server.URL)
+	}
+}
+
+func TestAllowlistRedirects(t *testing.T) {
+	defer viper.Reset()
+
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer internal.Close()
+
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer redirect.Close()
+	api := localhostEndpoint(t, redirect)
+
+	// The redirecting host is allowed by name, the redirect target isn't
+	viper.Set("tsl.connect.allowlist.hosts", []string{"localhost"})
+	if _, err := execWarp(&Request{Body: "NOW"}, api, context.Background()); err == nil || !strings.Contains(err.Error(), "redirect to host") {
+		t.Errorf("expected the redirect to be rejected, got %v", err)
+	}
+
+	viper.Set("tsl.connect.allowlist.hosts", []string{"localhost", "127.0.0.1"})
+	if _, err := execWarp(&Request{Body: "NOW"}, api, context.Background()); err != nil {
+		t.Errorf("expected the redirect to be followed, got %v", err)
+	}
+}
+
+func TestTrustedEndpointClient(t *testing.T) {
+	defer viper.Reset()
+
+	viper.Set("tsl.warp10.endpoints", []string{"http://127.0.0.1:8080"})
+	viper.Set("tsl.store.remoteWrite", []string{"http://127.0.0.1:9201/write"})
+
+	for _, api := range []string{"http://127.0.0.1:8080", "http://127.0.0.1:9201/write"} {
+		if backendClient(api) != http.DefaultClient {
+			t.Errorf("expected the default client for the configured endpoint %s", api)
+		}
+	}
+	if backendClient("http://127.0.0.1:8081") != allowlistClient {
+		t.Error("expected the allowlist client for an endpoint only allowed by the allowlist")
+	}
+}
+
+func TestPermissionErrorStatus(t *testing.T) {
+	defer viper.Reset()
+
+	viper.Set("tsl.default.type", tsl.WARP.String())
+	viper.Set("tsl.default.endpoint", "http://127.0.0.1:8080")
+	viper.Set("tsl.warp10.endpoints", []string{"http://127.0.0.1:8080"})
+
+	proxyTsl := NewProxyTSL(prometheus.NewRegistry())
+	jobs := NewJobQueue(prometheus.NewRegistry())
+
+	// Get the status of each query endpoint for a query
+	statuses := func(query string) map[string]int {
+		grafana, _ := json.Marshal(grafanaRequest{
+			Range:   grafanaRange{From: "2020-01-01T00:00:00Z", To: "2020-01-01T01:00:00Z"},
+			Queries: []grafanaQuery{{RefID: "A", Query: query}},
+		})
+
+		handlers := []struct {
+			name    string
+			handler echo.HandlerFunc
+			request *http.Request
+		}{
+			{"query", proxyTsl.Query, httptest.NewRequest(http.MethodPost, "/v0/query", strings.NewReader(query))},
+			{"jobs", jobs.Submit, httptest.NewRequest(http.MethodPost, "/v0/jobs", strings.NewReader(query))},
+			{"stream", proxyTsl.Stream, httptest.NewRequest(http.MethodPost, "/v0/stream", strings.NewReader(query))},
+			{"federate", proxyTsl.Federate, httptest.NewRequest(http.MethodGet, "/v0/federate?query="+url.QueryEscape(query), nil)},
+			{"grafana", proxyTsl.GrafanaQuery, httptest.NewRequest(http.MethodPost, "/v0/grafana/query", strings.NewReader(string(grafana)))},
+		}
+
+		res := make(map[string]int)
+		for _, handler := range handlers {
+			handler.request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			if err := handler.handler(echo.New().NewContext(handler.request, rec)); err != nil {
+				t.Fatalf("%s: unexpected error: %v", handler.name, err)
+			}
+
+			res[handler.name] = rec.Code
+			if handler.name == "grafana" {
+				response := grafanaResponse{}
+				if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+					t.Fatalf("unexpected Grafana response %q: %v", rec.Body.String(), err)
+				}
+				res[handler.name] = response.Results["A"].Status
+			}
+		}
+		return res
+	}
+
+	for name, status := range statuses(`connect("warp10", "http://10.1.2.3:8080", "TOKEN").select("cpu").last(1h)`) {
+		if status != http.StatusForbidden {
+			t.Errorf("%s: expected a 403 status for a backend that isn't allowed, got %d", name, status)
+		}
+	}
+
+	for name, status := range statuses(`select("cpu").last(1h`) {
+		if status != http.StatusBadRequest {
+			t.Errorf("%s: expected a 400 status for an invalid query, got %d", name, status)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Arrow IPC metadata enums and unions values
+const (
+	arrowMetadataV5       = 4
+	arrowHeaderSchema     = 1
+	arrowHeaderRecord     = 3
+	arrowTypeFloat        = 3
+	arrowTypeUtf8         = 5
+	arrowTypeTimestamp    = 10
+	arrowPrecisionDouble  = 2
+	arrowUnitNanosecond   = 3
+	arrowContinuation     = 0xFFFFFFFF
+	arrowAlignment        = 8
+	arrowStructVectorSize = 16
+)
+
+// Write series as an Apache Arrow IPC stream of a single record batch with one row per data point:
+// series, labels, timestamp and value, null for non numeric values
+func formatArrow(writer io.Writer, series []WarpSeries, ticksPerSecond int64) error {
+	names := newArrowStrings()
+	labels := newArrowStrings()
+	timestamps := []byte{}
+	values := []byte{}
+	validity := []byte{}
+	rows := 0
+	nulls := 0
+
+	for _, gts := range series {
+		gtsLabels := csvLabels(gts.Labels)
+		for _, point := range gts.Values {
+			if len(point) < 2 {
+				continue
+			}
+			tick, isTick := point[0].(int64)
+			if !isTick {
+				continue
+			}
+
+			names.append(gts.Class)
+			labels.append(gtsLabels)
+			timestamps = appendUint64(timestamps, uint64(tickTime(tick, ticksPerSecond).UnixNano()))
+
+			if rows%8 == 0 {
+				validity = append(validity, 0)
+			}
+			value, err := toFloat(point[len(point)-1])
+			if err != nil {
+				nulls++
+			} else {
+				validity[rows/8] |= 1 << uint(rows%8)
+			}
+			values = appendUint64(values, math.Float64bits(value))
+			rows++
+		}
+	}
+	if nulls == 0 {
+		validity = []byte{}
+	}
+
+	schema := arrowMessage(arrowHeaderSchema, &fbTable{fields: []interface{}{
+		nil,
+		fbTableVector{
+			arrowField("series", false, arrowTypeUtf8, &fbTable{}),
+			arrowField("labels", false, arrowTypeUtf8, &fbTable{}),
+			arrowField("timestamp", false, arrowTypeTimestamp, &fbTable{fields: []interface{}{fbShort(arrowUnitNanosecond), fbString("UTC")}}),
+			arrowField("value", true, arrowTypeFloat, &fbTable{fields: []interface{}{fbShort(arrowPrecisionDouble)}}),
+		},
+	}}, 0)
+	if err := writeArrowMessage(writer, schema, nil); err != nil {
+		return err
+	}
+
+	// Each column is made of a validity buffer, empty without nulls, then of its offsets and data buffers
+	columns := [][][]byte{
+		{{}, names.offsets, names.data},
+		{{}, labels.offsets, labels.data},
+		{{}, timestamps},
+		{validity, values},
+	}
+	nullCounts := []int{0, 0, 0, nulls}
+
+	body := []byte{}
+	nodes := []byte{}
+	buffers := []byte{}
+	for index, column := range columns {
+		nodes = appendUint64(appendUint64(nodes, uint64(rows)), uint64(nullCounts[index]))
+		for _, buffer := range column {
+			buffers = appendUint64(appendUint64(buffers, uint64(len(body))), uint64(len(buffer)))
+			body = append(body, buffer...)
+			body = append(body, make([]byte, arrowPadding(len(body)))...)
+		}
+	}
+
+	record := arrowMessage(arrowHeaderRecord, &fbTable{fields: []interface{}{
+		fbLong(rows),
+		fbStructVector(nodes),
+		fbStructVector(buffers),
+	}}, len(body))
+	if err := writeArrowMessage(writer, record, body); err != nil {
+		return err
+	}
+
+	// End of stream marker
+	_, err := writer.Write(appendUint32(appendUint32(nil, arrowContinuation), 0))
+	return err
+}
+
+// arrowStrings is an Arrow UTF-8 column, with its offsets and data buffers
+type arrowStrings struct {
+	offsets []byte
+	data    []byte
+}
+
+func newArrowStrings() *arrowStrings {
+	return &arrowStrings{offsets: appendUint32(nil, 0)}
+}
+
+func (column *arrowStrings) append(value string) {
+	column.data = append(column.data, value...)
+	column.offsets = appendUint32(column.offsets, uint32(len(column.data)))
+}
+
+// Build an Arrow schema field
+func arrowField(name string, nullable bool, fieldType byte, typeTable *fbTable) *fbTable {
+	return &fbTable{fields: []interface{}{fbString(name), fbBool(nullable), fbByte(fieldType), typeTable, nil, fbTableVector{}}}
+}
+
+// Build an Arrow IPC message
+func arrowMessage(headerType byte, header *fbTable, bodyLength int) []byte {
+	return buildFlatBuffer(&fbTable{fields: []interface{}{fbShort(arrowMetadataV5), fbByte(headerType), header, fbLong(bodyLength)}})
+}
+
+// Write an encapsulated Arrow IPC message: continuation marker, metadata size, padded metadata and body
+func writeArrowMessage(writer io.Writer, metadata []byte, body []byte) error {
+	metadata = append(metadata, make([]byte, arrowPadding(len(metadata)+8))...)
+
+	message := appendUint32(appendUint32(nil, arrowContinuation), uint32(len(metadata)))
+	message = append(message, metadata...)
+	message = append(message, body...)
+
+	_, err := writer.Write(message)
+	return err
+}
+
+// Get the padding of a size to the Arrow alignment
+func arrowPadding(size int) int {
+	return (arrowAlignment - size%arrowAlignment) % arrowAlignment
+}
+
+// FlatBuffers values, written in the order of the schema fields, nil for an absent field
+type (
+	fbByte         byte
+	fbBool         bool
+	fbShort        int16
+	fbLong         int64
+	fbString       string
+	fbStructVector []byte
+	fbTableVector  []*fbTable
+)
+
+// fbTable is a FlatBuffers table
+type fbTable struct {
+	fields []interface{}
+}
+
+// fbBuilder writes FlatBuffers forward: each object is written after its parent, the offsets to children being unsigned
+type fbBuilder struct {
+	buffer []byte
+}
+
+// Build a FlatBuffers buffer of a root table
+func buildFlatBuffer(root *fbTable) []byte {
+	builder := &fbBuilder{buffer: make([]byte, 4)}
+	builder.writeReference(0, root)
+	return builder.buffer
+}
+
+func (builder *fbBuilder) pad(alignment int) {
+	for len(builder.buffer)%alignment != 0 {
+		builder.buffer = append(builder.buffer, 0)
+	}
+}
+
+// Write a child object and set the offset to it at a position
+func (builder *fbBuilder) writeReference(position int, value interface{}) {
+	var start int
+	switch v := value.(type) {
+	case *fbTable:
+		start = builder.writeTable(v)
+	case fbString:
+		builder.pad(4)
+		start = len(builder.buffer)
+		builder.buffer = appendUint32(builder.buffer, uint32(len(v)))
+		builder.buffer = append(builder.buffer, v...)
+		builder.buffer = append(builder.buffer, 0)
+	case fbStructVector:
+		for (len(builder.buffer)+4)%8 != 0 {
+			builder.buffer = append(builder.buffer, 0)
+		}
+		start = len(builder.buffer)
+		builder.buffer = appendUint32(builder.buffer, uint32(len(v)/arrowStructVectorSize))
+		builder.buffer = append(builder.buffer, v...)
+	case fbTableVector:
+		builder.pad(4)
+		start = len(builder.buffer)
+		builder.buffer = appendUint32(builder.buffer, uint32(len(v)))
+		slots := len(builder.buffer)
+		builder.buffer = append(builder.buffer, make([]byte, 4*len(v))...)
+		for index, table := range v {
+			builder.writeReference(slots+4*index, table)
+		}
+	}
+	binary.LittleEndian.PutUint32(builder.buffer[position:], uint32(start-position))
+}
+
+// Write a table preceded by its vtable, then its children, returns the table position
+func (builder *fbBuilder) writeTable(table *fbTable) int {
+	type inline struct {
+		offset int
+		value  interface{}
+	}
+
+	// Place the fields after the vtable offset, aligned on their size
+	offsets := make([]int, len(table.fields))
+	inlines := []inline{}
+	size := 4
+	for index, value := range table.fields {
+		if value == nil {
+			continue
+		}
+		width := fbWidth(value)
+		for size%width != 0 {
+			size++
+		}
+		offsets[index] = size
+		inlines = append(inlines, inline{offset: size, value: value})
+		size += width
+	}
+
+	builder.pad(2)
+	vtable := len(builder.buffer)
+	builder.buffer = appendUint16(builder.buffer, uint16(4+2*len(table.fields)))
+	builder.buffer = appendUint16(builder.buffer, uint16(size))
+	for _, offset := range offsets {
+		builder.buffer = appendUint16(builder.buffer, uint16(offset))
+	}
+
+	builder.pad(8)
+	start := len(builder.buffer)
+	builder.buffer = append(builder.buffer, make([]byte, size)...)
+	binary.LittleEndian.PutUint32(builder.buffer[start:], uint32(int32(start-vtable)))
+
+	for _, field := range inlines {
+		position := start + field.offset
+		switch v := field.value.(type) {
+		case fbByte:
+			builder.buffer[position] = byte(v)
+		case fbBool:
+			if v {
+				builder.buffer[position] = 1
+			}
+		case fbShort:
+			binary.LittleEndian.PutUint16(builder.buffer[position:], uint16(v))
+		case fbLong:
+			binary.LittleEndian.PutUint64(builder.buffer[position:], uint64(v))
+		}
+	}
+
+	for _, field := range inlines {
+		if fbWidth(field.value) == 4 {
+			builder.writeReference(start+field.offset, field.value)
+		}
+	}
+	return start
+}
+
+// Get the inline size of a FlatBuffers value, references being 4 bytes offsets
+func fbWidth(value interface{}) int {
+	switch value.(type) {
+	case fbByte, fbBool:
+		return 1
+	case fbShort:
+		return 2
+	case fbLong:
+		return 8
+	}
+	return 4
+}
+
+func appendUint16(buffer []byte, value uint16) []byte {
+	return append(buffer, byte(value), byte(value>>8))
+}
+
+func appendUint32(buffer []byte, value uint32) []byte {
+	return append(buffer, byte(value), byte(value>>8), byte(value>>16), byte(value>>24))
+}
+
+func appendUint64(buffer []byte, value uint64) []byte {
+	return appendUint32(appendUint32(buffer, uint32(value)), uint32(value>>32))
+}
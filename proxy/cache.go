@@ -0,0 +1,435 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ovh/tsl/tsl"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultCacheChunk     = 24 * time.Hour
+	defaultCacheFreshness = 10 * time.Minute
+	defaultCacheSize      = 1000
+	defaultCachePathTTL   = 7 * 24 * time.Hour
+	maxCachePathCleanup   = time.Hour
+)
+
+// Queries result cache, nil when disabled
+var cache *resultCache
+
+// resultCache stores the results of past time chunks of Prometheus range queries and of Warp 10 queries on past fixed ranges,
+// and for a short time the results of Warp 10 queries on relative ranges
+type resultCache struct {
+	chunk       time.Duration
+	freshness   time.Duration
+	size        int
+	path        string
+	pathTTL     time.Duration
+	relativeTTL time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+
+	hits   prometheus.Counter
+	misses prometheus.Counter
+}
+
+// cacheEntry is a cached chunk or query result, as JSON, expiring when its expiry date is set
+type cacheEntry struct {
+	key     string
+	content []byte
+	expires time.Time
+}
+
+// promSeries is a Prometheus matrix series
+type promSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][]interface{}   `json:"values"`
+}
+
+// promMatrix is a Prometheus range query response
+type promMatrix struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string       `json:"resultType"`
+		Result     []promSeries `json:"result"`
+	} `json:"data"`
+}
+
+// LoadCache load the result cache configuration and register its metrics
+func LoadCache(promRegistry *prometheus.Registry) error {
+	if !viper.GetBool("tsl.cache.enabled") {
+		return nil
+	}
+
+	loaded := &resultCache{
+		chunk:       defaultCacheChunk,
+		freshness:   defaultCacheFreshness,
+		size:        defaultCacheSize,
+		path:        viper.GetString("tsl.cache.path"),
+		pathTTL:     defaultCachePathTTL,
+		relativeTTL: viper.GetDuration("tsl.cache.relativeTTL"),
+		entries:     make(map[string]*list.Element),
+		order:       list.New(),
+	}
+
+	if viper.IsSet("tsl.cache.chunk") {
+		loaded.chunk = viper.GetDuration("tsl.cache.chunk")
+	}
+	if viper.IsSet("tsl.cache.freshness") {
+		loaded.freshness = viper.GetDuration("tsl.cache.freshness")
+	}
+	if viper.IsSet("tsl.cache.size") {
+		loaded.size = viper.GetInt("tsl.cache.size")
+	}
+	if viper.IsSet("tsl.cache.pathTTL") {
+		loaded.pathTTL = viper.GetDuration("tsl.cache.pathTTL")
+	}
+
+	if loaded.path != "" {
+		if err := os.MkdirAll(loaded.path, 0750); err != nil {
+			return err
+		}
+
+		if loaded.pathTTL > 0 {
+			interval := loaded.pathTTL
+			if interval > maxCachePathCleanup {
+				interval = maxCachePathCleanup
+			}
+			go loaded.cleanPath(interval)
+		}
+	}
+
+	loaded.hits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tsl",
+		Subsystem: "cache",
+		Name:      "hits",
+		Help:      "Number of Prometheus query chunks and Warp 10 queries loaded from the cache.",
+	})
+	promRegistry.MustRegister(loaded.hits)
+	loaded.misses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tsl",
+		Subsystem: "cache",
+		Name:      "misses",
+		Help:      "Number of Prometheus query chunks and Warp 10 queries executed on a backend.",
+	})
+	promRegistry.MustRegister(loaded.misses)
+
+	cache = loaded
+	return nil
+}
+
+// Execute a range query split in chunks of the query steps, loading the past chunks from the cache
+func (c *resultCache) query(req *tsl.Ql, prom string, execute func(req *tsl.Ql) (string, error)) (string, error) {
+	start, errStart := parsePromTime(req.Start)
+	end, errEnd := parsePromTime(req.End)
+	step, errStep := model.ParseDuration(req.Step)
+	if errStart != nil || errEnd != nil || errStep != nil || time.Duration(step) < time.Millisecond {
+		return execute(req)
+	}
+
+	// As a query frontend, align the start and the end on the step, in milli-seconds, so that the refreshed queries of a
+	// relative range share their chunks: Prometheus evaluates them at multiples of the step, and the chunks boundaries
+	// are multiples of a steps multiple
+	stepMs := int64(time.Duration(step) / time.Millisecond)
+	chunkMs := int64(math.Max(1, math.Floor(c.chunk.Seconds()/time.Duration(step).Seconds()))) * stepMs
+
+	startMs := floorDiv(int64(math.Round(start*1000)), stepMs) * stepMs
+	endMs := floorDiv(int64(math.Round(end*1000)), stepMs) * stepMs
+	if endMs < startMs {
+		return execute(req)
+	}
+
+	freshLimit := time.Now().Add(-c.freshness).UnixNano() / int64(time.Millisecond)
+
+	results := [][]promSeries{}
+	for chunkStart := startMs; chunkStart <= endMs; {
+		chunkBoundary := (floorDiv(chunkStart, chunkMs)+1)*chunkMs - stepMs
+		chunkEnd := endMs
+		if chunkBoundary < endMs {
+			chunkEnd = chunkBoundary
+		}
+
+		chunk := *req
+		chunk.Start = formatPromMillis(chunkStart)
+		chunk.End = formatPromMillis(chunkEnd)
+
+		// Only complete chunks older than the freshness delay are immutable
+		cacheable := chunkEnd == chunkBoundary && chunkEnd < freshLimit
+		key := cacheKey(prom, &chunk)
+
+		result, ok := []promSeries(nil), false
+		if cacheable {
+			var content []byte
+			if content, ok = c.get(key); ok {
+				ok = json.Unmarshal(content, &result) == nil
+			}
+		}
+
+		if ok {
+			c.hits.Inc()
+		} else {
+			c.misses.Inc()
+			res, err := execute(&chunk)
+			if err != nil {
+				return res, err
+			}
+
+			matrix := promMatrix{}
+			if err := json.Unmarshal([]byte(res), &matrix); err != nil || matrix.Data.ResultType != "matrix" {
+				return execute(req)
+			}
+			result = matrix.Data.Result
+
+			if cacheable {
+				if content, err := json.Marshal(result); err == nil {
+					c.put(key, content)
+				}
+			}
+		}
+
+		results = append(results, result)
+		chunkStart = chunkEnd + stepMs
+	}
+
+	return stitchPromResults(results)
+}
+
+// Execute Warp 10 instructions, loading their result from the cache when their time ranges are fixed and past,
+// or when the relative TTL is set and their result is recent enough
+func (c *resultCache) warp(instructions []tsl.Instruction, warp string, execute func() (string, error)) (string, error) {
+	protoParser := warpParser("cache", 0)
+	freshLimit := time.Now().Add(-c.freshness)
+
+	// The instructions AST holds their tokens and time ranges
+	immutable := true
+	asts := []string{tsl.WARP.String(), warp}
+	for _, instruction := range instructions {
+		if instruction.HasStore() {
+			return execute()
+		}
+
+		end, fixed := protoParser.FixedEnd(instruction, tsl.WARP.String())
+		if !fixed || !end.Before(freshLimit) {
+			immutable = false
+		}
+		asts = append(asts, instruction.Normalized())
+	}
+	if !immutable && c.relativeTTL <= 0 {
+		return execute()
+	}
+
+	// Relative ranges results are only kept in memory
+	prefix := ""
+	if !immutable {
+		prefix = "relative\n"
+	}
+	hash := sha256.Sum256([]byte(prefix + strings.Join(asts, "\n")))
+	key := hex.EncodeToString(hash[:])
+
+	if content, ok := c.get(key); ok {
+		c.hits.Inc()
+		return string(content), nil
+	}
+
+	c.misses.Inc()
+	res, err := execute()
+	if err != nil {
+		return res, err
+	}
+
+	if immutable {
+		c.put(key, []byte(res))
+	} else {
+		c.store(key, []byte(res), time.Now().Add(c.relativeTTL))
+	}
+	return res, nil
+}
+
+// Merge the chunks series having the same labels
+func stitchPromResults(results [][]promSeries) (string, error) {
+	keys := []string{}
+	series := make(map[string]*promSeries)
+
+	for _, result := range results {
+		for _, chunkSeries := range result {
+			key := matchingKey(chunkSeries.Metric)
+			if merged, ok := series[key]; ok {
+				merged.Values = append(merged.Values, chunkSeries.Values...)
+				continue
+			}
+			keys = append(keys, key)
+			series[key] = &promSeries{Metric: chunkSeries.Metric, Values: append([][]interface{}{}, chunkSeries.Values...)}
+		}
+	}
+	sort.Strings(keys)
+
+	matrix := promMatrix{Status: "success"}
+	matrix.Data.ResultType = "matrix"
+	matrix.Data.Result = []promSeries{}
+	for _, key := range keys {
+		matrix.Data.Result = append(matrix.Data.Result, *series[key])
+	}
+
+	res, err := json.Marshal(matrix)
+	if err != nil {
+		return "", err
+	}
+	return string(res), nil
+}
+
+// Get a result from memory or from the disk store
+func (c *resultCache) get(key string) ([]byte, bool) {
+	c.mutex.Lock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		if entry.expires.IsZero() || time.Now().Before(entry.expires) {
+			c.order.MoveToFront(element)
+			c.mutex.Unlock()
+			return entry.content, true
+		}
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+	c.mutex.Unlock()
+
+	if c.path == "" {
+		return nil, false
+	}
+
+	file := filepath.Join(c.path, key)
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, false
+	}
+	if c.isExpiredFile(info, time.Now()) {
+		os.Remove(file)
+		return nil, false
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, false
+	}
+
+	c.store(key, content, time.Time{})
+	return content, true
+}
+
+// Store a result in memory and in the disk store
+func (c *resultCache) put(key string, content []byte) {
+	c.store(key, content, time.Time{})
+
+	if c.path == "" {
+		return
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(c.path, key), content, 0640); err != nil {
+		log.WithError(err).Warn("Could not write cache entry")
+	}
+}
+
+// Store a result in memory until its expiry date when set, evicting the least recently used one when full
+func (c *resultCache) store(key string, content []byte, expires time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		entry.content = content
+		entry.expires = expires
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, content: content, expires: expires})
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Remove periodically the disk store entries older than its TTL
+func (c *resultCache) cleanPath(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		c.removeExpiredFiles(time.Now())
+	}
+}
+
+// Remove the disk store entries older than its TTL at a date
+func (c *resultCache) removeExpiredFiles(now time.Time) {
+	files, err := ioutil.ReadDir(c.path)
+	if err != nil {
+		log.WithError(err).Warn("Could not list cache entries")
+		return
+	}
+
+	for _, info := range files {
+		if info.IsDir() || !c.isExpiredFile(info, now) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.path, info.Name())); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).Warn("Could not remove cache entry")
+		}
+	}
+}
+
+// Check if a disk store entry was written before its TTL
+func (c *resultCache) isExpiredFile(info os.FileInfo, now time.Time) bool {
+	return c.pathTTL > 0 && now.Sub(info.ModTime()) > c.pathTTL
+}
+
+// Get the key of a chunk query on an endpoint
+func cacheKey(prom string, req *tsl.Ql) string {
+	hash := sha256.Sum256([]byte(prom + "\n" + req.Token + "\n" + req.Query + "\n" + req.Step + "\n" + req.Start + "\n" + req.End))
+	return hex.EncodeToString(hash[:])
+}
+
+// Format milli-seconds as a Prometheus time in seconds
+func formatPromMillis(milliseconds int64) string {
+	return strconv.FormatFloat(float64(milliseconds)/1000, 'f', -1, 64)
+}
+
+// Euclidean division, for times before the epoch
+func floorDiv(value int64, divisor int64) int64 {
+	quotient := value / divisor
+	if value%divisor < 0 {
+		quotient--
+	}
+	return quotient
+}
+
+// Parse a Prometheus time, a Unix timestamp in seconds or a RFC3339 date
+func parsePromTime(value string) (float64, error) {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err == nil {
+		return seconds, nil
+	}
+
+	date, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, err
+	}
+	return float64(date.UnixNano()) / float64(time.Second), nil
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ovh/tsl/tsl"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestCache(chunk time.Duration) *resultCache {
+	return &resultCache{
+		chunk:     chunk,
+		freshness: 10 * time.Minute,
+		size:      100,
+		entries:   make(map[string]*list.Element),
+		order:     list.New(),
+		hits:      prometheus.NewCounter(prometheus.CounterOpts{Name: "hits"}),
+		misses:    prometheus.NewCounter(prometheus.CounterOpts{Name: "misses"}),
+	}
+}
+
+// Evaluate a range query as Prometheus does, at its start plus multiples of its step
+func promRange(t *testing.T, req *tsl.Ql) (string, error) {
+	start, _ := strconv.ParseFloat(req.Start, 64)
+	end, _ := strconv.ParseFloat(req.End, 64)
+	step, _ := time.ParseDuration(req.Step)
+
+	values := [][]interface{}{}
+	for tick := start; tick <= end; tick += step.Seconds() {
+		values = append(values, []interface{}{tick, "1"})
+	}
+
+	matrix := promMatrix{Status: "success"}
+	matrix.Data.ResultType = "matrix"
+	matrix.Data.Result = []promSeries{{Metric: map[string]string{"__name__": "cpu"}, Values: values}}
+	res, err := json.Marshal(matrix)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return string(res), nil
+}
+
+func TestCacheQueryAlignsOnStep(t *testing.T) {
+	c := newTestCache(time.Hour)
+
+	// An unaligned range, two days ago, evaluated on the step multiples
+	start := float64(time.Now().Add(-48*time.Hour).Unix()) + 10.5
+	end := start + 3*3600 + 30
+	req := &tsl.Ql{Query: "cpu", Start: strconv.FormatFloat(start, 'f', -1, 64), End: strconv.FormatFloat(end, 'f', -1, 64), Step: "1m"}
+
+	alignedStart := strconv.FormatFloat(math.Floor(start/60)*60, 'f', -1, 64)
+	alignedEnd := strconv.FormatFloat(math.Floor(end/60)*60, 'f', -1, 64)
+	expected, _ := promRange(t, &tsl.Ql{Query: "cpu", Start: alignedStart, End: alignedEnd, Step: "1m"})
+
+	for run := 0; run < 2; run++ {
+		res, err := c.query(req, "http://127.0.0.1:9090", func(chunk *tsl.Ql) (string, error) {
+			chunkStart, _ := strconv.ParseFloat(chunk.Start, 64)
+			if offset := int64(chunkStart*1000) % 60000; offset != 0 {
+				t.Errorf("chunk start %s is not aligned on the query step", chunk.Start)
+			}
+			return promRange(t, chunk)
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		result, expectedResult := promMatrix{}, promMatrix{}
+		json.Unmarshal([]byte(res), &result)
+		json.Unmarshal([]byte(expected), &expectedResult)
+		if fmt.Sprint(result.Data.Result) != fmt.Sprint(expectedResult.Data.Result) {
+			t.Errorf("run %d: expected the points of the whole query %v, got %v", run, expectedResult.Data.Result, result.Data.Result)
+		}
+	}
+}
+
+func TestCacheWarp(t *testing.T) {
+	c := newTestCache(time.Hour)
+
+	tests := []struct {
+		query     string
+		cacheable bool
+	}{
+		{`select("cpu").from("2020-01-01T00:00:00Z", to="2020-01-02T00:00:00Z")`, true},
+		{`select("cpu").from("2020-01-01T00:00:00Z", to="2020-01-02T00:00:00Z").timeclip(now, 1h)`, false},
+		{`select("cpu").from("2020-01-01T00:00:00Z")`, false},
+		{`select("cpu").last(1h)`, false},
+		{`select("cpu").from("2020-01-01T00:00:00Z", to="2020-01-02T00:00:00Z").store("WRITE_TOKEN")`, false},
+	}
+
+	for _, test := range tests {
+		parser, err := tsl.NewParser(strings.NewReader(test.query), "http://127.0.0.1:8080", "TOKEN", 0, "", "", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		query, err := parser.Parse()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.query, err)
+		}
+		instructions := []tsl.Instruction{*query.Statements[0]}
+
+		executions := 0
+		for run := 0; run < 2; run++ {
+			res, err := c.warp(instructions, "http://127.0.0.1:8080", func() (string, error) {
+				executions++
+				return "[[]]", nil
+			})
+			if err != nil || res != "[[]]" {
+				t.Fatalf("%s: unexpected result %q: %v", test.query, res, err)
+			}
+		}
+
+		if expected := map[bool]int{true: 1, false: 2}[test.cacheable]; executions != expected {
+			t.Errorf("%s: expected %d executions, got %d", test.query, expected, executions)
+		}
+	}
+}
+
+func TestCacheQueryRelativeRefresh(t *testing.T) {
+	c := newTestCache(time.Hour)
+
+	instructions := parseCacheInstructions(t, `select("cpu").last(24h).sampleBy(1m, last)`)
+	protoParser := tsl.ProtoParser{Name: "prometheus"}
+
+	// Two consecutive refreshes of a dashboard, their now being a few milli-seconds apart
+	executions := []int{0, 0}
+	for run := 0; run < 2; run++ {
+		req, err := protoParser.GeneratePromQl(instructions[0], time.Now().UTC())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		_, err = c.query(req, "http://127.0.0.1:9090", func(chunk *tsl.Ql) (string, error) {
+			executions[run]++
+			return promRange(t, chunk)
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Only the chunks younger than the freshness delay, and the first one when the start moved to the next step,
+	// are executed again
+	if executions[0] < 24 || executions[1] > 3 {
+		t.Errorf("expected the second query to load its past chunks from the cache, got %v executions", executions)
+	}
+}
+
+// Parse a TSL query on a Warp 10 endpoint
+func parseCacheInstructions(t *testing.T, query string) []tsl.Instruction {
+	t.Helper()
+
+	parser, err := tsl.NewParser(strings.NewReader(query), "http://127.0.0.1:8080", "TOKEN", 0, "", "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	parsed, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %v", query, err)
+	}
+
+	instructions := []tsl.Instruction{}
+	for _, instruction := range parsed.Statements {
+		instructions = append(instructions, *instruction)
+	}
+	return instructions
+}
+
+func TestCacheWarpRelativeTTL(t *testing.T) {
+	c := newTestCache(time.Hour)
+	c.relativeTTL = 50 * time.Millisecond
+
+	tests := []struct {
+		query      string
+		executions int
+	}{
+		{`select("cpu").last(1h)`, 1},
+		{`select("cpu").from(now - 1d, to=now)`, 1},
+		{`select("cpu").last(1h).store("WRITE_TOKEN")`, 2},
+	}
+
+	for _, test := range tests {
+		instructions := parseCacheInstructions(t, test.query)
+
+		executions := 0
+		for run := 0; run < 2; run++ {
+			if _, err := c.warp(instructions, "http://127.0.0.1:8080", func() (string, error) {
+				executions++
+				return "[[]]", nil
+			}); err != nil {
+				t.Fatalf("%s: unexpected error: %v", test.query, err)
+			}
+		}
+		if executions != test.executions {
+			t.Errorf("%s: expected %d executions, got %d", test.query, test.executions, executions)
+		}
+	}
+
+	// Relative results expire after the TTL
+	instructions := parseCacheInstructions(t, `select("cpu").last(1h)`)
+	time.Sleep(c.relativeTTL)
+	executed := false
+	c.warp(instructions, "http://127.0.0.1:8080", func() (string, error) {
+		executed = true
+		return "[[]]", nil
+	})
+	if !executed {
+		t.Error("expected the relative result to expire")
+	}
+}
+
+func TestCachePathTTL(t *testing.T) {
+	path, err := ioutil.TempDir("", "tsl-cache")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	c := newTestCache(time.Hour)
+	c.path = path
+	c.pathTTL = time.Hour
+
+	c.put("recent", []byte("[]"))
+	c.put("old", []byte("[]"))
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(path, "old"), old, old); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Entries are loaded from the disk store until their TTL
+	c.entries = make(map[string]*list.Element)
+	c.order = list.New()
+	if _, ok := c.get("recent"); !ok {
+		t.Error("expected a recent entry to be loaded from the disk store")
+	}
+	if _, ok := c.get("old"); ok {
+		t.Error("expected an entry older than the TTL to be ignored")
+	}
+	if _, err := os.Stat(filepath.Join(path, "old")); !os.IsNotExist(err) {
+		t.Errorf("expected the expired entry to be removed, got %v", err)
+	}
+
+	// The store cleanup removes the expired entries
+	c.removeExpiredFiles(time.Now().Add(2 * time.Hour))
+	files, err := ioutil.ReadDir(path)
+	if err != nil || len(files) != 0 {
+		t.Errorf("expected all entries to be removed, got %d: %v", len(files), err)
+	}
+}
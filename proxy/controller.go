@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -9,11 +10,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/labstack/echo"
+	"github.com/ovh/tsl/middlewares"
 	"github.com/ovh/tsl/tsl"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -23,6 +26,7 @@ const (
 	lineStartHeader     = "TSL-Line-Start"
 	queryRandeHeader    = "TSL-Query-Range"
 	samplersCountHeader = "TSL-Samplers"
+	timezoneHeader      = "TSL-Timezone"
 )
 
 // Request main syntax
@@ -51,6 +55,39 @@ func GetTokenFromBasicAuth(request *http.Request) string {
 	return pair[1]
 }
 
+// Set the authorization of a Prometheus request: a token holding base64 user:password credentials, as built by a
+// Prometheus connect, is sent with basic authentication, any other token as a bearer token
+func setPrometheusAuthorization(request *http.Request, token string) {
+	if token == "" {
+		return
+	}
+	if credentials, err := base64.StdEncoding.DecodeString(token); err == nil {
+		if pair := strings.SplitN(string(credentials), ":", 2); len(pair) == 2 {
+			request.SetBasicAuth(pair[0], pair[1])
+			return
+		}
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+}
+
+// Get the user token of an HTTP Request based on the default backend type
+// A request authenticated by a JWT has no user token: its tenant tokens are injected before execution
+func getRequestToken(ctx echo.Context) string {
+	if _, ok := ctx.Get(middlewares.TenantKey).(string); ok {
+		return ""
+	}
+
+	request := ctx.Request()
+	if viper.GetString("tsl.default.type") == "prometheus" {
+		s := strings.SplitN(request.Header.Get("Authorization"), " ", 2)
+		if len(s) != 2 {
+			return ""
+		}
+		return s[1]
+	}
+	return GetTokenFromBasicAuth(request)
+}
+
 // Query is the main API call method to start parsing Tsl queries
 func (proxyTsl ProxyTSL) Query(ctx echo.Context) error {
 
@@ -65,6 +102,16 @@ func (proxyTsl ProxyTSL) Query(ctx echo.Context) error {
 	// Get Header query samplers count
 	samplersCount := ctx.Request().Header.Get(samplersCountHeader)
 
+	// Get Header query default timezone
+	timezone := ctx.Request().Header.Get(timezoneHeader)
+
+	// Get the requested series output format
+	format, err := seriesFormat(ctx)
+	if err != nil {
+		proxyTsl.WarnCounter.Inc()
+		return ctx.JSON(http.StatusBadRequest, tsl.NewError(err))
+	}
+
 	lineStart := 0
 
 	if lineHeader != "" {
@@ -89,20 +136,17 @@ func (proxyTsl ProxyTSL) Query(ctx echo.Context) error {
 
 	// Get default backend URI and USER token
 	backendURL := viper.GetString("tsl.default.endpoint")
-	tokenString := GetTokenFromBasicAuth(ctx.Request())
+	tokenString := getRequestToken(ctx)
 
-	if viper.GetString("tsl.default.type") == "prometheus" {
-		s := strings.SplitN(ctx.Request().Header.Get("Authorization"), " ", 2)
-		if len(s) != 2 {
-			tokenString = ""
-		} else {
-			tokenString = s[1]
-		}
+	tenant, err := getTenant(ctx)
+	if err != nil {
+		proxyTsl.WarnCounter.Inc()
+		return ctx.JSON(http.StatusForbidden, tsl.NewError(err))
 	}
 
 	// Get query parsing result
 	variables := []string{}
-	parser, err := tsl.NewParser(strings.NewReader(string(body)), backendURL, tokenString, lineStart, queryRange, samplersCount, variables)
+	parser, err := tsl.NewParserWithTimezone(strings.NewReader(string(body)), backendURL, tokenString, lineStart, queryRange, samplersCount, timezone, variables)
 	if err != nil {
 		proxyTsl.WarnCounter.Inc()
 		return ctx.JSON(http.StatusBadRequest, tsl.NewError(err))
@@ -118,6 +162,12 @@ func (proxyTsl ProxyTSL) Query(ctx echo.Context) error {
 	// Get pivot format info
 	log.Debug(query.String())
 
+	// Reject the queries too expensive for the back-ends
+	if err := admitQuery(query.Statements, time.Now().UTC()); err != nil {
+		proxyTsl.WarnCounter.Inc()
+		return ctx.JSON(http.StatusBadRequest, tsl.NewError(err))
+	}
+
 	// Only warp and Prom checks for no-backend queries
 	onlyWarp := true
 	onlyProm := true
@@ -125,7 +175,29 @@ func (proxyTsl ProxyTSL) Query(ctx echo.Context) error {
 	// Create an instructions map per different back-end to call
 	instructionsPerAPI := map[string][]tsl.Instruction{}
 
+	// Operators between series of different back-ends are computed by TSL
+	crossInstructions := []tsl.Instruction{}
+
 	for _, instruction := range query.Statements {
+		if err := checkConnect(*instruction, tokenString, tenant); err != nil {
+			proxyTsl.WarnCounter.Inc()
+			return ctx.JSON(queryErrorStatus(err), tsl.NewError(err))
+		}
+
+		// Inject the tenant back-end tokens kept server side
+		if tenant != nil {
+			instruction.SetConnectTokens(tenant.tokens())
+		}
+
+		// Stores to a sink are written by TSL as cross-backend operators results,
+		// and all statements are evaluated by TSL to encode their series in an output format
+		if instruction.GetCrossBackendOperator() != nil || instruction.GetStoreSink() != nil || format != "" {
+			onlyWarp = false
+			onlyProm = false
+			crossInstructions = append(crossInstructions, *instruction)
+			continue
+		}
+
 		// Checks mixed backend in instruction
 		if !(instruction.GetConnectType() == tsl.WARP.String() || instruction.GetConnectType() == "") {
 			onlyWarp = false
@@ -153,7 +225,27 @@ func (proxyTsl ProxyTSL) Query(ctx echo.Context) error {
 	now := time.Now().UTC()
 
 	// Execute all Warp requests
-	warpEndpoints := viper.GetStringSlice("tsl.warp10.endpoints")
+	warpEndpoints := configuredEndpoints(tsl.WARP.String())
+
+	// Add the allowed endpoints explicitly set in connect methods
+	promEndpoints := configuredEndpoints(tsl.PROMETHEUS.String())
+	apis := []string{}
+	for api := range instructionsPerAPI {
+		apis = append(apis, api)
+	}
+	sort.Strings(apis)
+
+	for _, api := range apis {
+		backendType := getBackendType(instructionsPerAPI[api][0])
+		if contains(configuredEndpoints(backendType), api) || !isAllowedEndpoint(api) {
+			continue
+		}
+		if backendType == tsl.WARP.String() {
+			warpEndpoints = append(warpEndpoints, api)
+		} else {
+			promEndpoints = append(promEndpoints, api)
+		}
+	}
 
 	allowAuthenticate := viper.GetBool("tsl.warp10.authenticate")
 
@@ -169,7 +261,18 @@ func (proxyTsl ProxyTSL) Query(ctx echo.Context) error {
 			proto = tsl.PROMETHEUS.String()
 		}
 
-		params := map[string]string{lineStartHeader: fmt.Sprintf("%v", lineStart), queryRandeHeader: queryRange, samplersCountHeader: samplersCount}
+		params := map[string]string{lineStartHeader: fmt.Sprintf("%v", lineStart), queryRandeHeader: queryRange, samplersCountHeader: samplersCount, timezoneHeader: timezone}
+
+		// List each statement with its back-end when the query mixes back-ends
+		if proto == "" {
+			nativeQueries, err := GenerateMixedNativeQueries(string(body), tokenString, allowAuthenticate, params)
+			if err != nil {
+				proxyTsl.WarnCounter.Inc()
+				return ctx.JSON(http.StatusBadRequest, tsl.NewError(err))
+			}
+			return ctx.JSON(http.StatusOK, nativeQueries)
+		}
+
 		nativeRes, err := GenerateNativeQueriesWithParams(proto, string(body), tokenString, allowAuthenticate, params)
 
 		if err != nil {
@@ -198,8 +301,6 @@ func (proxyTsl ProxyTSL) Query(ctx echo.Context) error {
 	}
 
 	// Execute all Prom requests
-	promEndpoints := viper.GetStringSlice("tsl.promql.endpoints")
-
 	for _, prom := range promEndpoints {
 
 		if instructions, ok := instructionsPerAPI[prom]; ok {
@@ -216,6 +317,34 @@ func (proxyTsl ProxyTSL) Query(ctx echo.Context) error {
 		}
 	}
 
+	// Encode the normalized series of all statements
+	if format != "" {
+		stack, ticksPerSecond, err := evaluateInstructions(crossInstructions, ctx, now, lineStart, allowAuthenticate)
+		if err != nil {
+			proxyTsl.ErrCounter.Inc()
+			proxyTsl.WarnCounter.Inc()
+			return ctx.JSON(http.StatusInternalServerError, tsl.NewError(err))
+		}
+
+		series := []WarpSeries{}
+		for _, statementSeries := range stack {
+			series = append(series, statementSeries...)
+		}
+		return writeSeries(ctx, format, series, ticksPerSecond)
+	}
+
+	// Execute all cross-backend operators
+	if len(crossInstructions) > 0 {
+		res, err := crossBackendQuery(crossInstructions, ctx, now, lineStart, allowAuthenticate)
+		if err != nil {
+			proxyTsl.ErrCounter.Inc()
+			proxyTsl.WarnCounter.Inc()
+			return ctx.JSON(http.StatusInternalServerError, tsl.NewError(err))
+		}
+		buffer.WriteString(res)
+		buffer.WriteString("\n")
+	}
+
 	// By default return an empty array
 	if buffer.String() == "" {
 		buffer.WriteString("[]")
@@ -270,9 +399,14 @@ func tslToWarpScript(tslQuery string, defaulToken string, allowAuthenticate bool
 		samplersCount = ""
 	}
 
+	timezone, contains := params[timezoneHeader]
+	if !contains {
+		timezone = ""
+	}
+
 	// Get query parsing result
 	variables := []string{}
-	parser, err := tsl.NewParser(strings.NewReader(tslQuery), "warp", defaulToken, lineCountInt, queryRange, samplersCount, variables)
+	parser, err := tsl.NewParserWithTimezone(strings.NewReader(tslQuery), "warp", defaulToken, lineCountInt, queryRange, samplersCount, timezone, variables)
 	if err != nil {
 		return "", err
 	}
@@ -291,7 +425,7 @@ func tslToWarpScript(tslQuery string, defaulToken string, allowAuthenticate bool
 		instructions = append(instructions, *instruction)
 	}
 
-	protoParser := tsl.ProtoParser{Name: "warp 10", LineStart: 0}
+	protoParser := warpParser("warp 10", 0)
 	warpscript, err := protoParser.GenerateWarpScript(instructions, allowAuthenticate)
 	if err != nil {
 		return "", err
@@ -330,9 +464,14 @@ func tslToPromQL(tslQuery string, token string, params map[string]string) (strin
 		samplersCount = ""
 	}
 
+	timezone, contains := params[timezoneHeader]
+	if !contains {
+		timezone = ""
+	}
+
 	// Generate parser
 	variables := []string{}
-	parser, err := tsl.NewParser(strings.NewReader(tslQuery), "warp", token, lineCountInt, queryRange, samplersCount, variables)
+	parser, err := tsl.NewParserWithTimezone(strings.NewReader(tslQuery), "warp", token, lineCountInt, queryRange, samplersCount, timezone, variables)
 	if err != nil {
 		return "", err
 	}
@@ -371,18 +510,7 @@ func tslToPromQL(tslQuery string, token string, params map[string]string) (strin
 
 		if promQl.Query != "" {
 			log.Debug(promQl)
-			queryType := "query_range"
-
-			if promQl.InstantQuery {
-				queryType = "query"
-			}
-
-			buffer.WriteString(fmt.Sprintf("/api/v1/%s?query=%s&start=%s&end=%s&step=%s",
-				queryType,
-				url.QueryEscape(promQl.Query),
-				url.QueryEscape(promQl.Start),
-				url.QueryEscape(promQl.End),
-				url.QueryEscape(promQl.Step)))
+			buffer.WriteString(promQueryPath(promQl))
 			buffer.WriteString("\n")
 		}
 	}
@@ -395,6 +523,94 @@ func tslToPromQL(tslQuery string, token string, params map[string]string) (strin
 	return buffer.String(), nil
 }
 
+// Get the Prometheus API path of a PromQL query
+func promQueryPath(promQl *tsl.Ql) string {
+	queryType := "query_range"
+
+	if promQl.InstantQuery {
+		queryType = "query"
+	}
+
+	return fmt.Sprintf("/api/v1/%s?query=%s&start=%s&end=%s&step=%s",
+		queryType,
+		url.QueryEscape(promQl.Query),
+		url.QueryEscape(promQl.Start),
+		url.QueryEscape(promQl.End),
+		url.QueryEscape(promQl.Step))
+}
+
+// NativeQuery is a TSL statement generated in its back-end native format
+type NativeQuery struct {
+	Backend  string        `json:"backend"`
+	Endpoint string        `json:"endpoint,omitempty"`
+	Query    string        `json:"query,omitempty"`
+	Operator string        `json:"operator,omitempty"`
+	Operands []NativeQuery `json:"operands,omitempty"`
+}
+
+// GenerateMixedNativeQueries Generate each statement of a TSL query using several back-ends in its native format, with a param map replacing query headers
+func GenerateMixedNativeQueries(tslQuery string, defaultToken string, allowAuthenticate bool, params map[string]string) ([]NativeQuery, error) {
+	query, lineStart, err := parseQueryWithParams(tslQuery, defaultToken, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set a common now for all Prometheus statements
+	now := time.Now().UTC()
+
+	nativeQueries := []NativeQuery{}
+	for _, instruction := range query.Statements {
+		nativeQuery, err := generateNativeQuery(*instruction, lineStart, allowAuthenticate, now)
+		if err != nil {
+			return nil, err
+		}
+		nativeQueries = append(nativeQueries, *nativeQuery)
+	}
+	return nativeQueries, nil
+}
+
+// Generate a single statement in its native format
+func generateNativeQuery(instruction tsl.Instruction, lineStart int, allowAuthenticate bool, now time.Time) (*NativeQuery, error) {
+
+	// Cross-backend operators are computed by TSL on its operands results
+	if operator := instruction.GetCrossBackendOperator(); operator != nil {
+		nativeQuery := &NativeQuery{Backend: "tsl", Operator: operator.Operator.String()}
+		for _, operand := range operator.Operands {
+			operandQuery, err := generateNativeQuery(operand, lineStart, allowAuthenticate, now)
+			if err != nil {
+				return nil, err
+			}
+			nativeQuery.Operands = append(nativeQuery.Operands, *operandQuery)
+		}
+		return nativeQuery, nil
+	}
+
+	backend := instruction.GetConnectType()
+	if backend == "" {
+		backend = viper.GetString("tsl.default.type")
+	}
+
+	switch backend {
+	case tsl.WARP.String():
+		protoParser := warpParser("warp 10", lineStart)
+		warpscript, err := protoParser.GenerateWarpScript([]tsl.Instruction{instruction}, allowAuthenticate)
+		if err != nil {
+			return nil, err
+		}
+		return &NativeQuery{Backend: tsl.WARP.String(), Endpoint: instruction.GetConnectAPI(), Query: warpscript}, nil
+
+	case tsl.PROMETHEUS.String(), tsl.PROM.String():
+		protoParser := tsl.ProtoParser{Name: "prometheus", LineStart: lineStart}
+		promQl, err := protoParser.GeneratePromQl(instruction, now)
+		if err != nil {
+			return nil, err
+		}
+		return &NativeQuery{Backend: tsl.PROMETHEUS.String(), Endpoint: instruction.GetConnectAPI(), Query: promQueryPath(promQl)}, nil
+	}
+
+	return nil, errors.New("The specified backend " + backend + " is not supported")
+}
+
 // Execute all Prom requests on a prometheus backend
 func promQuery(instructions []tsl.Instruction, prom string, ctx echo.Context, now time.Time, lineStart int) (string, error) {
 
@@ -417,13 +633,21 @@ func promQuery(instructions []tsl.Instruction, prom string, ctx echo.Context, no
 		promRequests[index] = promQl
 	}
 
+	// Execute identical queries only once and share their result
+	results := make(map[tsl.Ql]string)
+
 	for _, promQl := range promRequests {
 		buffer.WriteString(prefix)
 		if promQl.Query != "" {
 			log.Debug(promQl)
-			body, err := execProm(promQl, ctx, prom)
-			if err != nil {
-				return "", ctx.JSON(http.StatusInternalServerError, tsl.NewError(err))
+			body, ok := results[*promQl]
+			if !ok {
+				var err error
+				body, err = execProm(promQl, ctx, prom)
+				if err != nil {
+					return "", ctx.JSON(http.StatusInternalServerError, tsl.NewError(err))
+				}
+				results[*promQl] = body
 			}
 			buffer.WriteString(body)
 			buffer.WriteString("\n")
@@ -438,15 +662,13 @@ func promQuery(instructions []tsl.Instruction, prom string, ctx echo.Context, no
 // Execute a Warp 10 request
 func warpQuery(instructions []tsl.Instruction, warp string, ctx echo.Context, lineStart int, allowAuthenticate bool) (string, error) {
 
-	protoParser := tsl.ProtoParser{Name: "warp 10", LineStart: lineStart}
+	protoParser := warpParser("warp 10", lineStart)
 	warpscript, err := protoParser.GenerateWarpScript(instructions, allowAuthenticate)
 	if err != nil {
 		return "", ctx.JSON(http.StatusBadRequest, tsl.NewError(err))
 	}
 	log.Debug(warpscript)
-	req := &Request{}
-	req.Body = warpscript
-	res, err := exec(req, warp, ctx)
+	res, err := execWarpInstructions(instructions, warpscript, warp, ctx)
 	if err != nil {
 		log.WithError(err).Error("Could not execute WarpScript")
 		return "", ctx.JSON(http.StatusInternalServerError, tsl.NewError(err))
@@ -454,6 +676,16 @@ func warpQuery(instructions []tsl.Instruction, warp string, ctx echo.Context, li
 	return res, nil
 }
 
+// Execute the WarpScript of Warp 10 instructions, loading their result from the cache when enabled
+func execWarpInstructions(instructions []tsl.Instruction, warpscript string, warp string, ctx echo.Context) (string, error) {
+	if cache != nil {
+		return cache.warp(instructions, warp, func() (string, error) {
+			return exec(&Request{Body: warpscript}, warp, ctx)
+		})
+	}
+	return exec(&Request{Body: warpscript}, warp, ctx)
+}
+
 // Execute WarpScript on Warp10 metrics backend
 func exec(req *Request, warp string, ctx echo.Context) (string, error) {
 
@@ -462,16 +694,31 @@ func exec(req *Request, warp string, ctx echo.Context) (string, error) {
 		return "", err
 	}
 
-	httpReq, err := http.NewRequest(http.MethodPost, warp+"/api/v0/exec", strings.NewReader(req.Body))
-	httpReq.Header.Add("User-Agent", "tsl/"+viper.GetString("version")+" (Warp10)")
+	if pool, ok := getPool(warp); ok {
+		return pool.do(func(url string) (string, error) {
+			return execWarp(req, url, ctx.Request().Context())
+		})
+	}
+	return execWarp(req, warp, ctx.Request().Context())
+}
 
+// Execute WarpScript on a single Warp10 endpoint, until the request context is done
+func execWarp(req *Request, warp string, requestCtx context.Context) (string, error) {
+
+	httpReq, err := http.NewRequest(http.MethodPost, warp+"/api/v0/exec", strings.NewReader(req.Body))
 	if err != nil {
 		return "", err
 	}
+	httpReq = httpReq.WithContext(requestCtx)
+	httpReq.Header.Add("User-Agent", "tsl/"+viper.GetString("version")+" (Warp10)")
 
-	res, err := http.DefaultClient.Do(httpReq)
+	res, err := backendClient(warp).Do(httpReq)
 	if err != nil {
-		return "", err
+		// A canceled request doesn't reflect the endpoint health
+		if requestCtx.Err() != nil {
+			return "", err
+		}
+		return "", &connectionError{err: err}
 	}
 
 	if http.StatusOK != res.StatusCode {
@@ -485,6 +732,26 @@ func exec(req *Request, warp string, ctx echo.Context) (string, error) {
 
 // Execute PromQL on prometheus metrics backend
 func execProm(req *tsl.Ql, ctx echo.Context, prom string) (string, error) {
+	if cache != nil && !req.InstantQuery {
+		return cache.query(req, prom, func(chunk *tsl.Ql) (string, error) {
+			return execPromBackend(chunk, prom, ctx.Request().Context())
+		})
+	}
+	return execPromBackend(req, prom, ctx.Request().Context())
+}
+
+// Execute PromQL on a prometheus endpoint or pool
+func execPromBackend(req *tsl.Ql, prom string, requestCtx context.Context) (string, error) {
+	if pool, ok := getPool(prom); ok {
+		return pool.do(func(url string) (string, error) {
+			return execPromEndpoint(req, url, requestCtx)
+		})
+	}
+	return execPromEndpoint(req, prom, requestCtx)
+}
+
+// Execute PromQL on a single prometheus endpoint, until the request context is done
+func execPromEndpoint(req *tsl.Ql, prom string, requestCtx context.Context) (string, error) {
 
 	queryType := "query_range"
 
@@ -505,17 +772,19 @@ func execProm(req *tsl.Ql, ctx echo.Context, prom string) (string, error) {
 	}
 
 	httpReq, err := http.NewRequest("GET", u.String(), nil)
-	if req.Token != "" {
-		httpReq.Header.Add("Authorization", "Basic "+req.Token)
-	}
-
 	if err != nil {
 		return "", err
 	}
+	httpReq = httpReq.WithContext(requestCtx)
+	setPrometheusAuthorization(httpReq, req.Token)
 
-	res, err := http.DefaultClient.Do(httpReq)
+	res, err := backendClient(prom).Do(httpReq)
 	if err != nil {
-		return "", err
+		// A canceled request doesn't reflect the endpoint health
+		if requestCtx.Err() != nil {
+			return "", err
+		}
+		return "", &connectionError{err: err}
 	}
 
 	defer res.Body.Close()
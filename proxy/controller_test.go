@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/ovh/tsl/tsl"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+func TestPromQuerySharesIdenticalQueries(t *testing.T) {
+	defer viper.Reset()
+
+	var requests int32
+	queries := make(chan string, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		queries <- r.URL.Query().Get("query")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer server.Close()
+
+	viper.Set("tsl.promql.endpoints", []string{server.URL})
+
+	query := "select(\"cpu\").last(1h).sampleBy(1m, last)\nselect(\"cpu\").last(1h).sampleBy(1m, last)\nselect(\"mem\").last(1h).sampleBy(1m, last)"
+	parser, err := tsl.NewParser(strings.NewReader(query), server.URL, "", 0, "", "", nil)
+	if err != nil {
+		t.Fatalf("unexpected parser error: %v", err)
+	}
+	parsed, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	instructions := []tsl.Instruction{}
+	for _, instruction := range parsed.Statements {
+		instructions = append(instructions, *instruction)
+	}
+
+	rec := httptest.NewRecorder()
+	ctx := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/v0/query", nil), rec)
+	res, err := promQuery(instructions, server.URL, ctx, time.Now().UTC(), 0)
+	if err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("unexpected error: %v %s", err, rec.Body.String())
+	}
+
+	if count := atomic.LoadInt32(&requests); count != 2 {
+		t.Errorf("expected the identical cpu queries to be executed once, got %d requests", count)
+	}
+	if count := strings.Count(res, `"resultType":"matrix"`); count != 3 {
+		t.Errorf("expected a result for each statement, got %d in %q", count, res)
+	}
+
+	close(queries)
+	executed := []string{}
+	for query := range queries {
+		executed = append(executed, query)
+	}
+	if len(executed) != 2 || executed[0] == executed[1] {
+		t.Errorf("expected the cpu and mem queries to be executed, got %v", executed)
+	}
+}
+
+// Post a query to the query endpoint of a proxy started without back-end
+func noBackendQuery(t *testing.T, query string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	viper.Set("no-backend", true)
+	viper.Set("tsl.default.type", tsl.WARP.String())
+	viper.Set("tsl.default.endpoint", "http://127.0.0.1:8080")
+	viper.Set("tsl.promql.endpoints", []string{"http://127.0.0.1:9090"})
+
+	rec := httptest.NewRecorder()
+	ctx := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/v0/query", strings.NewReader(query)), rec)
+	if err := NewProxyTSL(prometheus.NewRegistry()).Query(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return rec
+}
+
+func TestQueryNoBackendMixedStatements(t *testing.T) {
+	defer viper.Reset()
+
+	prom := `connect("prometheus", "http://127.0.0.1:9090").select("cpu").last(1h).sampleBy(1m, last)`
+	query := "sub(select(\"cpu\").last(1h).sampleBy(1m, mean), " + prom + ").on(\"host\")\nselect(\"cpu\").last(1h)\n" + prom
+
+	rec := noBackendQuery(t, query)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected a 200 status, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	nativeQueries := []NativeQuery{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &nativeQueries); err != nil {
+		t.Fatalf("expects a native queries list, got %q: %v", rec.Body.String(), err)
+	}
+	if len(nativeQueries) != 3 {
+		t.Fatalf("expected a native query per statement, got %+v", nativeQueries)
+	}
+
+	cross := nativeQueries[0]
+	if cross.Backend != "tsl" || cross.Operator != tsl.SUBSERIES.String() || cross.Query != "" || len(cross.Operands) != 2 {
+		t.Fatalf("expected a sub computed by TSL between two operands, got %+v", cross)
+	}
+	if cross.Operands[0].Backend != tsl.WARP.String() || cross.Operands[1].Backend != tsl.PROMETHEUS.String() {
+		t.Errorf("expected a Warp 10 and a Prometheus operand, got %+v", cross.Operands)
+	}
+
+	warp := nativeQueries[1]
+	if warp.Backend != tsl.WARP.String() || warp.Endpoint != "http://127.0.0.1:8080" || !strings.Contains(warp.Query, "FETCH") {
+		t.Errorf("expected a Warp 10 statement on the default endpoint, got %+v", warp)
+	}
+
+	promQl := nativeQueries[2]
+	if promQl.Backend != tsl.PROMETHEUS.String() || promQl.Endpoint != "http://127.0.0.1:9090" || !strings.HasPrefix(promQl.Query, "/api/v1/query_range?query=") {
+		t.Errorf("expected a Prometheus statement on its connect endpoint, got %+v", promQl)
+	}
+	if cross.Operands[1].Query != promQl.Query {
+		t.Errorf("expected the Prometheus operand to share the query now, got %q and %q", cross.Operands[1].Query, promQl.Query)
+	}
+}
+
+func TestQueryNoBackendMixedStatementsError(t *testing.T) {
+	defer viper.Reset()
+
+	// The Prometheus statement misses its sampler
+	rec := noBackendQuery(t, "select(\"cpu\").last(1h)\nconnect(\"prometheus\", \"http://127.0.0.1:9090\").select(\"cpu\").last(1h)")
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "expects a default sample") {
+		t.Errorf("expected a 400 status with the generation error, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestExecCanceledIsNotConnectionError(t *testing.T) {
+	defer viper.Reset()
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	viper.Set("tsl.warp10.endpoints", []string{server.URL})
+	viper.Set("tsl.promql.endpoints", []string{server.URL})
+
+	requestCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// A canceled request doesn't count as an endpoint failure for pools
+	if _, err := execWarp(&Request{Body: "NOW"}, server.URL, requestCtx); err == nil {
+		t.Error("expected an error on a canceled Warp 10 request")
+	} else if _, isConnectionError := err.(*connectionError); isConnectionError {
+		t.Errorf("expected a canceled Warp 10 request not to be a connection error, got %v", err)
+	}
+
+	if _, err := execPromEndpoint(&tsl.Ql{Query: "up"}, server.URL, requestCtx); err == nil {
+		t.Error("expected an error on a canceled Prometheus request")
+	} else if _, isConnectionError := err.(*connectionError); isConnectionError {
+		t.Errorf("expected a canceled Prometheus request not to be a connection error, got %v", err)
+	}
+
+	// An unreachable endpoint is a connection error
+	close(release)
+	server.Close()
+	if _, err := execWarp(&Request{Body: "NOW"}, server.URL, context.Background()); err == nil {
+		t.Error("expected an error on an unreachable endpoint")
+	} else if _, isConnectionError := err.(*connectionError); !isConnectionError {
+		t.Errorf("expected a connection error, got %v", err)
+	}
+}
+
+func TestSetPrometheusAuthorization(t *testing.T) {
+	tests := []struct {
+		token         string
+		authorization string
+	}{
+		{"", ""},
+		{"TOKEN", "Bearer TOKEN"},
+		{base64.StdEncoding.EncodeToString([]byte("user:pwd")), "Basic dXNlcjpwd2Q="},
+		// A base64 token without credentials pair is a bearer token
+		{base64.StdEncoding.EncodeToString([]byte("token")), "Bearer dG9rZW4="},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		setPrometheusAuthorization(req, test.token)
+		if authorization := req.Header.Get("Authorization"); authorization != test.authorization {
+			t.Errorf("%q: expected the %q authorization, got %q", test.token, test.authorization, authorization)
+		}
+	}
+}
@@ -0,0 +1,572 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/ovh/tsl/tsl"
+	"github.com/spf13/viper"
+)
+
+// WarpSeries is a time series in Warp 10 JSON format
+type WarpSeries struct {
+	Class        string            `json:"c"`
+	Labels       map[string]string `json:"l"`
+	Attributes   map[string]string `json:"a"`
+	LastActivity int64             `json:"la"`
+	Values       [][]interface{}   `json:"v"`
+}
+
+// promResult Prometheus query result, a matrix or a vector
+type promResult struct {
+	Data struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Values [][]interface{}   `json:"values"`
+			Value  []interface{}     `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// crossQuery executes each operand of a cross-backend operator on its own back-end and computes the operator in TSL
+type crossQuery struct {
+	ctx               echo.Context
+	lineStart         int
+	allowAuthenticate bool
+	now               time.Time
+	ticksPerSecond    int64
+}
+
+// Get the query params of a request headers
+func headerParams(ctx echo.Context) map[string]string {
+	headers := ctx.Request().Header
+	params := map[string]string{
+		queryRandeHeader:    headers.Get(queryRandeHeader),
+		samplersCountHeader: headers.Get(samplersCountHeader),
+		timezoneHeader:      headers.Get(timezoneHeader),
+	}
+	if lineStart := headers.Get(lineStartHeader); lineStart != "" {
+		params[lineStartHeader] = lineStart
+	}
+	return params
+}
+
+// Parse and check the statements of a query evaluated by TSL out of the query endpoint, with a param map replacing query headers,
+// injecting the request tenant tokens
+func prepareQuery(ctx echo.Context, tslQuery string, params map[string]string) (*crossQuery, []tsl.Instruction, error) {
+	token := getRequestToken(ctx)
+	query, lineStart, err := parseQueryWithParams(tslQuery, token, params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tenant, err := getTenant(ctx)
+	if err != nil {
+		return nil, nil, &permissionError{err: err}
+	}
+
+	if err := admitQuery(query.Statements, time.Now().UTC()); err != nil {
+		return nil, nil, err
+	}
+
+	statements := []tsl.Instruction{}
+	for _, instruction := range query.Statements {
+		if err := checkConnect(*instruction, token, tenant); err != nil {
+			return nil, nil, err
+		}
+
+		if tenant != nil {
+			instruction.SetConnectTokens(tenant.tokens())
+		}
+		statements = append(statements, *instruction)
+	}
+
+	ticksPerSecond, err := tsl.TimeUnitTicks(viper.GetString("tsl.warp10.timeunit"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	evaluation := &crossQuery{
+		ctx:               ctx,
+		lineStart:         lineStart,
+		allowAuthenticate: viper.GetBool("tsl.warp10.authenticate"),
+		ticksPerSecond:    ticksPerSecond,
+	}
+	return evaluation, statements, nil
+}
+
+// Execute all cross-backend instructions, returns their results as a Warp 10 stack
+func crossBackendQuery(instructions []tsl.Instruction, ctx echo.Context, now time.Time, lineStart int, allowAuthenticate bool) (string, error) {
+	stack, _, err := evaluateInstructions(instructions, ctx, now, lineStart, allowAuthenticate)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := json.Marshal(stack)
+	if err != nil {
+		return "", err
+	}
+	return string(res), nil
+}
+
+// Evaluate instructions in TSL, returns the series of each of them and the platform ticks per second
+func evaluateInstructions(instructions []tsl.Instruction, ctx echo.Context, now time.Time, lineStart int, allowAuthenticate bool) ([][]WarpSeries, int64, error) {
+	ticksPerSecond, err := tsl.TimeUnitTicks(viper.GetString("tsl.warp10.timeunit"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := &crossQuery{ctx: ctx, lineStart: lineStart, allowAuthenticate: allowAuthenticate, now: now, ticksPerSecond: ticksPerSecond}
+
+	stack := make([][]WarpSeries, len(instructions))
+	for index, instruction := range instructions {
+		series, err := query.evaluate(instruction)
+		if err != nil {
+			return nil, 0, err
+		}
+		stack[index] = series
+	}
+	return stack, ticksPerSecond, nil
+}
+
+// Load the series of an instruction, executing it on its back-end or computing it when it's a cross-backend operator,
+// then write them to the instruction store sink
+func (query *crossQuery) evaluate(instruction tsl.Instruction) ([]WarpSeries, error) {
+	series, err := query.compute(instruction)
+	if err != nil {
+		return nil, err
+	}
+
+	if sink := instruction.GetStoreSink(); sink != nil {
+		if err := writeSink(sink, series, query.ticksPerSecond); err != nil {
+			return nil, fmt.Errorf("store to the %s sink failed: %s", sink.Type, err.Error())
+		}
+	}
+	return series, nil
+}
+
+// Compute the series of an instruction
+func (query *crossQuery) compute(instruction tsl.Instruction) ([]WarpSeries, error) {
+	operator := instruction.GetCrossBackendOperator()
+	if operator == nil {
+		return query.execute(instruction)
+	}
+
+	if instruction.HasGroup() {
+		return nil, fmt.Errorf("groupLeft and groupRight are not supported on the cross-backend operator %s", operator.Operator.String())
+	}
+	if instruction.HasFrameworks() {
+		return nil, fmt.Errorf("methods can't be applied on the result of the cross-backend operator %s", operator.Operator.String())
+	}
+
+	operands := make([][]WarpSeries, len(operator.Operands))
+	for index, operand := range operator.Operands {
+		series, err := query.evaluate(operand)
+		if err != nil {
+			return nil, err
+		}
+		operands[index] = series
+	}
+
+	return applyCrossOperator(operator, operands)
+}
+
+// Execute a single backend instruction
+func (query *crossQuery) execute(instruction tsl.Instruction) ([]WarpSeries, error) {
+	api := instruction.GetConnectAPI()
+
+	backend := getBackendType(instruction)
+
+	switch backend {
+	case tsl.WARP.String():
+		if !isExecutableEndpoint(backend, api) {
+			return nil, fmt.Errorf("Warp 10 endpoint %q is not configured", api)
+		}
+
+		// Share the query now with the other back-ends, at the milli-second precision of Prometheus
+		protoParser := warpParser("warp 10", query.lineStart)
+		protoParser.Now = query.now.Truncate(time.Millisecond)
+		warpscript, err := protoParser.GenerateWarpScript([]tsl.Instruction{instruction}, query.allowAuthenticate)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := execWarpInstructions([]tsl.Instruction{instruction}, warpscript, api, query.ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		endpointTicks, err := tsl.TimeUnitTicks(protoParser.EndpointTimeUnit(api))
+		if err != nil {
+			return nil, err
+		}
+		return parseWarpResult(res, endpointTicks, query.ticksPerSecond)
+
+	case tsl.PROMETHEUS.String():
+		if !isExecutableEndpoint(backend, api) {
+			return nil, fmt.Errorf("Prometheus endpoint %q is not configured", api)
+		}
+
+		protoParser := tsl.ProtoParser{Name: "prometheus", LineStart: query.lineStart}
+		promQl, err := protoParser.GeneratePromQl(instruction, query.now)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := execProm(promQl, query.ctx, api)
+		if err != nil {
+			return nil, err
+		}
+		return parsePromResult(res, query.ticksPerSecond)
+	}
+
+	return nil, errors.New("The specified backend " + backend + " is not supported")
+}
+
+// Load the series list on top of a Warp 10 stack, converting its ticks from the endpoint time unit to the query one
+func parseWarpResult(res string, endpointTicks int64, ticksPerSecond int64) ([]WarpSeries, error) {
+	decoder := json.NewDecoder(strings.NewReader(res))
+	decoder.UseNumber()
+
+	stack := [][]WarpSeries{}
+	if err := decoder.Decode(&stack); err != nil {
+		return nil, fmt.Errorf("expects a series list as Warp 10 result: %s", err.Error())
+	}
+	if len(stack) == 0 {
+		return []WarpSeries{}, nil
+	}
+
+	// Keep only the tick and the value of each data point
+	for _, series := range stack[0] {
+		for index, point := range series.Values {
+			tick, err := point[0].(json.Number).Int64()
+			if err != nil {
+				return nil, err
+			}
+			series.Values[index] = []interface{}{convertTick(tick, endpointTicks, ticksPerSecond), point[len(point)-1]}
+		}
+	}
+	return stack[0], nil
+}
+
+// Convert a Prometheus result into series with ticks in platform time unit
+func parsePromResult(res string, ticksPerSecond int64) ([]WarpSeries, error) {
+	result := promResult{}
+	if err := json.Unmarshal([]byte(res), &result); err != nil {
+		return nil, fmt.Errorf("expects a matrix or a vector as Prometheus result: %s", err.Error())
+	}
+
+	seriesList := make([]WarpSeries, len(result.Data.Result))
+	for index, promSeries := range result.Data.Result {
+		series := WarpSeries{Labels: map[string]string{}, Attributes: map[string]string{}, Values: [][]interface{}{}}
+		for key, value := range promSeries.Metric {
+			if key == "__name__" {
+				series.Class = value
+				continue
+			}
+			series.Labels[key] = value
+		}
+
+		points := promSeries.Values
+		if result.Data.ResultType == "vector" {
+			points = [][]interface{}{promSeries.Value}
+		}
+
+		for _, point := range points {
+			if len(point) != 2 {
+				continue
+			}
+			seconds, ok := point[0].(float64)
+			if !ok {
+				return nil, errors.New("expects a number as Prometheus timestamp")
+			}
+			value, err := strconv.ParseFloat(fmt.Sprintf("%v", point[1]), 64)
+			if err != nil {
+				return nil, err
+			}
+			tick := int64(math.Round(seconds * float64(ticksPerSecond)))
+			series.Values = append(series.Values, []interface{}{tick, value})
+		}
+		seriesList[index] = series
+	}
+	return seriesList, nil
+}
+
+// Compute an operator between series sets matching on labels and exact ticks
+func applyCrossOperator(operator *tsl.CrossBackendOperator, operands [][]WarpSeries) ([]WarpSeries, error) {
+	keys := []string{}
+	indexes := make([]map[string]WarpSeries, len(operands))
+
+	for index, operand := range operands {
+		indexes[index] = make(map[string]WarpSeries)
+		for _, series := range operand {
+			key := matchingKey(matchingLabels(operator, series.Labels))
+
+			if _, exists := indexes[index][key]; exists {
+				return nil, fmt.Errorf("multiple matches for labels %s in operator %s: a cross-backend operator expects one series per labels in each metrics set", key, operator.Operator.String())
+			}
+
+			// Results keep the labels of the first metrics set series, as the native operators
+			labels := make(map[string]string, len(series.Labels))
+			for label, value := range series.Labels {
+				labels[label] = value
+			}
+			indexes[index][key] = WarpSeries{Class: series.Class, Labels: labels, Attributes: map[string]string{}, Values: series.Values}
+
+			if index == 0 {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	result := []WarpSeries{}
+	for _, key := range keys {
+		matches := make([]WarpSeries, len(operands))
+		found := true
+		for index := range operands {
+			series, ok := indexes[index][key]
+			if !ok {
+				found = false
+				break
+			}
+			matches[index] = series
+		}
+		if !found {
+			continue
+		}
+
+		series, err := applyCrossValues(operator.Operator, matches)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, series)
+	}
+	return result, nil
+}
+
+// Compute an operator on the ticks of the first series, matching the nearest tick of each other series
+// within half of its step as back-ends may not align their buckets on the same ticks
+func applyCrossValues(operator tsl.Token, matches []WarpSeries) (WarpSeries, error) {
+	points := make([][][]interface{}, len(matches))
+	tolerances := make([]int64, len(matches))
+	for index, series := range matches {
+		points[index] = append([][]interface{}{}, series.Values...)
+		sort.Slice(points[index], func(i, j int) bool { return points[index][i][0].(int64) < points[index][j][0].(int64) })
+		tolerances[index] = seriesStep(points[index]) / 2
+	}
+
+	series := WarpSeries{Class: matches[0].Class, Labels: matches[0].Labels, Attributes: map[string]string{}, Values: [][]interface{}{}}
+	for _, point := range matches[0].Values {
+		tick := point[0].(int64)
+
+		values := []interface{}{point[1]}
+		for index := 1; index < len(matches); index++ {
+			value, ok := nearestValue(points[index], tick, tolerances[index])
+			if !ok {
+				break
+			}
+			values = append(values, value)
+		}
+		if len(values) != len(matches) {
+			continue
+		}
+
+		value, keep, err := crossValue(operator, values)
+		if err != nil {
+			return series, err
+		}
+		if keep {
+			series.Values = append(series.Values, []interface{}{tick, value})
+		}
+	}
+	return series, nil
+}
+
+// Get the smallest interval between the sorted ticks of a series, 0 for a series with a single tick
+func seriesStep(points [][]interface{}) int64 {
+	step := int64(0)
+	for index := 1; index < len(points); index++ {
+		interval := points[index][0].(int64) - points[index-1][0].(int64)
+		if interval > 0 && (step == 0 || interval < step) {
+			step = interval
+		}
+	}
+	return step
+}
+
+// Get the value of the sorted points tick nearest to a tick, when within the tolerance
+func nearestValue(points [][]interface{}, tick int64, tolerance int64) (interface{}, bool) {
+	index := sort.Search(len(points), func(i int) bool { return points[i][0].(int64) >= tick })
+
+	var value interface{}
+	distance := tolerance + 1
+	if index < len(points) {
+		value, distance = points[index][1], points[index][0].(int64)-tick
+	}
+	if index > 0 && tick-points[index-1][0].(int64) < distance {
+		value, distance = points[index-1][1], tick-points[index-1][0].(int64)
+	}
+	return value, distance <= tolerance
+}
+
+// Compute an operator on the values of a tick, returns whether the tick is kept
+func crossValue(operator tsl.Token, values []interface{}) (interface{}, bool, error) {
+	switch operator {
+	case tsl.ANDL, tsl.ORL:
+		result := operator == tsl.ANDL
+		for _, value := range values {
+			if operator == tsl.ANDL {
+				result = result && toBool(value)
+			} else {
+				result = result || toBool(value)
+			}
+		}
+		return result, true, nil
+
+	case tsl.MASK, tsl.NEGMASK:
+		return values[1], toBool(values[0]) == (operator == tsl.MASK), nil
+	}
+
+	numbers := make([]float64, len(values))
+	for index, value := range values {
+		number, err := toFloat(value)
+		if err != nil {
+			return nil, false, fmt.Errorf("operator %s expects numeric values: %s", operator.String(), err.Error())
+		}
+		numbers[index] = number
+	}
+
+	result := numbers[0]
+	for _, number := range numbers[1:] {
+		switch operator {
+		case tsl.ADDSERIES:
+			result += number
+		case tsl.SUBSERIES:
+			result -= number
+		case tsl.MULSERIES:
+			result *= number
+		case tsl.DIVSERIES:
+			result /= number
+		}
+	}
+
+	// Comparison operators keep the first value when the comparison holds between each consecutive values
+	for index := 1; index < len(numbers); index++ {
+		left := numbers[index-1]
+		right := numbers[index]
+
+		var holds bool
+		switch operator {
+		case tsl.EQUAL:
+			holds = left == right
+		case tsl.NOTEQUAL:
+			holds = left != right
+		case tsl.GREATERTHAN:
+			holds = left > right
+		case tsl.GREATEROREQUAL:
+			holds = left >= right
+		case tsl.LESSTHAN:
+			holds = left < right
+		case tsl.LESSOREQUAL:
+			holds = left <= right
+		default:
+			holds = true
+		}
+		if !holds {
+			return nil, false, nil
+		}
+	}
+
+	return result, true, nil
+}
+
+// Get the labels of a series used to match the other metrics sets
+func matchingLabels(operator *tsl.CrossBackendOperator, labels map[string]string) map[string]string {
+	matching := make(map[string]string)
+
+	if operator.IsOn {
+		for _, label := range operator.Labels {
+			if value, ok := labels[label]; ok {
+				matching[label] = value
+			}
+		}
+		return matching
+	}
+
+	for key, value := range labels {
+		matching[key] = value
+	}
+	if operator.IsIgnoring {
+		for _, label := range operator.Ignoring {
+			delete(matching, label)
+		}
+	}
+	return matching
+}
+
+// Get a unique key of a labels set
+func matchingKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buffer bytes.Buffer
+	buffer.WriteString("{")
+	for index, key := range keys {
+		if index > 0 {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString(strconv.Quote(key) + "=" + strconv.Quote(labels[key]))
+	}
+	buffer.WriteString("}")
+	return buffer.String()
+}
+
+// Convert a series value into a number
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case json.Number:
+		return v.Float64()
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("got %v", value)
+}
+
+// Convert a series value into a boolean
+func toBool(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	}
+	number, err := toFloat(value)
+	return err == nil && number != 0
+}
+
+// Check if a list contains a value
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
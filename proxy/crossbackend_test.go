@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ovh/tsl/tsl"
+)
+
+func TestApplyCrossValuesNearestTicks(t *testing.T) {
+	warp := WarpSeries{Class: "cpu", Values: [][]interface{}{{int64(120000), 3.0}, {int64(60000), 2.0}, {int64(0), 1.0}}}
+	prom := WarpSeries{Class: "cpu", Values: [][]interface{}{{int64(1000), 10.0}, {int64(61000), 20.0}, {int64(151000), 30.0}}}
+
+	// Ticks 0 and 60000 match within half of the Prometheus step, tick 120000 is 31000 away from the nearest one
+	series, err := applyCrossValues(tsl.ADDSERIES, []WarpSeries{warp, prom})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[int64]float64{0: 11, 60000: 22}
+	if len(series.Values) != len(expected) {
+		t.Fatalf("expected %d points, got %v", len(expected), series.Values)
+	}
+	for _, point := range series.Values {
+		if value, ok := expected[point[0].(int64)]; !ok || point[1] != value {
+			t.Errorf("unexpected point %v", point)
+		}
+	}
+}
+
+func TestApplyCrossValuesSingleTick(t *testing.T) {
+	first := WarpSeries{Class: "cpu", Values: [][]interface{}{{int64(1000), 1.0}}}
+	second := WarpSeries{Class: "cpu", Values: [][]interface{}{{int64(1001), 2.0}}}
+
+	// A series with a single tick only matches its exact tick
+	series, err := applyCrossValues(tsl.ADDSERIES, []WarpSeries{first, second})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(series.Values) != 0 {
+		t.Errorf("expected no points, got %v", series.Values)
+	}
+
+	second.Values[0][0] = int64(1000)
+	series, err = applyCrossValues(tsl.ADDSERIES, []WarpSeries{first, second})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(series.Values) != 1 || series.Values[0][1] != 3.0 {
+		t.Errorf("expected a single point of value 3, got %v", series.Values)
+	}
+}
+
+func TestApplyCrossOperatorLabels(t *testing.T) {
+	warp := []WarpSeries{
+		{Class: "cpu", Labels: map[string]string{"host": "a", "dc": "gra"}, Values: [][]interface{}{{int64(0), 1.0}}},
+		{Class: "cpu", Labels: map[string]string{"host": "b", "dc": "rbx"}, Values: [][]interface{}{{int64(0), 2.0}}},
+	}
+	prom := []WarpSeries{
+		{Class: "cpu", Labels: map[string]string{"host": "a", "job": "node"}, Values: [][]interface{}{{int64(0), 10.0}}},
+		{Class: "cpu", Labels: map[string]string{"host": "c", "job": "node"}, Values: [][]interface{}{{int64(0), 30.0}}},
+	}
+
+	tests := []struct {
+		operator *tsl.CrossBackendOperator
+		expected []map[string]string
+	}{
+		{
+			&tsl.CrossBackendOperator{Operator: tsl.ADDSERIES, IsOn: true, Labels: []string{"host"}},
+			[]map[string]string{{"host": "a", "dc": "gra"}},
+		},
+		{
+			&tsl.CrossBackendOperator{Operator: tsl.ADDSERIES, IsIgnoring: true, Ignoring: []string{"dc", "job"}},
+			[]map[string]string{{"host": "a", "dc": "gra"}},
+		},
+		{
+			&tsl.CrossBackendOperator{Operator: tsl.ADDSERIES},
+			[]map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		series, err := applyCrossOperator(test.operator, [][]WarpSeries{warp, prom})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(series) != len(test.expected) {
+			t.Fatalf("expected %d series, got %v", len(test.expected), series)
+		}
+		for index, expected := range test.expected {
+			if !reflect.DeepEqual(series[index].Labels, expected) {
+				t.Errorf("expected the first metrics set labels %v, got %v", expected, series[index].Labels)
+			}
+			if len(series[index].Values) != 1 || series[index].Values[0][1] != 11.0 {
+				t.Errorf("expected a single point of value 11, got %v", series[index].Values)
+			}
+		}
+	}
+
+	// Results labels are a copy of the operand ones
+	series, err := applyCrossOperator(tests[0].operator, [][]WarpSeries{warp, prom})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	series[0].Labels["host"] = "z"
+	if warp[0].Labels["host"] != "a" {
+		t.Error("expected the operand labels to be left unchanged")
+	}
+}
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Series output formats
+const (
+	jsonFormat    = "json"
+	csvFormat     = "csv"
+	wideCSVFormat = "csv-wide"
+	ndjsonFormat  = "ndjson"
+	arrowFormat   = "arrow"
+)
+
+// Series output formats content types
+var formatContentTypes = map[string]string{
+	jsonFormat:    echo.MIMEApplicationJSONCharsetUTF8,
+	csvFormat:     "text/csv; charset=utf-8",
+	wideCSVFormat: "text/csv; charset=utf-8",
+	ndjsonFormat:  "application/x-ndjson",
+	arrowFormat:   "application/vnd.apache.arrow.stream",
+}
+
+// Get the series output format of a request, from its format parameter or its Accept header
+// Returns an empty format when none is requested
+func seriesFormat(ctx echo.Context) (string, error) {
+	if format := ctx.QueryParam("format"); format != "" {
+		if _, ok := formatContentTypes[format]; !ok {
+			return "", fmt.Errorf("unknown format %q, expects json, csv, csv-wide, ndjson or arrow", format)
+		}
+		return format, nil
+	}
+
+	accept := ctx.Request().Header.Get(echo.HeaderAccept)
+	switch {
+	case strings.Contains(accept, "text/csv"):
+		return csvFormat, nil
+	case strings.Contains(accept, "application/x-ndjson"):
+		return ndjsonFormat, nil
+	case strings.Contains(accept, "application/vnd.apache.arrow.stream"):
+		return arrowFormat, nil
+	}
+	return "", nil
+}
+
+// Write series in an output format as response
+func writeSeries(ctx echo.Context, format string, series []WarpSeries, ticksPerSecond int64) error {
+	response := ctx.Response()
+	response.Header().Set(echo.HeaderContentType, formatContentTypes[format])
+	response.WriteHeader(http.StatusOK)
+
+	switch format {
+	case csvFormat:
+		return formatCSV(response, series, ticksPerSecond)
+	case wideCSVFormat:
+		return formatWideCSV(response, series, ticksPerSecond)
+	case ndjsonFormat:
+		return formatNDJSON(response, series, ticksPerSecond)
+	case arrowFormat:
+		return formatArrow(response, series, ticksPerSecond)
+	}
+	return json.NewEncoder(response).Encode(series)
+}
+
+// Write series as a CSV table with one line per data point: series, labels, timestamp and value
+func formatCSV(writer io.Writer, series []WarpSeries, ticksPerSecond int64) error {
+	table := csv.NewWriter(writer)
+	if err := table.Write([]string{"series", "labels", "timestamp", "value"}); err != nil {
+		return err
+	}
+
+	for _, gts := range series {
+		labels := csvLabels(gts.Labels)
+		for _, point := range gts.Values {
+			if len(point) < 2 {
+				continue
+			}
+			tick, isTick := point[0].(int64)
+			if !isTick {
+				continue
+			}
+			if err := table.Write([]string{gts.Class, labels, tickTime(tick, ticksPerSecond).Format(time.RFC3339Nano), csvValue(point[len(point)-1])}); err != nil {
+				return err
+			}
+		}
+	}
+
+	table.Flush()
+	return table.Error()
+}
+
+// Write series as a CSV table with one line per timestamp and one column per series
+func formatWideCSV(writer io.Writer, series []WarpSeries, ticksPerSecond int64) error {
+	table := csv.NewWriter(writer)
+
+	header := make([]string, len(series)+1)
+	header[0] = "timestamp"
+	rows := map[int64][]string{}
+	for index, gts := range series {
+		header[index+1] = gts.Class + "{" + csvLabels(gts.Labels) + "}"
+
+		for _, point := range gts.Values {
+			if len(point) < 2 {
+				continue
+			}
+			tick, isTick := point[0].(int64)
+			if !isTick {
+				continue
+			}
+			if _, ok := rows[tick]; !ok {
+				rows[tick] = make([]string, len(series)+1)
+				rows[tick][0] = tickTime(tick, ticksPerSecond).Format(time.RFC3339Nano)
+			}
+			rows[tick][index+1] = csvValue(point[len(point)-1])
+		}
+	}
+	if err := table.Write(header); err != nil {
+		return err
+	}
+
+	ticks := make([]int64, 0, len(rows))
+	for tick := range rows {
+		ticks = append(ticks, tick)
+	}
+	sort.Slice(ticks, func(i, j int) bool { return ticks[i] < ticks[j] })
+
+	for _, tick := range ticks {
+		if err := table.Write(rows[tick]); err != nil {
+			return err
+		}
+	}
+
+	table.Flush()
+	return table.Error()
+}
+
+// ndjsonPoint is a data point of a series, written as a JSON line
+type ndjsonPoint struct {
+	Series    string            `json:"series"`
+	Labels    map[string]string `json:"labels"`
+	Timestamp string            `json:"timestamp"`
+	Value     interface{}       `json:"value"`
+}
+
+// Write series as JSON lines with one data point per line
+func formatNDJSON(writer io.Writer, series []WarpSeries, ticksPerSecond int64) error {
+	encoder := json.NewEncoder(writer)
+	for _, gts := range series {
+		for _, point := range gts.Values {
+			if len(point) < 2 {
+				continue
+			}
+			tick, isTick := point[0].(int64)
+			if !isTick {
+				continue
+			}
+			line := ndjsonPoint{Series: gts.Class, Labels: gts.Labels, Timestamp: tickTime(tick, ticksPerSecond).Format(time.RFC3339Nano), Value: point[len(point)-1]}
+			if err := encoder.Encode(line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Format series labels as a sorted key=value list
+func csvLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for index, key := range keys {
+		pairs[index] = key + "=" + labels[key]
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Format a series value as a CSV cell
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	number, err := toFloat(value)
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatFloat(number, 'g', -1, 64)
+}
+
+// Convert platform ticks into an UTC time
+func tickTime(tick int64, ticksPerSecond int64) time.Time {
+	return time.Unix(tick/ticksPerSecond, tick%ticksPerSecond*(int64(time.Second)/ticksPerSecond)).UTC()
+}
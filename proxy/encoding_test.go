@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Series with a non numeric value and labels holding CSV delimiters
+var testSeries = []WarpSeries{
+	{Class: "cpu", Labels: map[string]string{"host": "a", "dc": "gra,\"1\""}, Values: [][]interface{}{{int64(1346846400000000), 1.5}, {int64(1346846460000000), json.Number("2")}}},
+	{Class: "status", Labels: map[string]string{}, Values: [][]interface{}{{int64(1346846400500000), "up"}}},
+}
+
+func TestFormatCSV(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := formatCSV(&buffer, testSeries, 1000000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rows, err := csv.NewReader(&buffer).ReadAll()
+	if err != nil {
+		t.Fatalf("unexpected CSV error: %v", err)
+	}
+	expected := [][]string{
+		{"series", "labels", "timestamp", "value"},
+		{"cpu", "dc=gra,\"1\",host=a", "2012-09-05T12:00:00Z", "1.5"},
+		{"cpu", "dc=gra,\"1\",host=a", "2012-09-05T12:01:00Z", "2"},
+		{"status", "", "2012-09-05T12:00:00.5Z", "up"},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected %q, got %q", expected, rows)
+	}
+}
+
+func TestFormatWideCSV(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := formatWideCSV(&buffer, testSeries, 1000000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rows, err := csv.NewReader(&buffer).ReadAll()
+	if err != nil {
+		t.Fatalf("unexpected CSV error: %v", err)
+	}
+	expected := [][]string{
+		{"timestamp", "cpu{dc=gra,\"1\",host=a}", "status{}"},
+		{"2012-09-05T12:00:00Z", "1.5", ""},
+		{"2012-09-05T12:00:00.5Z", "", "up"},
+		{"2012-09-05T12:01:00Z", "2", ""},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected %q, got %q", expected, rows)
+	}
+}
+
+func TestFormatNDJSON(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := formatNDJSON(&buffer, testSeries, 1000000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	points := []ndjsonPoint{}
+	scanner := bufio.NewScanner(&buffer)
+	for scanner.Scan() {
+		point := ndjsonPoint{}
+		if err := json.Unmarshal(scanner.Bytes(), &point); err != nil {
+			t.Fatalf("unexpected error on line %q: %v", scanner.Text(), err)
+		}
+		points = append(points, point)
+	}
+
+	expected := []ndjsonPoint{
+		{Series: "cpu", Labels: testSeries[0].Labels, Timestamp: "2012-09-05T12:00:00Z", Value: 1.5},
+		{Series: "cpu", Labels: testSeries[0].Labels, Timestamp: "2012-09-05T12:01:00Z", Value: 2.0},
+		{Series: "status", Labels: map[string]string{}, Timestamp: "2012-09-05T12:00:00.5Z", Value: "up"},
+	}
+	if !reflect.DeepEqual(points, expected) {
+		t.Errorf("expected %+v, got %+v", expected, points)
+	}
+}
+
+// fbReader reads the FlatBuffers tables of an Arrow IPC message metadata
+type fbReader struct {
+	t      *testing.T
+	buffer []byte
+}
+
+// Get the position of a table field, 0 when absent
+func (reader fbReader) field(table int, index int) int {
+	vtable := table - int(int32(binary.LittleEndian.Uint32(reader.buffer[table:])))
+	if 4+2*index >= int(binary.LittleEndian.Uint16(reader.buffer[vtable:])) {
+		return 0
+	}
+	offset := int(binary.LittleEndian.Uint16(reader.buffer[vtable+4+2*index:]))
+	if offset == 0 {
+		return 0
+	}
+	return table + offset
+}
+
+// Follow the offset of a reference field
+func (reader fbReader) reference(table int, index int) int {
+	position := reader.field(table, index)
+	if position == 0 {
+		reader.t.Fatalf("missing field %d of table %d", index, table)
+	}
+	return position + int(binary.LittleEndian.Uint32(reader.buffer[position:]))
+}
+
+func (reader fbReader) byteField(table int, index int) byte {
+	if position := reader.field(table, index); position != 0 {
+		return reader.buffer[position]
+	}
+	return 0
+}
+
+func (reader fbReader) shortField(table int, index int) int16 {
+	if position := reader.field(table, index); position != 0 {
+		return int16(binary.LittleEndian.Uint16(reader.buffer[position:]))
+	}
+	return 0
+}
+
+func (reader fbReader) longField(table int, index int) int64 {
+	if position := reader.field(table, index); position != 0 {
+		return int64(binary.LittleEndian.Uint64(reader.buffer[position:]))
+	}
+	return 0
+}
+
+func (reader fbReader) stringField(table int, index int) string {
+	position := reader.reference(table, index)
+	length := int(binary.LittleEndian.Uint32(reader.buffer[position:]))
+	return string(reader.buffer[position+4 : position+4+length])
+}
+
+// Get the tables of a vector field
+func (reader fbReader) tables(table int, index int) []int {
+	position := reader.reference(table, index)
+	tables := make([]int, binary.LittleEndian.Uint32(reader.buffer[position:]))
+	for element := range tables {
+		slot := position + 4 + 4*element
+		tables[element] = slot + int(binary.LittleEndian.Uint32(reader.buffer[slot:]))
+	}
+	return tables
+}
+
+// Get the 16 bytes structs of a vector field as pairs of longs, which must be aligned on 8 bytes
+func (reader fbReader) structs(table int, index int) [][2]int64 {
+	position := reader.reference(table, index)
+	if (position+4)%8 != 0 {
+		reader.t.Errorf("struct vector at %d isn't aligned on 8 bytes", position)
+	}
+	structs := make([][2]int64, binary.LittleEndian.Uint32(reader.buffer[position:]))
+	for element := range structs {
+		start := position + 4 + 16*element
+		structs[element] = [2]int64{int64(binary.LittleEndian.Uint64(reader.buffer[start:])), int64(binary.LittleEndian.Uint64(reader.buffer[start+8:]))}
+	}
+	return structs
+}
+
+// arrowTestMessage is a decoded Arrow IPC message: its metadata root table and its body
+type arrowTestMessage struct {
+	metadata fbReader
+	root     int
+	body     []byte
+}
+
+// Read the encapsulated messages of an Arrow IPC stream until its end marker
+func readArrowStream(t *testing.T, stream []byte) []arrowTestMessage {
+	messages := []arrowTestMessage{}
+	position := 0
+	for {
+		if binary.LittleEndian.Uint32(stream[position:]) != arrowContinuation {
+			t.Fatalf("expected a continuation marker at %d", position)
+		}
+		size := int(binary.LittleEndian.Uint32(stream[position+4:]))
+		position += 8
+		if size == 0 {
+			if position != len(stream) {
+				t.Errorf("expected the stream to end after its end marker, got %d more bytes", len(stream)-position)
+			}
+			return messages
+		}
+		if position%arrowAlignment != 0 || size%arrowAlignment != 0 {
+			t.Errorf("message at %d of %d bytes isn't aligned on %d bytes", position, size, arrowAlignment)
+		}
+
+		metadata := fbReader{t: t, buffer: stream[position : position+size]}
+		root := int(binary.LittleEndian.Uint32(metadata.buffer))
+		if version := metadata.shortField(root, 0); version != arrowMetadataV5 {
+			t.Errorf("expected the V5 metadata version, got %d", version)
+		}
+		position += size
+
+		bodyLength := int(metadata.longField(root, 3))
+		messages = append(messages, arrowTestMessage{metadata: metadata, root: root, body: stream[position : position+bodyLength]})
+		position += bodyLength
+	}
+}
+
+func TestFormatArrow(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := formatArrow(&buffer, testSeries, 1000000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	messages := readArrowStream(t, buffer.Bytes())
+	if len(messages) != 2 {
+		t.Fatalf("expected a schema and a record batch, got %d messages", len(messages))
+	}
+
+	// Schema fields: name, nullable, type and type parameters
+	schema := messages[0]
+	if headerType := schema.metadata.byteField(schema.root, 1); headerType != arrowHeaderSchema {
+		t.Fatalf("expected a schema message, got %d", headerType)
+	}
+	fields := []string{}
+	for _, field := range schema.metadata.tables(schema.metadata.reference(schema.root, 2), 1) {
+		description := fmt.Sprintf("%s:%d:%v", schema.metadata.stringField(field, 0), schema.metadata.byteField(field, 2), schema.metadata.byteField(field, 1) == 1)
+		fieldType := schema.metadata.reference(field, 3)
+		switch schema.metadata.byteField(field, 2) {
+		case arrowTypeTimestamp:
+			description += fmt.Sprintf(":%d:%s", schema.metadata.shortField(fieldType, 0), schema.metadata.stringField(fieldType, 1))
+		case arrowTypeFloat:
+			description += fmt.Sprintf(":%d", schema.metadata.shortField(fieldType, 0))
+		}
+		fields = append(fields, description)
+	}
+	expectedFields := []string{"series:5:false", "labels:5:false", "timestamp:10:false:3:UTC", "value:3:true:2"}
+	if !reflect.DeepEqual(fields, expectedFields) {
+		t.Errorf("expected the fields %v, got %v", expectedFields, fields)
+	}
+
+	record := messages[1]
+	if headerType := record.metadata.byteField(record.root, 1); headerType != arrowHeaderRecord {
+		t.Fatalf("expected a record batch message, got %d", headerType)
+	}
+	header := record.metadata.reference(record.root, 2)
+	rows := int(record.metadata.longField(header, 0))
+	nodes := record.metadata.structs(header, 1)
+	buffers := record.metadata.structs(header, 2)
+	if rows != 3 || len(nodes) != 4 || len(buffers) != 10 {
+		t.Fatalf("expected 3 rows, 4 columns and 10 buffers, got %d, %d and %d", rows, len(nodes), len(buffers))
+	}
+
+	body := func(index int) []byte {
+		if buffers[index][0]%arrowAlignment != 0 {
+			t.Errorf("buffer %d isn't aligned on %d bytes", index, arrowAlignment)
+		}
+		return record.body[buffers[index][0] : buffers[index][0]+buffers[index][1]]
+	}
+	utf8 := func(offsets []byte, data []byte) []string {
+		values := []string{}
+		for row := 0; row < rows; row++ {
+			values = append(values, string(data[binary.LittleEndian.Uint32(offsets[4*row:]):binary.LittleEndian.Uint32(offsets[4*row+4:])]))
+		}
+		return values
+	}
+
+	if series := utf8(body(1), body(2)); !reflect.DeepEqual(series, []string{"cpu", "cpu", "status"}) {
+		t.Errorf("unexpected series column %v", series)
+	}
+	if labels := utf8(body(4), body(5)); !reflect.DeepEqual(labels, []string{"dc=gra,\"1\",host=a", "dc=gra,\"1\",host=a", ""}) {
+		t.Errorf("unexpected labels column %q", labels)
+	}
+
+	timestamps := []string{}
+	for row := 0; row < rows; row++ {
+		timestamps = append(timestamps, time.Unix(0, int64(binary.LittleEndian.Uint64(body(7)[8*row:]))).UTC().Format(time.RFC3339Nano))
+	}
+	if !reflect.DeepEqual(timestamps, []string{"2012-09-05T12:00:00Z", "2012-09-05T12:01:00Z", "2012-09-05T12:00:00.5Z"}) {
+		t.Errorf("unexpected timestamp column %v", timestamps)
+	}
+
+	// The non numeric value is null
+	if nodes[3] != [2]int64{3, 1} {
+		t.Errorf("expected 3 values with a null, got %v", nodes[3])
+	}
+	validity := body(8)
+	values := []string{}
+	for row := 0; row < rows; row++ {
+		if validity[row/8]&(1<<uint(row%8)) == 0 {
+			values = append(values, "null")
+			continue
+		}
+		values = append(values, fmt.Sprint(math.Float64frombits(binary.LittleEndian.Uint64(body(9)[8*row:]))))
+	}
+	if strings.Join(values, " ") != "1.5 2 null" {
+		t.Errorf("unexpected value column %v", values)
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/ovh/tsl/tsl"
+	"github.com/spf13/viper"
+)
+
+// Explain is the API call method returning the execution plan of each TSL statement without executing it
+func (proxyTsl ProxyTSL) Explain(ctx echo.Context) error {
+
+	proxyTsl.ReqCounter.Inc()
+
+	// Read user body
+	body, err := ioutil.ReadAll(ctx.Request().Body)
+	if err != nil {
+		proxyTsl.WarnCounter.Inc()
+		return ctx.JSON(http.StatusBadRequest, tsl.NewError(err))
+	}
+
+	plans, err := ExplainQueries(string(body), getRequestToken(ctx), viper.GetBool("tsl.warp10.authenticate"), headerParams(ctx))
+	if err != nil {
+		proxyTsl.WarnCounter.Inc()
+		return ctx.JSON(http.StatusBadRequest, tsl.NewError(err))
+	}
+
+	return ctx.JSON(http.StatusOK, plans)
+}
+
+// ExplainQueries Generate the execution plan of each statement of a TSL query with a param map replacing query headers
+func ExplainQueries(tslQuery string, defaultToken string, allowAuthenticate bool, params map[string]string) ([]tsl.Plan, error) {
+	query, lineStart, err := parseQueryWithParams(tslQuery, defaultToken, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set a common now for all Prometheus statements
+	now := time.Now().UTC()
+
+	plans := []tsl.Plan{}
+	for _, instruction := range query.Statements {
+		plan, err := explainInstruction(*instruction, lineStart, allowAuthenticate, now)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add the statement estimated cost used by the admission control
+		protoParser := costParser()
+		cost := protoParser.EstimateCost(*instruction, now, viper.GetString("tsl.default.type"))
+		plan.Cost = &cost
+		plans = append(plans, *plan)
+	}
+
+	return plans, nil
+}
+
+// Parse a TSL query on the default endpoint with a param map replacing query headers, returns the query line start
+func parseQueryWithParams(tslQuery string, defaultToken string, params map[string]string) (*tsl.Query, int, error) {
+	lineStart := 0
+	if lineCount, contains := params[lineStartHeader]; contains {
+		var err error
+		lineStart, err = strconv.Atoi(lineCount)
+		if err != nil {
+			return nil, 0, errors.New("unvalid header " + lineStartHeader + ", expects an integer number")
+		}
+	}
+
+	variables := []string{}
+	parser, err := tsl.NewParserWithTimezone(strings.NewReader(tslQuery), viper.GetString("tsl.default.endpoint"), defaultToken, lineStart, params[queryRandeHeader], params[samplersCountHeader], params[timezoneHeader], variables)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query, err := parser.Parse()
+	if err != nil {
+		return nil, 0, err
+	}
+	return query, lineStart, nil
+}
+
+// Generate the execution plan of a single statement
+func explainInstruction(instruction tsl.Instruction, lineStart int, allowAuthenticate bool, now time.Time) (*tsl.Plan, error) {
+
+	// Cross-backend operators are computed by TSL on its operands results
+	if operator := instruction.GetCrossBackendOperator(); operator != nil {
+		plan := &tsl.Plan{Backend: "tsl", PushedDown: []string{}, PostProcessed: []string{}}
+		for index, operand := range operator.Operands {
+			operandPlan, err := explainInstruction(operand, lineStart, allowAuthenticate, now)
+			if err != nil {
+				return nil, err
+			}
+			if index == 0 {
+				plan.Start, plan.End, plan.Step = operandPlan.Start, operandPlan.End, operandPlan.Step
+			}
+			plan.PushedDown = append(plan.PushedDown, operandPlan.PushedDown...)
+			plan.PostProcessed = append(plan.PostProcessed, operandPlan.PostProcessed...)
+			plan.Fetches += operandPlan.Fetches
+		}
+		plan.PostProcessed = append(plan.PostProcessed, operator.Operator.String())
+		if instruction.GetStoreSink() != nil {
+			plan.PostProcessed = append(plan.PostProcessed, tsl.STORE.String())
+		}
+		return plan, nil
+	}
+
+	backend := instruction.GetConnectType()
+	if backend == "" {
+		backend = viper.GetString("tsl.default.type")
+	}
+
+	switch backend {
+	case tsl.WARP.String():
+		protoParser := warpParser("warp 10", lineStart)
+		return protoParser.ExplainWarpScript(instruction, allowAuthenticate)
+	case tsl.PROMETHEUS.String(), tsl.PROM.String():
+		protoParser := tsl.ProtoParser{Name: "prometheus", LineStart: lineStart}
+		return protoParser.ExplainPromQl(instruction, now)
+	}
+
+	return nil, errors.New("The specified backend " + backend + " is not supported")
+}
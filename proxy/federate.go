@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/ovh/tsl/tsl"
+)
+
+// Metrics text formats content types
+const (
+	openMetricsContentType    = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	prometheusTextContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// Federate is the API call method exposing the last value of each series of a TSL query in the OpenMetrics text format,
+// or in the Prometheus text format when the client doesn't accept OpenMetrics, to be scraped by a Prometheus server
+func (proxyTsl ProxyTSL) Federate(ctx echo.Context) error {
+
+	proxyTsl.ReqCounter.Inc()
+
+	tslQuery := ctx.QueryParam("query")
+	if strings.TrimSpace(tslQuery) == "" {
+		proxyTsl.WarnCounter.Inc()
+		return ctx.JSON(http.StatusBadRequest, tsl.NewError(errors.New("expects a TSL query as query parameter")))
+	}
+
+	evaluation, statements, err := prepareQuery(ctx, tslQuery, headerParams(ctx))
+	if err != nil {
+		proxyTsl.WarnCounter.Inc()
+		return ctx.JSON(queryErrorStatus(err), tsl.NewError(err))
+	}
+	evaluation.now = time.Now().UTC()
+
+	// Each scrape evaluates the query: sinks would be written at each of them
+	for _, instruction := range statements {
+		if instruction.GetStoreSink() != nil {
+			proxyTsl.WarnCounter.Inc()
+			return ctx.JSON(http.StatusBadRequest, tsl.NewError(errors.New("a store to a sink can't be federated")))
+		}
+		if instruction.IsMeta() {
+			proxyTsl.WarnCounter.Inc()
+			return ctx.JSON(http.StatusBadRequest, tsl.NewError(errors.New("a meta-data statement can't be federated")))
+		}
+	}
+
+	// Keep the last point of each series, a series returned by several statements is exposed once
+	last := []WarpSeries{}
+	exposed := map[string]bool{}
+	for _, instruction := range statements {
+		series, err := evaluation.evaluate(instruction)
+		if err != nil {
+			proxyTsl.WarnCounter.Inc()
+			return ctx.JSON(http.StatusInternalServerError, tsl.NewError(err))
+		}
+
+		for _, gts := range series {
+			key := gts.Class + matchingKey(gts.Labels)
+			point := lastPoint(gts)
+			if point == nil || exposed[key] {
+				continue
+			}
+			exposed[key] = true
+
+			gts.Values = [][]interface{}{point}
+			last = append(last, gts)
+		}
+	}
+
+	openMetrics := strings.Contains(ctx.Request().Header.Get(echo.HeaderAccept), "application/openmetrics-text")
+
+	var buffer bytes.Buffer
+	if err := formatMetricsText(&buffer, last, evaluation.ticksPerSecond, openMetrics); err != nil {
+		proxyTsl.WarnCounter.Inc()
+		return ctx.JSON(http.StatusInternalServerError, tsl.NewError(err))
+	}
+
+	response := ctx.Response()
+	if openMetrics {
+		response.Header().Set(echo.HeaderContentType, openMetricsContentType)
+	} else {
+		response.Header().Set(echo.HeaderContentType, prometheusTextContentType)
+	}
+	response.WriteHeader(http.StatusOK)
+	_, err = response.Write(buffer.Bytes())
+	return err
+}
+
+// Get the point of a series with the highest tick, nil for a series without points
+func lastPoint(gts WarpSeries) []interface{} {
+	var last []interface{}
+	var lastTick int64
+	for _, point := range gts.Values {
+		if len(point) < 2 {
+			continue
+		}
+		tick, isTick := point[0].(int64)
+		if !isTick {
+			continue
+		}
+		if last == nil || tick > lastTick {
+			last, lastTick = point, tick
+		}
+	}
+	return last
+}
@@ -0,0 +1,401 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/ovh/tsl/tsl"
+)
+
+// Grafana query types, a variable query returns the values of a template variable
+const grafanaVariableQuery = "variable"
+
+// grafanaRequest is a Grafana data source query request, holding the dashboard time range and its panel queries
+type grafanaRequest struct {
+	Range   grafanaRange   `json:"range"`
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	Queries []grafanaQuery `json:"queries"`
+}
+
+// grafanaRange is a Grafana time range, as RFC3339 dates
+type grafanaRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// grafanaQuery is a Grafana panel query: a TSL query and the panel resolution
+type grafanaQuery struct {
+	RefID         string        `json:"refId"`
+	QueryType     string        `json:"queryType"`
+	Query         string        `json:"query"`
+	IntervalMs    int64         `json:"intervalMs"`
+	MaxDataPoints int64         `json:"maxDataPoints"`
+	TimeRange     *grafanaRange `json:"timeRange"`
+}
+
+// grafanaResponse holds the data frames or the error of each query, per query reference
+type grafanaResponse struct {
+	Results map[string]grafanaResult `json:"results"`
+}
+
+type grafanaResult struct {
+	Frames []grafanaFrame `json:"frames,omitempty"`
+	Error  string         `json:"error,omitempty"`
+	Status int            `json:"status,omitempty"`
+}
+
+// grafanaFrame is a Grafana data frame in its JSON wire format, columns values being in the fields order
+type grafanaFrame struct {
+	Schema grafanaSchema `json:"schema"`
+	Data   grafanaData   `json:"data"`
+}
+
+type grafanaSchema struct {
+	Name   string            `json:"name,omitempty"`
+	RefID  string            `json:"refId"`
+	Meta   *grafanaFrameMeta `json:"meta,omitempty"`
+	Fields []grafanaField    `json:"fields"`
+}
+
+type grafanaFrameMeta struct {
+	Type        string `json:"type"`
+	TypeVersion []int  `json:"typeVersion"`
+}
+
+type grafanaField struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	TypeInfo grafanaTypeInfo   `json:"typeInfo"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+type grafanaTypeInfo struct {
+	Frame    string `json:"frame"`
+	Nullable bool   `json:"nullable,omitempty"`
+}
+
+type grafanaData struct {
+	Values [][]interface{} `json:"values"`
+}
+
+// GrafanaQuery is the API call method evaluating Grafana panel queries, returning a data frame per series
+// The dashboard range and the panel resolution are applied as query range and samplers count
+func (proxyTsl ProxyTSL) GrafanaQuery(ctx echo.Context) error {
+
+	proxyTsl.ReqCounter.Inc()
+
+	request := grafanaRequest{}
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&request); err != nil {
+		proxyTsl.WarnCounter.Inc()
+		return ctx.JSON(http.StatusBadRequest, tsl.NewError(fmt.Errorf("expects a Grafana query request: %s", err.Error())))
+	}
+
+	response := grafanaResponse{Results: make(map[string]grafanaResult)}
+	for _, query := range request.Queries {
+		if query.isEmpty() {
+			response.Results[query.RefID] = grafanaResult{Frames: []grafanaFrame{}}
+			continue
+		}
+
+		frames, err := query.evaluate(ctx, request.timeRange())
+		if err != nil {
+			proxyTsl.WarnCounter.Inc()
+			response.Results[query.RefID] = grafanaResult{Error: err.Error(), Status: queryErrorStatus(err)}
+			continue
+		}
+		response.Results[query.RefID] = grafanaResult{Frames: frames}
+	}
+
+	return ctx.JSON(http.StatusOK, response)
+}
+
+// Get the request dashboard range, Grafana sending it as RFC3339 dates or as epoch milliseconds
+func (request grafanaRequest) timeRange() grafanaRange {
+	if request.Range.From != "" {
+		return request.Range
+	}
+	return grafanaRange{From: request.From, To: request.To}
+}
+
+// Convert a range into a TSL query range
+func (timeRange grafanaRange) queryRange() (string, time.Duration, error) {
+	if timeRange.From == "" {
+		return "", 0, nil
+	}
+
+	from, err := grafanaTime(timeRange.From)
+	if err != nil {
+		return "", 0, err
+	}
+	to := time.Now().UTC()
+	if timeRange.To != "" {
+		to, err = grafanaTime(timeRange.To)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	if !to.After(from) {
+		return "", 0, fmt.Errorf("range from %s is not before its end %s", timeRange.From, timeRange.To)
+	}
+	return from.Format(time.RFC3339Nano) + "," + to.Format(time.RFC3339Nano), to.Sub(from), nil
+}
+
+// Parse a Grafana date, as RFC3339 or epoch milliseconds
+func grafanaTime(date string) (time.Time, error) {
+	if milliseconds, err := strconv.ParseInt(date, 10, 64); err == nil {
+		return time.Unix(0, milliseconds*int64(time.Millisecond)).UTC(), nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339Nano, date)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unvalid range date %q, expects a RFC3339 date or epoch milliseconds", date)
+	}
+	return parsed.UTC(), nil
+}
+
+// Evaluate a Grafana query within a range
+func (query grafanaQuery) evaluate(ctx echo.Context, timeRange grafanaRange) ([]grafanaFrame, error) {
+	if query.TimeRange != nil {
+		timeRange = *query.TimeRange
+	}
+
+	queryRange, span, err := timeRange.queryRange()
+	if err != nil {
+		return nil, err
+	}
+
+	// Sample the range in as many points as the panel displays, without going under its interval
+	params := headerParams(ctx)
+	if queryRange != "" {
+		params[queryRandeHeader] = queryRange
+	}
+	samplersCount := query.MaxDataPoints
+	if query.IntervalMs > 0 && span > 0 {
+		intervals := int64(span / (time.Duration(query.IntervalMs) * time.Millisecond))
+		if samplersCount <= 0 || intervals < samplersCount {
+			samplersCount = intervals
+		}
+	}
+	if samplersCount > 0 {
+		params[samplersCountHeader] = strconv.FormatInt(samplersCount, 10)
+	}
+
+	evaluation, statements, err := prepareQuery(ctx, query.Query, params)
+	if err != nil {
+		return nil, err
+	}
+	evaluation.now = time.Now().UTC()
+
+	if query.QueryType == grafanaVariableQuery {
+		values, err := evaluation.variableValues(statements)
+		if err != nil {
+			return nil, err
+		}
+		return []grafanaFrame{variableFrame(query.RefID, values)}, nil
+	}
+
+	frames := []grafanaFrame{}
+	for _, instruction := range statements {
+		if instruction.IsMeta() {
+			return nil, errors.New("a meta-data statement can only be used as a variable query")
+		}
+
+		series, err := evaluation.evaluate(instruction)
+		if err != nil {
+			return nil, err
+		}
+		for _, gts := range series {
+			frames = append(frames, seriesFrame(query.RefID, gts, evaluation.ticksPerSecond))
+		}
+	}
+	return frames, nil
+}
+
+// Get the values of a template variable: the values of the meta-data statements and the names of the series statements
+func (query *crossQuery) variableValues(statements []tsl.Instruction) ([]string, error) {
+	values := []string{}
+	for _, instruction := range statements {
+		if instruction.IsMeta() {
+			metas, err := query.executeMeta(instruction)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, metas...)
+			continue
+		}
+
+		series, err := query.evaluate(instruction)
+		if err != nil {
+			return nil, err
+		}
+		for _, gts := range series {
+			values = append(values, gts.Class)
+		}
+	}
+
+	unique := []string{}
+	for _, value := range values {
+		if !contains(unique, value) {
+			unique = append(unique, value)
+		}
+	}
+	sort.Strings(unique)
+	return unique, nil
+}
+
+// Execute a meta-data statement, only Warp 10 back-ends find meta-data
+func (query *crossQuery) executeMeta(instruction tsl.Instruction) ([]string, error) {
+	api := instruction.GetConnectAPI()
+
+	backend := getBackendType(instruction)
+	if backend != tsl.WARP.String() {
+		return nil, fmt.Errorf("meta-data statements are not supported on the %s backend", backend)
+	}
+	if !isExecutableEndpoint(backend, api) {
+		return nil, fmt.Errorf("Warp 10 endpoint %q is not configured", api)
+	}
+
+	protoParser := warpParser("warp 10", query.lineStart)
+	warpscript, err := protoParser.GenerateWarpScript([]tsl.Instruction{instruction}, query.allowAuthenticate)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := exec(&Request{Body: warpscript}, api, query.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stack := [][]interface{}{}
+	if err := json.Unmarshal([]byte(res), &stack); err != nil {
+		return nil, fmt.Errorf("expects a meta-data list as Warp 10 result: %s", err.Error())
+	}
+	if len(stack) == 0 {
+		return []string{}, nil
+	}
+
+	values := make([]string, len(stack[0]))
+	for index, meta := range stack[0] {
+		switch value := meta.(type) {
+		case string:
+			values[index] = value
+		case map[string]interface{}:
+			labels := make(map[string]string, len(value))
+			for key, label := range value {
+				labels[key] = fmt.Sprint(label)
+			}
+			values[index] = csvLabels(labels)
+		default:
+			values[index] = fmt.Sprint(value)
+		}
+	}
+	return values, nil
+}
+
+// Build the data frame of a series: a time field and a value field with the series labels
+// The value field holds a single type: string when a value is a string, number when a value is numeric, boolean otherwise
+func seriesFrame(refID string, gts WarpSeries, ticksPerSecond int64) grafanaFrame {
+	points := [][]interface{}{}
+	hasString, hasNumber := false, false
+	for _, point := range gts.Values {
+		if len(point) < 2 {
+			continue
+		}
+		if _, isTick := point[0].(int64); !isTick {
+			continue
+		}
+		points = append(points, point)
+
+		switch point[len(point)-1].(type) {
+		case string:
+			hasString = true
+		case bool:
+		default:
+			hasNumber = true
+		}
+	}
+
+	valueType, frameType := "boolean", "bool"
+	if hasString {
+		valueType, frameType = "string", "string"
+	} else if hasNumber || len(points) == 0 {
+		valueType, frameType = "number", "float64"
+	}
+
+	times := make([]interface{}, len(points))
+	values := make([]interface{}, len(points))
+	for index, point := range points {
+		times[index] = tickTime(point[0].(int64), ticksPerSecond).UnixNano() / int64(time.Millisecond)
+		values[index] = frameValue(point[len(point)-1], valueType)
+	}
+
+	return grafanaFrame{
+		Schema: grafanaSchema{
+			Name:  gts.Class,
+			RefID: refID,
+			Meta:  &grafanaFrameMeta{Type: "timeseries-multi", TypeVersion: []int{0, 1}},
+			Fields: []grafanaField{
+				{Name: "Time", Type: "time", TypeInfo: grafanaTypeInfo{Frame: "time.Time"}},
+				{Name: "Value", Type: valueType, TypeInfo: grafanaTypeInfo{Frame: frameType, Nullable: true}, Labels: gts.Labels},
+			},
+		},
+		Data: grafanaData{Values: [][]interface{}{times, values}},
+	}
+}
+
+// Convert a series value to a frame field type, nil when it has no value of this type
+func frameValue(value interface{}, valueType string) interface{} {
+	switch valueType {
+	case "string":
+		if text, isString := value.(string); isString {
+			return text
+		}
+		if boolean, isBool := value.(bool); isBool {
+			return strconv.FormatBool(boolean)
+		}
+		number, err := toFloat(value)
+		if err != nil {
+			return nil
+		}
+		return strconv.FormatFloat(number, 'g', -1, 64)
+
+	case "boolean":
+		return value
+	}
+
+	number, err := toFloat(value)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return nil
+	}
+	return number
+}
+
+// Build the data frame of a template variable values, as a single text field
+func variableFrame(refID string, values []string) grafanaFrame {
+	texts := make([]interface{}, len(values))
+	for index, value := range values {
+		texts[index] = value
+	}
+
+	return grafanaFrame{
+		Schema: grafanaSchema{
+			RefID:  refID,
+			Fields: []grafanaField{{Name: "text", Type: "string", TypeInfo: grafanaTypeInfo{Frame: "string"}}},
+		},
+		Data: grafanaData{Values: [][]interface{}{texts}},
+	}
+}
+
+// Check a query holds some TSL
+func (query grafanaQuery) isEmpty() bool {
+	return strings.TrimSpace(query.Query) == ""
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSeriesFrameFieldType(t *testing.T) {
+	tests := []struct {
+		values    []interface{}
+		valueType string
+		expected  []interface{}
+	}{
+		{[]interface{}{1.5, json.Number("2"), math.NaN()}, "number", []interface{}{1.5, 2.0, nil}},
+		{[]interface{}{true, false}, "boolean", []interface{}{true, false}},
+		{[]interface{}{1.5, true, false}, "number", []interface{}{1.5, 1.0, 0.0}},
+		{[]interface{}{"up", 1.5, true}, "string", []interface{}{"up", "1.5", "true"}},
+		{[]interface{}{true, "down"}, "string", []interface{}{"true", "down"}},
+		{[]interface{}{}, "number", []interface{}{}},
+	}
+
+	for _, test := range tests {
+		gts := WarpSeries{Class: "cpu", Labels: map[string]string{}}
+		for index, value := range test.values {
+			gts.Values = append(gts.Values, []interface{}{int64(index) * 1000000, value})
+		}
+
+		frame := seriesFrame("A", gts, 1000000)
+		field := frame.Schema.Fields[1]
+		if field.Type != test.valueType {
+			t.Errorf("%v: expected a %s field, got %s", test.values, test.valueType, field.Type)
+		}
+		if values := frame.Data.Values[1]; !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("%v: expected the %s values %v, got %v", test.values, test.valueType, test.expected, values)
+		}
+	}
+}
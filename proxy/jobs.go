@@ -0,0 +1,402 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/ovh/tsl/middlewares"
+	"github.com/ovh/tsl/tsl"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Jobs statuses
+const (
+	jobQueued   = "queued"
+	jobRunning  = "running"
+	jobDone     = "done"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+)
+
+// Job is an asynchronous TSL query, its result is kept until the jobs TTL after its end
+type Job struct {
+	ID        string      `json:"id"`
+	Status    string      `json:"status"`
+	Submitted time.Time   `json:"submitted"`
+	Started   *time.Time  `json:"started,omitempty"`
+	Finished  *time.Time  `json:"finished,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Progress  JobProgress `json:"progress"`
+
+	owner      string
+	statements []tsl.Instruction
+	evaluation *crossQuery
+	cancel     context.CancelFunc
+	result     []WarpSeries
+	updated    chan struct{}
+}
+
+// JobProgress counts the statements evaluated by a job, and the series and points they returned
+type JobProgress struct {
+	Statements int `json:"statements"`
+	Done       int `json:"done"`
+	Series     int `json:"series"`
+	Points     int `json:"points"`
+}
+
+// JobQueue executes the submitted jobs with a bounded queue and a fixed number of workers
+type JobQueue struct {
+	mutex     sync.Mutex
+	jobs      map[string]*Job
+	queue     chan *Job
+	ttl       time.Duration
+	maxPoints int
+	depth     prometheus.Gauge
+	running   prometheus.Gauge
+	finished  *prometheus.CounterVec
+}
+
+// NewJobQueue is creating a job queue and starting its workers
+func NewJobQueue(promRegistry *prometheus.Registry) *JobQueue {
+	queueSize := viper.GetInt("tsl.jobs.queueSize")
+	if queueSize <= 0 {
+		queueSize = 100
+	}
+	workers := viper.GetInt("tsl.jobs.workers")
+	if workers <= 0 {
+		workers = 2
+	}
+	ttl := viper.GetDuration("tsl.jobs.ttl")
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+
+	jobs := &JobQueue{
+		jobs:      make(map[string]*Job),
+		queue:     make(chan *Job, queueSize),
+		ttl:       ttl,
+		maxPoints: viper.GetInt("tsl.jobs.maxPoints"),
+	}
+
+	// metrics
+	jobs.depth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "tsl",
+		Subsystem: "jobs",
+		Name:      "queue_depth",
+		Help:      "Number of jobs waiting in the queue.",
+	})
+	promRegistry.MustRegister(jobs.depth)
+	jobs.running = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "tsl",
+		Subsystem: "jobs",
+		Name:      "running",
+		Help:      "Number of jobs running.",
+	})
+	promRegistry.MustRegister(jobs.running)
+	jobs.finished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tsl",
+		Subsystem: "jobs",
+		Name:      "finished",
+		Help:      "Number of jobs finished per status.",
+	}, []string{"status"})
+	promRegistry.MustRegister(jobs.finished)
+
+	for worker := 0; worker < workers; worker++ {
+		go jobs.work()
+	}
+	go jobs.cleanup()
+
+	return jobs
+}
+
+// Submit is the API call method queuing a TSL query job
+func (jobs *JobQueue) Submit(ctx echo.Context) error {
+	body, err := ioutil.ReadAll(ctx.Request().Body)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, tsl.NewError(err))
+	}
+
+	// The job request lives after the HTTP request: it keeps the parsed statements with their tokens
+	evaluation, statements, err := prepareQuery(ctx, string(body), headerParams(ctx))
+	if err != nil {
+		return ctx.JSON(queryErrorStatus(err), tsl.NewError(err))
+	}
+
+	// Its back-end requests are interrupted when the job is canceled
+	jobCtx, cancel := context.WithCancel(context.Background())
+	request, err := http.NewRequest(http.MethodPost, "/v0/jobs", http.NoBody)
+	if err != nil {
+		cancel()
+		return ctx.JSON(http.StatusInternalServerError, tsl.NewError(err))
+	}
+	evaluation.ctx = echo.New().NewContext(request.WithContext(jobCtx), nil)
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		cancel()
+		return ctx.JSON(http.StatusInternalServerError, tsl.NewError(err))
+	}
+
+	job := &Job{
+		ID:         hex.EncodeToString(id),
+		Status:     jobQueued,
+		Submitted:  time.Now().UTC(),
+		Progress:   JobProgress{Statements: len(statements)},
+		owner:      middlewares.ClientKey(ctx),
+		statements: statements,
+		evaluation: evaluation,
+		cancel:     cancel,
+		updated:    make(chan struct{}),
+	}
+
+	jobs.mutex.Lock()
+	select {
+	case jobs.queue <- job:
+		jobs.jobs[job.ID] = job
+		jobs.depth.Inc()
+	default:
+		jobs.mutex.Unlock()
+		cancel()
+		ctx.Response().Header().Set("Retry-After", "60")
+		return ctx.JSON(http.StatusServiceUnavailable, tsl.NewError(errors.New("the jobs queue is full")))
+	}
+	snapshot := *job
+	jobs.mutex.Unlock()
+
+	return ctx.JSON(http.StatusAccepted, snapshot)
+}
+
+// Status is the API call method returning a job status and progress
+func (jobs *JobQueue) Status(ctx echo.Context) error {
+	job, err := jobs.get(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, tsl.NewError(err))
+	}
+
+	jobs.mutex.Lock()
+	snapshot := *job
+	jobs.mutex.Unlock()
+
+	return ctx.JSON(http.StatusOK, snapshot)
+}
+
+// Progress is the API call method pushing a job status as Server-Sent Events at each update, until its end
+func (jobs *JobQueue) Progress(ctx echo.Context) error {
+	job, err := jobs.get(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, tsl.NewError(err))
+	}
+
+	response := ctx.Response()
+	response.Header().Set(echo.HeaderContentType, "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Header().Set("X-Accel-Buffering", "no")
+	response.WriteHeader(http.StatusOK)
+
+	for {
+		jobs.mutex.Lock()
+		snapshot := *job
+		updated := job.updated
+		jobs.mutex.Unlock()
+
+		payload, err := json.Marshal(snapshot)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(response, "event: progress\ndata: %s\n\n", payload); err != nil {
+			return nil
+		}
+		response.Flush()
+
+		if snapshot.Finished != nil {
+			return nil
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Request().Context().Done():
+			return nil
+		}
+	}
+}
+
+// Cancel is the API call method canceling a job, interrupting the back-end requests of a running job
+// A finished job is removed with its result
+func (jobs *JobQueue) Cancel(ctx echo.Context) error {
+	job, err := jobs.get(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, tsl.NewError(err))
+	}
+
+	jobs.mutex.Lock()
+	if job.Finished == nil {
+		if job.Status == jobQueued {
+			jobs.depth.Dec()
+		}
+		jobs.finish(job, jobCanceled, "")
+	} else {
+		delete(jobs.jobs, job.ID)
+	}
+	snapshot := *job
+	jobs.mutex.Unlock()
+
+	return ctx.JSON(http.StatusOK, snapshot)
+}
+
+// Result is the API call method returning a done job result, as a series JSON list or in an output format
+func (jobs *JobQueue) Result(ctx echo.Context) error {
+	job, err := jobs.get(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, tsl.NewError(err))
+	}
+
+	jobs.mutex.Lock()
+	status, result := job.Status, job.result
+	jobs.mutex.Unlock()
+
+	if status != jobDone {
+		return ctx.JSON(http.StatusConflict, tsl.NewError(fmt.Errorf("job %s is %s", job.ID, status)))
+	}
+
+	format, err := seriesFormat(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, tsl.NewError(err))
+	}
+	if format == "" {
+		format = jsonFormat
+	}
+
+	if format == csvFormat || format == wideCSVFormat {
+		ctx.Response().Header().Set("Content-Disposition", "attachment; filename="+job.ID+".csv")
+	}
+	return writeSeries(ctx, format, result, job.evaluation.ticksPerSecond)
+}
+
+// Get the job of a request, only visible by the client who submitted it
+func (jobs *JobQueue) get(ctx echo.Context) (*Job, error) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	job, ok := jobs.jobs[ctx.Param("id")]
+	if !ok || job.owner != middlewares.ClientKey(ctx) {
+		return nil, fmt.Errorf("job %q not found", ctx.Param("id"))
+	}
+	return job, nil
+}
+
+// Execute the queued jobs
+func (jobs *JobQueue) work() {
+	for job := range jobs.queue {
+		jobs.mutex.Lock()
+		if job.Finished != nil {
+			jobs.mutex.Unlock()
+			continue
+		}
+		jobs.depth.Dec()
+		jobs.running.Inc()
+		started := time.Now().UTC()
+		job.Started = &started
+		job.Status = jobRunning
+		job.notify()
+		statements := job.statements
+		jobs.mutex.Unlock()
+
+		jobs.run(job, statements)
+
+		jobs.mutex.Lock()
+		jobs.running.Dec()
+		jobs.mutex.Unlock()
+	}
+}
+
+// Evaluate a job statements one by one, checking its cancellation and its points count between each of them
+func (jobs *JobQueue) run(job *Job, statements []tsl.Instruction) {
+	job.evaluation.now = time.Now().UTC()
+
+	result := []WarpSeries{}
+	for _, instruction := range statements {
+		series, err := job.evaluation.evaluate(instruction)
+
+		jobs.mutex.Lock()
+		if job.Finished != nil {
+			jobs.mutex.Unlock()
+			return
+		}
+		if err != nil {
+			jobs.finish(job, jobFailed, err.Error())
+			jobs.mutex.Unlock()
+			return
+		}
+
+		result = append(result, series...)
+		job.Progress.Done++
+		job.Progress.Series += len(series)
+		for _, gts := range series {
+			job.Progress.Points += len(gts.Values)
+		}
+		if jobs.maxPoints > 0 && job.Progress.Points > jobs.maxPoints {
+			jobs.finish(job, jobFailed, fmt.Sprintf("%d points exceeds the job maximum of %d", job.Progress.Points, jobs.maxPoints))
+			jobs.mutex.Unlock()
+			return
+		}
+		job.notify()
+		jobs.mutex.Unlock()
+	}
+
+	jobs.mutex.Lock()
+	if job.Finished == nil {
+		job.result = result
+		jobs.finish(job, jobDone, "")
+	}
+	jobs.mutex.Unlock()
+}
+
+// End a job with a status, must be called with the queue lock
+func (jobs *JobQueue) finish(job *Job, status string, message string) {
+	finished := time.Now().UTC()
+	job.Finished = &finished
+	job.Status = status
+	job.Error = message
+	job.statements = nil
+	job.cancel()
+	jobs.finished.With(prometheus.Labels{"status": status}).Inc()
+	job.notify()
+
+	log.WithFields(log.Fields{
+		"job":    job.ID,
+		"status": status,
+	}).Debug("Job finished")
+}
+
+// Wake up the job progress watchers, must be called with the queue lock
+func (job *Job) notify() {
+	close(job.updated)
+	job.updated = make(chan struct{})
+}
+
+// Remove the jobs finished for longer than the TTL
+func (jobs *JobQueue) cleanup() {
+	ticker := time.NewTicker(jobs.ttl / 10)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		jobs.mutex.Lock()
+		for id, job := range jobs.jobs {
+			if job.Finished != nil && now.Sub(*job.Finished) > jobs.ttl {
+				delete(jobs.jobs, id)
+			}
+		}
+		jobs.mutex.Unlock()
+	}
+}
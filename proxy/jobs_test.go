@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/ovh/tsl/tsl"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// Submit a query job, returns its id
+func submitJob(t *testing.T, jobs *JobQueue, query string) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v0/jobs", strings.NewReader(query))
+	if err := jobs.Submit(echo.New().NewContext(req, rec)); err != nil || rec.Code != http.StatusAccepted {
+		t.Fatalf("unexpected submit response %d %s: %v", rec.Code, rec.Body.String(), err)
+	}
+
+	job := Job{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return job.ID
+}
+
+// Wait for the end of a job, returns its final state
+func waitJob(t *testing.T, jobs *JobQueue, id string) Job {
+	t.Helper()
+
+	for timeout := time.After(5 * time.Second); ; {
+		jobs.mutex.Lock()
+		job := *jobs.jobs[id]
+		jobs.mutex.Unlock()
+		if job.Finished != nil {
+			return job
+		}
+
+		select {
+		case <-timeout:
+			t.Fatalf("job %s didn't finish", id)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestJobCancelInterruptsBackendRequests(t *testing.T) {
+	defer viper.Reset()
+
+	started, interrupted := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server watches the connection close once the request body is read
+		ioutil.ReadAll(r.Body)
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(interrupted)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	viper.Set("tsl.default.type", tsl.WARP.String())
+	viper.Set("tsl.default.endpoint", server.URL)
+	viper.Set("tsl.warp10.endpoints", []string{server.URL})
+	jobs := NewJobQueue(prometheus.NewRegistry())
+
+	id := submitJob(t, jobs, `select("cpu").last(1h)`)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the job to query its back-end")
+	}
+
+	rec := httptest.NewRecorder()
+	ctx := echo.New().NewContext(httptest.NewRequest(http.MethodDelete, "/v0/jobs/"+id, nil), rec)
+	ctx.SetParamNames("id")
+	ctx.SetParamValues(id)
+	if err := jobs.Cancel(ctx); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("unexpected cancel response %d %s: %v", rec.Code, rec.Body.String(), err)
+	}
+
+	select {
+	case <-interrupted:
+	case <-time.After(time.Second):
+		t.Fatal("expected the back-end request to be interrupted by the cancellation")
+	}
+	if job := waitJob(t, jobs, id); job.Status != jobCanceled {
+		t.Errorf("expected a canceled job, got %s", job.Status)
+	}
+}
+
+func TestJobMaxPoints(t *testing.T) {
+	defer viper.Reset()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[[{"c":"cpu","l":{},"a":{},"v":[[1,1],[2,2],[3,3]]}]]`))
+	}))
+	defer server.Close()
+
+	viper.Set("tsl.default.type", tsl.WARP.String())
+	viper.Set("tsl.default.endpoint", server.URL)
+	viper.Set("tsl.warp10.endpoints", []string{server.URL})
+	viper.Set("tsl.jobs.maxPoints", 2)
+	jobs := NewJobQueue(prometheus.NewRegistry())
+
+	job := waitJob(t, jobs, submitJob(t, jobs, `select("cpu").last(1h)`))
+	if job.Status != jobFailed || !strings.Contains(job.Error, "maximum of 2") {
+		t.Errorf("expected the job to fail above its maximum points, got %s %q", job.Status, job.Error)
+	}
+}
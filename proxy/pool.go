@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ovh/tsl/tsl"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	poolPrefix             = "pool:"
+	roundRobinStrategy     = "round-robin"
+	leastLatencyStrategy   = "least-latency"
+	defaultPoolRetries     = 1
+	defaultBreakerFailures = 5
+	defaultBreakerTimeout  = 30 * time.Second
+	healthCheckTimeout     = 5 * time.Second
+)
+
+// Backend pools loaded from the configuration, per name
+var pools = map[string]*Pool{}
+
+// Pool is a named set of replicated back-end endpoints
+type Pool struct {
+	next            uint64 // First field to be 64-bit aligned for atomic operations
+	Name            string
+	Type            string
+	strategy        string
+	retries         int
+	breakerFailures int
+	breakerTimeout  time.Duration
+	timeUnit        string
+	endpoints       []*poolEndpoint
+}
+
+// poolEndpoint is a pool endpoint with its health and circuit breaker state
+type poolEndpoint struct {
+	url       string
+	mutex     sync.Mutex
+	healthy   bool
+	failures  int
+	openUntil time.Time
+	latency   time.Duration
+}
+
+// connectionError is an error raised when a back-end can't be reached
+type connectionError struct {
+	err error
+}
+
+func (e *connectionError) Error() string {
+	return e.err.Error()
+}
+
+// LoadPools load the back-end pools of the configuration and start their health checks
+func LoadPools() error {
+	loaded := map[string]*Pool{}
+
+	for name := range viper.GetStringMap("tsl.pools") {
+		key := "tsl.pools." + name
+
+		pool := &Pool{
+			Name:            name,
+			Type:            viper.GetString(key + ".type"),
+			strategy:        roundRobinStrategy,
+			retries:         defaultPoolRetries,
+			breakerFailures: defaultBreakerFailures,
+			breakerTimeout:  defaultBreakerTimeout,
+		}
+
+		switch pool.Type {
+		case tsl.WARP.String():
+		case tsl.PROMETHEUS.String(), tsl.PROM.String():
+			pool.Type = tsl.PROMETHEUS.String()
+		default:
+			return fmt.Errorf("pool %q expects a warp10 or a prometheus type, got %q", name, pool.Type)
+		}
+
+		if viper.IsSet(key + ".strategy") {
+			pool.strategy = viper.GetString(key + ".strategy")
+		}
+		if pool.strategy != roundRobinStrategy && pool.strategy != leastLatencyStrategy {
+			return fmt.Errorf("pool %q expects a %s or a %s strategy, got %q", name, roundRobinStrategy, leastLatencyStrategy, pool.strategy)
+		}
+
+		if viper.IsSet(key + ".retries") {
+			pool.retries = viper.GetInt(key + ".retries")
+		}
+		if viper.IsSet(key + ".breaker.failures") {
+			pool.breakerFailures = viper.GetInt(key + ".breaker.failures")
+		}
+		if viper.IsSet(key + ".breaker.timeout") {
+			pool.breakerTimeout = viper.GetDuration(key + ".breaker.timeout")
+		}
+		if viper.IsSet(key + ".timeunit") {
+			pool.timeUnit = viper.GetString(key + ".timeunit")
+			if _, err := tsl.TimeUnitTicks(pool.timeUnit); err != nil {
+				return fmt.Errorf("pool %q: %s", name, err.Error())
+			}
+		}
+
+		for _, url := range viper.GetStringSlice(key + ".endpoints") {
+			pool.endpoints = append(pool.endpoints, &poolEndpoint{url: url, healthy: true})
+		}
+		if len(pool.endpoints) == 0 {
+			return fmt.Errorf("pool %q expects at least one endpoint", name)
+		}
+
+		if interval := viper.GetDuration(key + ".healthcheck"); interval > 0 {
+			go pool.healthCheck(interval)
+		}
+
+		loaded[name] = pool
+	}
+
+	pools = loaded
+	return nil
+}
+
+// Get the pool of a connect API when it uses the pool prefix
+func getPool(api string) (*Pool, bool) {
+	if !strings.HasPrefix(api, poolPrefix) {
+		return nil, false
+	}
+	pool, ok := pools[strings.TrimPrefix(api, poolPrefix)]
+	return pool, ok
+}
+
+// Get all configured endpoints and pools addresses of a back-end type
+func configuredEndpoints(backendType string) []string {
+	var endpoints []string
+	if backendType == tsl.WARP.String() {
+		for _, endpoint := range configuredWarpEndpoints() {
+			endpoints = append(endpoints, endpoint.url)
+		}
+	} else {
+		endpoints = viper.GetStringSlice("tsl.promql.endpoints")
+	}
+
+	names := []string{}
+	for name, pool := range pools {
+		if pool.Type == backendType {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		endpoints = append(endpoints, poolPrefix+name)
+	}
+	return endpoints
+}
+
+// Execute a request on the pool endpoints, retrying on another endpoint when one can't be reached
+func (pool *Pool) do(request func(url string) (string, error)) (string, error) {
+	candidates := pool.candidates()
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no available endpoint in pool %q", pool.Name)
+	}
+
+	var err error
+	for attempt, endpoint := range candidates {
+		if attempt > pool.retries {
+			break
+		}
+
+		start := time.Now()
+		var res string
+		res, err = request(endpoint.url)
+
+		if _, isConnectionError := err.(*connectionError); isConnectionError {
+			log.WithError(err).WithField("pool", pool.Name).Warnf("Could not reach %s", endpoint.url)
+			endpoint.fail(pool.breakerFailures, pool.breakerTimeout)
+			continue
+		}
+
+		endpoint.succeed(time.Since(start))
+		return res, err
+	}
+	return "", err
+}
+
+// Get the available endpoints sorted by the pool strategy
+func (pool *Pool) candidates() []*poolEndpoint {
+	now := time.Now()
+
+	candidates := []*poolEndpoint{}
+	if pool.strategy == leastLatencyStrategy {
+		candidates = append(candidates, pool.endpoints...)
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].getLatency() < candidates[j].getLatency()
+		})
+	} else {
+		start := int(atomic.AddUint64(&pool.next, 1) % uint64(len(pool.endpoints)))
+		candidates = append(candidates, pool.endpoints[start:]...)
+		candidates = append(candidates, pool.endpoints[:start]...)
+	}
+
+	available := []*poolEndpoint{}
+	for _, endpoint := range candidates {
+		if endpoint.isAvailable(now) {
+			available = append(available, endpoint)
+		}
+	}
+	return available
+}
+
+// Check periodically the health of each pool endpoint
+func (pool *Pool) healthCheck(interval time.Duration) {
+	client := &http.Client{Timeout: healthCheckTimeout}
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		for _, endpoint := range pool.endpoints {
+			var res *http.Response
+			var err error
+			if pool.Type == tsl.WARP.String() {
+				res, err = client.Post(endpoint.url+"/api/v0/exec", "text/plain", strings.NewReader("NOW"))
+			} else {
+				res, err = client.Get(endpoint.url + "/-/healthy")
+			}
+
+			if err == nil {
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					err = errors.New(res.Status)
+				}
+			}
+
+			if err != nil {
+				log.WithError(err).WithField("pool", pool.Name).Warnf("Health check failed for %s", endpoint.url)
+			}
+			endpoint.setHealthy(err == nil)
+		}
+	}
+}
+
+// An endpoint is available when healthy and its circuit is closed or its open timeout is over
+func (endpoint *poolEndpoint) isAvailable(now time.Time) bool {
+	endpoint.mutex.Lock()
+	defer endpoint.mutex.Unlock()
+	return endpoint.healthy && !now.Before(endpoint.openUntil)
+}
+
+func (endpoint *poolEndpoint) setHealthy(healthy bool) {
+	endpoint.mutex.Lock()
+	defer endpoint.mutex.Unlock()
+	endpoint.healthy = healthy
+}
+
+func (endpoint *poolEndpoint) getLatency() time.Duration {
+	endpoint.mutex.Lock()
+	defer endpoint.mutex.Unlock()
+	return endpoint.latency
+}
+
+// Open the endpoint circuit once it reaches the failures threshold
+func (endpoint *poolEndpoint) fail(threshold int, timeout time.Duration) {
+	endpoint.mutex.Lock()
+	defer endpoint.mutex.Unlock()
+
+	endpoint.failures++
+	if endpoint.failures >= threshold {
+		endpoint.openUntil = time.Now().Add(timeout)
+	}
+}
+
+// Close the endpoint circuit and update its mean latency
+func (endpoint *poolEndpoint) succeed(latency time.Duration) {
+	endpoint.mutex.Lock()
+	defer endpoint.mutex.Unlock()
+
+	endpoint.failures = 0
+	endpoint.openUntil = time.Time{}
+	if endpoint.latency == 0 {
+		endpoint.latency = latency
+	} else {
+		endpoint.latency = (endpoint.latency*4 + latency) / 5
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Create a pool of endpoints, without health checks
+func newTestPool(strategy string, retries int, urls ...string) *Pool {
+	pool := &Pool{Name: "test", strategy: strategy, retries: retries, breakerFailures: 2, breakerTimeout: time.Hour}
+	for _, url := range urls {
+		pool.endpoints = append(pool.endpoints, &poolEndpoint{url: url, healthy: true})
+	}
+	return pool
+}
+
+// Execute a request on a pool, returns the endpoints tried in order
+func doPool(t *testing.T, pool *Pool, failures map[string]error) ([]string, error) {
+	t.Helper()
+
+	tried := []string{}
+	_, err := pool.do(func(url string) (string, error) {
+		tried = append(tried, url)
+		return url, failures[url]
+	})
+	return tried, err
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	pool := newTestPool(roundRobinStrategy, 1, "a", "b", "c")
+
+	first := []string{}
+	for i := 0; i < 6; i++ {
+		tried, err := doPool(t, pool, nil)
+		if err != nil || len(tried) != 1 {
+			t.Fatalf("expected a single successful attempt, got %v: %v", tried, err)
+		}
+		first = append(first, tried[0])
+	}
+
+	for i := 3; i < len(first); i++ {
+		if first[i] != first[i-3] {
+			t.Errorf("expected the requests to cycle on the endpoints, got %v", first)
+		}
+	}
+	if first[0] == first[1] || first[1] == first[2] || first[0] == first[2] {
+		t.Errorf("expected each endpoint to be used in turn, got %v", first)
+	}
+}
+
+func TestPoolLeastLatency(t *testing.T) {
+	pool := newTestPool(leastLatencyStrategy, 1, "a", "b", "c")
+	pool.endpoints[0].latency = 30 * time.Millisecond
+	pool.endpoints[1].latency = 10 * time.Millisecond
+	pool.endpoints[2].latency = 20 * time.Millisecond
+
+	for i := 0; i < 3; i++ {
+		tried, err := doPool(t, pool, nil)
+		if err != nil || len(tried) != 1 || tried[0] != "b" {
+			t.Fatalf("expected the fastest endpoint to be used, got %v: %v", tried, err)
+		}
+	}
+
+	// A failing endpoint is retried on the next fastest one
+	tried, err := doPool(t, pool, map[string]error{"b": &connectionError{err: errors.New("refused")}})
+	if err != nil || len(tried) != 2 || tried[1] != "c" {
+		t.Errorf("expected a retry on the next fastest endpoint, got %v: %v", tried, err)
+	}
+}
+
+func TestPoolRetries(t *testing.T) {
+	refused := &connectionError{err: errors.New("refused")}
+
+	// Connection errors are retried on other endpoints, up to the pool retries
+	pool := newTestPool(leastLatencyStrategy, 1, "a", "b", "c")
+	tried, err := doPool(t, pool, map[string]error{"a": refused, "b": refused})
+	if err != refused || len(tried) != 2 {
+		t.Errorf("expected a single retry, got %v: %v", tried, err)
+	}
+
+	pool = newTestPool(leastLatencyStrategy, 2, "a", "b", "c")
+	tried, err = doPool(t, pool, map[string]error{"a": refused, "b": refused})
+	if err != nil || len(tried) != 3 || tried[2] != "c" {
+		t.Errorf("expected two retries, got %v: %v", tried, err)
+	}
+
+	// Other errors are returned by the back-end itself and aren't retried
+	failed := errors.New("bad query")
+	pool = newTestPool(leastLatencyStrategy, 2, "a", "b", "c")
+	tried, err = doPool(t, pool, map[string]error{"a": failed})
+	if err != failed || len(tried) != 1 {
+		t.Errorf("expected no retry on a back-end error, got %v: %v", tried, err)
+	}
+	if pool.endpoints[0].failures != 0 {
+		t.Errorf("expected a back-end error not to count as a failure, got %d", pool.endpoints[0].failures)
+	}
+}
+
+func TestPoolBreaker(t *testing.T) {
+	refused := &connectionError{err: errors.New("refused")}
+
+	pool := newTestPool(leastLatencyStrategy, 0, "a", "b")
+	pool.breakerTimeout = 50 * time.Millisecond
+
+	// The circuit opens once the failures threshold is reached
+	for i := 0; i < pool.breakerFailures; i++ {
+		if _, err := doPool(t, pool, map[string]error{"a": refused}); err != refused {
+			t.Fatalf("expected a connection error, got %v", err)
+		}
+	}
+	tried, err := doPool(t, pool, map[string]error{"a": refused})
+	if err != nil || len(tried) != 1 || tried[0] != "b" {
+		t.Fatalf("expected the open endpoint to be skipped, got %v: %v", tried, err)
+	}
+
+	// Half-open after its timeout, a single failure opens it again
+	time.Sleep(pool.breakerTimeout)
+	tried, err = doPool(t, pool, map[string]error{"a": refused})
+	if err != refused || len(tried) != 1 || tried[0] != "a" {
+		t.Fatalf("expected a trial request on the half-open endpoint, got %v: %v", tried, err)
+	}
+	if tried, _ = doPool(t, pool, nil); tried[0] != "b" {
+		t.Fatalf("expected the endpoint to open again after a failed trial, got %v", tried)
+	}
+
+	// A successful trial closes it
+	time.Sleep(pool.breakerTimeout)
+	if tried, err = doPool(t, pool, nil); err != nil || tried[0] != "a" {
+		t.Fatalf("expected a successful trial request, got %v: %v", tried, err)
+	}
+	if pool.endpoints[0].failures != 0 || !pool.endpoints[0].isAvailable(time.Now()) {
+		t.Error("expected the circuit to be closed")
+	}
+
+	// Unhealthy or open endpoints leave no candidate
+	pool.endpoints[0].setHealthy(false)
+	pool.endpoints[1].setHealthy(false)
+	if _, err := doPool(t, pool, nil); err == nil {
+		t.Error("expected an error without available endpoint")
+	}
+}
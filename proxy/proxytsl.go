@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"github.com/ovh/tsl/middlewares"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -9,11 +10,13 @@ type ProxyTSL struct {
 	ReqCounter  prometheus.Counter
 	ErrCounter  prometheus.Counter
 	WarnCounter prometheus.Counter
+	StreamGauge prometheus.Gauge
+	streams     middlewares.LimitStore
 }
 
 // NewProxyTSL is creating a new tsl proxy query handler
 func NewProxyTSL(promRegistry *prometheus.Registry) *ProxyTSL {
-	proxyTsl := &ProxyTSL{}
+	proxyTsl := &ProxyTSL{streams: middlewares.NewMemoryStore()}
 
 	// metrics
 	proxyTsl.ReqCounter = prometheus.NewCounter(prometheus.CounterOpts{
@@ -37,6 +40,13 @@ func NewProxyTSL(promRegistry *prometheus.Registry) *ProxyTSL {
 		Help:      "Number of errored client requests.",
 	})
 	promRegistry.MustRegister(proxyTsl.WarnCounter)
+	proxyTsl.StreamGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "tsl",
+		Subsystem: "controller",
+		Name:      "streams",
+		Help:      "Number of open query streams.",
+	})
+	promRegistry.MustRegister(proxyTsl.StreamGauge)
 
 	return proxyTsl
 }
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/spf13/viper"
+)
+
+// Prometheus remote write messages, with the prompb protobuf definitions
+type promWriteRequest struct {
+	Timeseries []*promTimeSeries `protobuf:"bytes,1,rep,name=timeseries,proto3"`
+}
+
+type promTimeSeries struct {
+	Labels  []*promLabel  `protobuf:"bytes,1,rep,name=labels,proto3"`
+	Samples []*promSample `protobuf:"bytes,2,rep,name=samples,proto3"`
+}
+
+type promLabel struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+type promSample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"`
+}
+
+func (m *promWriteRequest) Reset()         { *m = promWriteRequest{} }
+func (m *promWriteRequest) String() string { return proto.CompactTextString(m) }
+func (*promWriteRequest) ProtoMessage()    {}
+
+func (m *promTimeSeries) Reset()         { *m = promTimeSeries{} }
+func (m *promTimeSeries) String() string { return proto.CompactTextString(m) }
+func (*promTimeSeries) ProtoMessage()    {}
+
+func (m *promLabel) Reset()         { *m = promLabel{} }
+func (m *promLabel) String() string { return proto.CompactTextString(m) }
+func (*promLabel) ProtoMessage()    {}
+
+func (m *promSample) Reset()         { *m = promSample{} }
+func (m *promSample) String() string { return proto.CompactTextString(m) }
+func (*promSample) ProtoMessage()    {}
+
+// RemoteWrite Send series to a Prometheus remote write endpoint, ticks are in platform time unit
+func RemoteWrite(url string, series []WarpSeries, ticksPerSecond int64) error {
+	return remoteWrite(backendClient(url), url, "", series, ticksPerSecond)
+}
+
+// Send series to a Prometheus remote write endpoint with a client, and a token sent as a Prometheus authorization
+func remoteWrite(client *http.Client, url string, token string, series []WarpSeries, ticksPerSecond int64) error {
+	request, err := proto.Marshal(writeRequest(series, ticksPerSecond))
+	if err != nil {
+		return err
+	}
+	body := snappy.Encode(nil, request)
+
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	setPrometheusAuthorization(httpReq, token)
+	httpReq.Header.Add("Content-Encoding", "snappy")
+	httpReq.Header.Add("Content-Type", "application/x-protobuf")
+	httpReq.Header.Add("X-Prometheus-Remote-Write-Version", "0.1.0")
+	httpReq.Header.Add("User-Agent", "tsl/"+viper.GetString("version")+" (Prometheus)")
+
+	res, err := client.Do(httpReq)
+	if err != nil {
+		return &connectionError{err: err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("remote write to %s failed with %s: %s", url, res.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// Convert series into a Prometheus remote write request, keeping only their numeric values
+func writeRequest(series []WarpSeries, ticksPerSecond int64) *promWriteRequest {
+	request := &promWriteRequest{Timeseries: make([]*promTimeSeries, 0, len(series))}
+
+	for _, gts := range series {
+		labels := map[string]string{"__name__": gts.Class}
+		for key, value := range gts.Labels {
+			labels[key] = value
+		}
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		timeSeries := &promTimeSeries{Labels: make([]*promLabel, 0, len(names))}
+		for _, name := range names {
+			timeSeries.Labels = append(timeSeries.Labels, &promLabel{Name: name, Value: labels[name]})
+		}
+
+		for _, point := range gts.Values {
+			if len(point) < 2 {
+				continue
+			}
+			tick, isTick := point[0].(int64)
+			value, err := toFloat(point[len(point)-1])
+			if !isTick || err != nil {
+				continue
+			}
+			timeSeries.Samples = append(timeSeries.Samples, &promSample{Value: value, Timestamp: ticksToMillis(tick, ticksPerSecond)})
+		}
+
+		request.Timeseries = append(request.Timeseries, timeSeries)
+	}
+
+	return request
+}
+
+// Convert platform ticks into milliseconds without overflowing nanoseconds ticks
+func ticksToMillis(tick int64, ticksPerSecond int64) int64 {
+	if ticksPerSecond >= 1000 {
+		return tick / (ticksPerSecond / 1000)
+	}
+	return tick * 1000 / ticksPerSecond
+}
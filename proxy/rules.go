@@ -0,0 +1,436 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/ovh/tsl/tsl"
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	defaultRulesInterval = time.Minute
+	alertNameLabel       = "alertname"
+)
+
+// RuleGroups is the content of a rules file
+type RuleGroups struct {
+	Groups []*RuleGroup `yaml:"groups"`
+}
+
+// RuleGroup is a set of rules evaluated in order at a same interval
+type RuleGroup struct {
+	Name     string  `yaml:"name"`
+	Interval string  `yaml:"interval"`
+	Rules    []*Rule `yaml:"rules"`
+	interval time.Duration
+}
+
+// Rule is a recording or an alerting rule on a TSL expression
+type Rule struct {
+	Record      string            `yaml:"record"`
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+	forDuration time.Duration
+	active      map[string]*activeAlert
+}
+
+// activeAlert is an alerting rule series, pending until it is active for the rule duration
+type activeAlert struct {
+	labels      map[string]string
+	annotations map[string]string
+	activeAt    time.Time
+	firing      bool
+}
+
+// Alert is an alert in the Alertmanager API format
+type Alert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+}
+
+// LoadRuleGroups load and check the rule groups of YAML rules files
+func LoadRuleGroups(files []string) ([]*RuleGroup, error) {
+	groups := []*RuleGroup{}
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		ruleGroups := RuleGroups{}
+		if err := yaml.UnmarshalStrict(content, &ruleGroups); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+
+		for _, group := range ruleGroups.Groups {
+			if err := group.load(); err != nil {
+				return nil, fmt.Errorf("%s: group %q: %v", file, group.Name, err)
+			}
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+// Check a rule group and load its durations
+func (group *RuleGroup) load() error {
+	group.interval = defaultRulesInterval
+	if viper.IsSet("tsl.rules.interval") {
+		group.interval = viper.GetDuration("tsl.rules.interval")
+	}
+	if group.Interval != "" {
+		interval, err := model.ParseDuration(group.Interval)
+		if err != nil {
+			return err
+		}
+		group.interval = time.Duration(interval)
+	}
+	if group.interval <= 0 {
+		return errors.New("expects a positive interval")
+	}
+
+	for index, rule := range group.Rules {
+		if (rule.Record == "") == (rule.Alert == "") {
+			return fmt.Errorf("rule %d expects a record or an alert name", index+1)
+		}
+
+		if _, _, err := parseQueryWithParams(rule.Expr, viper.GetString("tsl.rules.token"), map[string]string{}); err != nil {
+			return fmt.Errorf("rule %d: %v", index+1, err)
+		}
+
+		if rule.Record != "" {
+			if rule.For != "" || len(rule.Annotations) > 0 {
+				return fmt.Errorf("recording rule %q doesn't accept for and annotations", rule.Record)
+			}
+			if viper.GetString("tsl.rules.warp10.endpoint") == "" && viper.GetString("tsl.rules.remoteWrite.url") == "" {
+				return fmt.Errorf("recording rule %q expects a Warp 10 or a remote write sink", rule.Record)
+			}
+			continue
+		}
+
+		if viper.GetString("tsl.rules.alertmanager.url") == "" {
+			return fmt.Errorf("alerting rule %q expects an alertmanager url", rule.Alert)
+		}
+		if rule.For != "" {
+			duration, err := model.ParseDuration(rule.For)
+			if err != nil {
+				return fmt.Errorf("alerting rule %q: %v", rule.Alert, err)
+			}
+			rule.forDuration = time.Duration(duration)
+		}
+		rule.active = map[string]*activeAlert{}
+	}
+	return nil
+}
+
+// Run evaluates the group rules at each interval until stop is closed
+func (group *RuleGroup) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(group.interval)
+	defer ticker.Stop()
+
+	group.Evaluate(time.Now().UTC())
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			group.Evaluate(now.UTC())
+		}
+	}
+}
+
+// Evaluate the group rules in order
+func (group *RuleGroup) Evaluate(now time.Time) {
+	for _, rule := range group.Rules {
+		logger := log.WithFields(log.Fields{"group": group.Name, "record": rule.Record, "alert": rule.Alert})
+
+		series, err := EvaluateQuery(rule.Expr, viper.GetString("tsl.rules.token"), now)
+		if err != nil {
+			logger.WithError(err).Error("Could not evaluate rule")
+			continue
+		}
+
+		if rule.Record != "" {
+			err = rule.record(series, now)
+		} else {
+			err = rule.alert(series, now, group.interval)
+		}
+		if err != nil {
+			logger.WithError(err).Error("Could not process rule result")
+		}
+	}
+}
+
+// EvaluateQuery Execute each statement of a TSL query on its back-end, returns the series of all statements
+func EvaluateQuery(tslQuery string, token string, now time.Time) ([]WarpSeries, error) {
+	query, lineStart, err := parseQueryWithParams(tslQuery, token, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+
+	ticksPerSecond, err := tsl.TimeUnitTicks(viper.GetString("tsl.warp10.timeunit"))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, "/v0/query", http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	evaluation := &crossQuery{
+		ctx:               echo.New().NewContext(request, nil),
+		lineStart:         lineStart,
+		allowAuthenticate: viper.GetBool("tsl.warp10.authenticate"),
+		now:               now,
+		ticksPerSecond:    ticksPerSecond,
+	}
+
+	series := []WarpSeries{}
+	for _, instruction := range query.Statements {
+		if err := checkConnect(*instruction, token, nil); err != nil {
+			return nil, err
+		}
+
+		statementSeries, err := evaluation.evaluate(*instruction)
+		if err != nil {
+			return nil, err
+		}
+		series = append(series, statementSeries...)
+	}
+	return series, nil
+}
+
+// Record the last value of each series at the evaluation time, renamed after the rule and with its labels
+func (rule *Rule) record(series []WarpSeries, now time.Time) error {
+	ticksPerSecond, err := tsl.TimeUnitTicks(viper.GetString("tsl.warp10.timeunit"))
+	if err != nil {
+		return err
+	}
+	tick := now.UnixNano() / (int64(time.Second) / ticksPerSecond)
+
+	recorded := []WarpSeries{}
+	for _, gts := range series {
+		value, ok := lastValue(gts)
+		if !ok || math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		recorded = append(recorded, WarpSeries{
+			Class:      rule.Record,
+			Labels:     rule.seriesLabels(gts),
+			Attributes: map[string]string{},
+			Values:     [][]interface{}{{tick, value}},
+		})
+	}
+	if len(recorded) == 0 {
+		return nil
+	}
+
+	if endpoint := viper.GetString("tsl.rules.warp10.endpoint"); endpoint != "" {
+		if err := warpUpdate(endpoint, viper.GetString("tsl.rules.warp10.token"), recorded, ticksPerSecond); err != nil {
+			return err
+		}
+	}
+
+	if url := viper.GetString("tsl.rules.remoteWrite.url"); url != "" {
+		if err := RemoteWrite(url, recorded, ticksPerSecond); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update the rule alerts states from its active series and notify the firing and resolved ones
+func (rule *Rule) alert(series []WarpSeries, now time.Time, interval time.Duration) error {
+	alerts := []Alert{}
+	seen := map[string]bool{}
+
+	for _, gts := range series {
+		value, ok := lastValue(gts)
+		if !ok {
+			continue
+		}
+
+		labels := rule.seriesLabels(gts)
+		labels[alertNameLabel] = rule.Alert
+		key := matchingKey(labels)
+		seen[key] = true
+
+		active, ok := rule.active[key]
+		if !ok {
+			active = &activeAlert{labels: labels, activeAt: now}
+			rule.active[key] = active
+		}
+		active.annotations = expandAnnotations(rule.Annotations, gts.Labels, value)
+
+		if now.Sub(active.activeAt) >= rule.forDuration {
+			active.firing = true
+
+			// Resolve the alert on Alertmanager side when it isn't sent anymore
+			alerts = append(alerts, Alert{Labels: active.labels, Annotations: active.annotations, StartsAt: active.activeAt, EndsAt: now.Add(3 * interval)})
+		}
+	}
+
+	for key, active := range rule.active {
+		if seen[key] {
+			continue
+		}
+		if active.firing {
+			alerts = append(alerts, Alert{Labels: active.labels, Annotations: active.annotations, StartsAt: active.activeAt, EndsAt: now})
+		}
+		delete(rule.active, key)
+	}
+
+	if len(alerts) == 0 {
+		return nil
+	}
+	return sendAlerts(viper.GetString("tsl.rules.alertmanager.url"), alerts)
+}
+
+// Get the labels of a rule result series
+func (rule *Rule) seriesLabels(gts WarpSeries) map[string]string {
+	labels := map[string]string{}
+	for key, value := range gts.Labels {
+		labels[key] = value
+	}
+	for key, value := range rule.Labels {
+		labels[key] = value
+	}
+	return labels
+}
+
+// Get the numeric value of the latest series data point
+func lastValue(gts WarpSeries) (float64, bool) {
+	found := false
+	lastTick := int64(0)
+	value := 0.0
+
+	for _, point := range gts.Values {
+		if len(point) < 2 {
+			continue
+		}
+		tick, isTick := point[0].(int64)
+		pointValue, err := toFloat(point[len(point)-1])
+		if !isTick || err != nil || (found && tick <= lastTick) {
+			continue
+		}
+		found, lastTick, value = true, tick, pointValue
+	}
+	return value, found
+}
+
+// Expand the annotations templates using the series $labels and $value
+func expandAnnotations(annotations map[string]string, labels map[string]string, value float64) map[string]string {
+	expanded := map[string]string{}
+	data := struct {
+		Labels map[string]string
+		Value  float64
+	}{labels, value}
+
+	for key, text := range annotations {
+		expanded[key] = text
+
+		annotation, err := template.New(key).Parse("{{$labels := .Labels}}{{$value := .Value}}" + text)
+		if err != nil {
+			log.WithError(err).Warnf("Could not parse annotation %q", key)
+			continue
+		}
+
+		var buffer bytes.Buffer
+		if err := annotation.Execute(&buffer, data); err != nil {
+			log.WithError(err).Warnf("Could not expand annotation %q", key)
+			continue
+		}
+		expanded[key] = buffer.String()
+	}
+	return expanded
+}
+
+// Send alerts to an Alertmanager compatible webhook
+func sendAlerts(url string, alerts []Alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("sending alerts to %s failed with %s", url, res.Status)
+	}
+	return nil
+}
+
+// Store series on a Warp 10 endpoint or pool with its update API, their ticks being converted from the default platform time unit
+func warpUpdate(endpoint string, token string, series []WarpSeries, ticksPerSecond int64) error {
+	protoParser := warpParser("rules", 0)
+	endpointTicks, err := tsl.TimeUnitTicks(protoParser.EndpointTimeUnit(endpoint))
+	if err != nil {
+		return err
+	}
+
+	converted := make([]WarpSeries, len(series))
+	for index, gts := range series {
+		converted[index] = gts
+		converted[index].Values = make([][]interface{}, len(gts.Values))
+		for pointIndex, point := range gts.Values {
+			converted[index].Values[pointIndex] = []interface{}{convertTick(point[0].(int64), ticksPerSecond, endpointTicks), point[len(point)-1]}
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := formatGTSInput(&buffer, converted); err != nil {
+		return err
+	}
+
+	update := func(url string) (string, error) {
+		httpReq, err := http.NewRequest(http.MethodPost, url+"/api/v0/update", bytes.NewReader(buffer.Bytes()))
+		if err != nil {
+			return "", err
+		}
+		httpReq.Header.Add("X-Warp10-Token", token)
+		httpReq.Header.Add("Content-Type", "text/plain")
+		httpReq.Header.Add("User-Agent", "tsl/"+viper.GetString("version")+" (Warp10)")
+
+		res, err := backendClient(url).Do(httpReq)
+		if err != nil {
+			return "", &connectionError{err: err}
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode/100 != 2 {
+			return "", fmt.Errorf("update of %s failed with %s: %s", url, res.Status, res.Header.Get("X-Warp10-Error-Message"))
+		}
+		return "", nil
+	}
+
+	if pool, ok := getPool(endpoint); ok {
+		_, err = pool.do(update)
+		return err
+	}
+	_, err = update(endpoint)
+	return err
+}
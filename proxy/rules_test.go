@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestWarpUpdate(t *testing.T) {
+	defer viper.Reset()
+
+	var body, token string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v0/update" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		content, _ := ioutil.ReadAll(r.Body)
+		body, token = string(content), r.Header.Get("X-Warp10-Token")
+	}))
+	defer server.Close()
+
+	viper.Set("tsl.warp10.endpoints", []interface{}{map[string]interface{}{"url": server.URL, "timeunit": "ms"}})
+
+	// Labels with the TSL and GTS input format delimiters are sent escaped
+	series := []WarpSeries{{
+		Class:  "cpu.usage",
+		Labels: map[string]string{"host": `a", "b`, "path": "{/é,=}"},
+		Values: [][]interface{}{{int64(1346846400000000), 1.5}},
+	}}
+	if err := warpUpdate(server.URL, "WRITE_TOKEN", series, 1000000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if token != "WRITE_TOKEN" {
+		t.Errorf("expected the WRITE_TOKEN token, got %q", token)
+	}
+	if expected := "1346846400000// cpu.usage{host=a\"%2C%20\"b,path=%7B/%C3%A9%2C%3D%7D} 1.5\n"; body != expected {
+		t.Errorf("expected %q, got %q", expected, body)
+	}
+}
+
+func TestWarpUpdateError(t *testing.T) {
+	defer viper.Reset()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Warp10-Error-Message", "Invalid token.")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	viper.Set("tsl.rules.warp10.endpoint", server.URL)
+
+	series := []WarpSeries{{Class: "cpu", Labels: map[string]string{}, Values: [][]interface{}{{int64(1), 1.0}}}}
+	err := warpUpdate(server.URL, "TOKEN", series, 1000000)
+	if err == nil || !strings.Contains(err.Error(), "Invalid token.") {
+		t.Errorf("expected the Warp 10 error message, got %v", err)
+	}
+}
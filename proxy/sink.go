@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ovh/tsl/tsl"
+	"github.com/spf13/viper"
+)
+
+// Write series to the sink of a store method
+func writeSink(sink *tsl.StoreSink, series []WarpSeries, ticksPerSecond int64) error {
+	switch sink.Type {
+	case tsl.PrometheusSink:
+		// A store with a token writes on the remote write API of the connected back-end
+		if sink.Backend != "" {
+			write := func(url string) (string, error) {
+				return "", remoteWrite(backendClient(url), url+"/api/v1/write", sink.Token, series, ticksPerSecond)
+			}
+			if pool, ok := getPool(sink.Backend); ok {
+				_, err := pool.do(write)
+				return err
+			}
+			_, err := write(sink.Backend)
+			return err
+		}
+
+		if !contains(viper.GetStringSlice("tsl.store.remoteWrite"), sink.Destination) && !isAllowedEndpoint(sink.Destination) {
+			return fmt.Errorf("remote write endpoint %q is not configured", sink.Destination)
+		}
+		return RemoteWrite(sink.Destination, series, ticksPerSecond)
+
+	case tsl.GTSSink:
+		path, err := sinkPath(sink.Destination)
+		if err != nil {
+			return err
+		}
+
+		// GTS input format files are appended, as successive updates of the series
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		if err := formatGTSInput(file, series); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+
+	case tsl.OpenMetricsSink:
+		path, err := sinkPath(sink.Destination)
+		if err != nil {
+			return err
+		}
+
+		// OpenMetrics files are replaced at once, to be scraped as a complete exposition
+		file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+		if err != nil {
+			return err
+		}
+		if err := FormatOpenMetrics(file, series, ticksPerSecond); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return err
+		}
+		if err := file.Close(); err != nil {
+			os.Remove(file.Name())
+			return err
+		}
+		if err := os.Chmod(file.Name(), 0644); err != nil {
+			os.Remove(file.Name())
+			return err
+		}
+		return os.Rename(file.Name(), path)
+	}
+	return fmt.Errorf("unknown store sink %q", sink.Type)
+}
+
+// Resolve a sink file inside the configured store directory
+func sinkPath(destination string) (string, error) {
+	root := viper.GetString("tsl.store.path")
+	if root == "" {
+		return "", fmt.Errorf("file sinks are disabled, set a tsl.store.path directory")
+	}
+
+	path := filepath.Clean(destination)
+	if filepath.IsAbs(path) || path == "." || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("sink file %q must be a relative path inside the store directory", destination)
+	}
+	return filepath.Join(root, path), nil
+}
+
+// Write series in the Warp 10 GTS input format, ticks are kept in platform time unit
+func formatGTSInput(writer io.Writer, series []WarpSeries) error {
+	var buffer bytes.Buffer
+
+	for _, gts := range series {
+		keys := make([]string, 0, len(gts.Labels))
+		for key := range gts.Labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		labels := make([]string, len(keys))
+		for index, key := range keys {
+			labels[index] = gtsEscape(key) + "=" + gtsEscape(gts.Labels[key])
+		}
+		selector := gtsEscape(gts.Class) + "{" + strings.Join(labels, ",") + "}"
+
+		for _, point := range gts.Values {
+			if len(point) < 2 {
+				continue
+			}
+			tick, isTick := point[0].(int64)
+			value, err := gtsValue(point[len(point)-1])
+			if !isTick || err != nil {
+				continue
+			}
+
+			// Only the first point of a series holds its selector, next ones are continuation lines
+			if selector != "" {
+				buffer.WriteString(fmt.Sprintf("%d// %s %s\n", tick, selector, value))
+				selector = ""
+			} else {
+				buffer.WriteString(fmt.Sprintf("=%d// %s\n", tick, value))
+			}
+		}
+	}
+
+	_, err := writer.Write(buffer.Bytes())
+	return err
+}
+
+// Format a value of the GTS input format
+func gtsValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return "T", nil
+		}
+		return "F", nil
+	case string:
+		return "'" + url.PathEscape(v) + "'", nil
+	case json.Number:
+		return v.String(), nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", fmt.Errorf("got %v", value)
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	}
+	return "", fmt.Errorf("got %v", value)
+}
+
+// Percent-encode the characters with a meaning in the GTS input format classes and labels
+func gtsEscape(value string) string {
+	var buffer bytes.Buffer
+	for _, char := range []byte(value) {
+		if char <= ' ' || char >= 0x7f || strings.IndexByte("%{},=", char) >= 0 {
+			buffer.WriteString(fmt.Sprintf("%%%02X", char))
+			continue
+		}
+		buffer.WriteByte(char)
+	}
+	return buffer.String()
+}
+
+// FormatOpenMetrics write series in the OpenMetrics text format, grouping them per metric family
+func FormatOpenMetrics(writer io.Writer, series []WarpSeries, ticksPerSecond int64) error {
+	return formatMetricsText(writer, series, ticksPerSecond, true)
+}
+
+// Write series in the OpenMetrics text format or, when openMetrics is false, in the Prometheus text format
+// with untyped families and timestamps in milliseconds
+// Fails when different classes, or labels of a series, get the same name once their characters are replaced
+func formatMetricsText(writer io.Writer, series []WarpSeries, ticksPerSecond int64, openMetrics bool) error {
+	families := map[string][]WarpSeries{}
+	classes := map[string]string{}
+	for _, gts := range series {
+		name := openMetricsName(gts.Class, true)
+		if class, exists := classes[name]; exists && class != gts.Class {
+			return fmt.Errorf("series %q and %q have the same metric name %q, rename one of them", class, gts.Class, name)
+		}
+		classes[name] = gts.Class
+		families[name] = append(families[name], gts)
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buffer bytes.Buffer
+	for _, name := range names {
+		if openMetrics {
+			buffer.WriteString("# TYPE " + name + " unknown\n")
+		} else {
+			buffer.WriteString("# TYPE " + name + " untyped\n")
+		}
+
+		for _, gts := range families[name] {
+			keys := make([]string, 0, len(gts.Labels))
+			for key := range gts.Labels {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			labels := make([]string, len(keys))
+			labelKeys := map[string]string{}
+			for index, key := range keys {
+				labelName := openMetricsName(key, false)
+				if labelKey, exists := labelKeys[labelName]; exists {
+					return fmt.Errorf("labels %q and %q of series %q have the same name %q, rename one of them", labelKey, key, gts.Class, labelName)
+				}
+				labelKeys[labelName] = key
+				labels[index] = labelName + "=\"" + openMetricsEscaper.Replace(gts.Labels[key]) + "\""
+			}
+			metric := name
+			if len(labels) > 0 {
+				metric += "{" + strings.Join(labels, ",") + "}"
+			}
+
+			for _, point := range gts.Values {
+				if len(point) < 2 {
+					continue
+				}
+				tick, isTick := point[0].(int64)
+				value, err := toFloat(point[len(point)-1])
+				if !isTick || err != nil {
+					continue
+				}
+				timestamp := openMetricsTimestamp(tick, ticksPerSecond)
+				if !openMetrics {
+					timestamp = strconv.FormatInt(tickTime(tick, ticksPerSecond).UnixNano()/int64(time.Millisecond), 10)
+				}
+				buffer.WriteString(metric + " " + openMetricsValue(value) + " " + timestamp + "\n")
+			}
+		}
+	}
+	if openMetrics {
+		buffer.WriteString("# EOF\n")
+	}
+
+	_, err := writer.Write(buffer.Bytes())
+	return err
+}
+
+// Escape OpenMetrics label values
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Replace the characters not allowed in OpenMetrics metric or label names by an underscore
+func openMetricsName(name string, isMetric bool) string {
+	var buffer bytes.Buffer
+	for index, char := range name {
+		switch {
+		case char >= 'a' && char <= 'z', char >= 'A' && char <= 'Z', char == '_':
+		case char == ':' && isMetric:
+		case char >= '0' && char <= '9' && index > 0:
+		default:
+			char = '_'
+		}
+		buffer.WriteRune(char)
+	}
+	if buffer.Len() == 0 {
+		return "_"
+	}
+	return buffer.String()
+}
+
+// Format an OpenMetrics sample value
+func openMetricsValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Format platform ticks as an OpenMetrics timestamp in seconds
+func openMetricsTimestamp(tick int64, ticksPerSecond int64) string {
+	if tick%ticksPerSecond == 0 {
+		return strconv.FormatInt(tick/ticksPerSecond, 10)
+	}
+	return strconv.FormatFloat(float64(tick)/float64(ticksPerSecond), 'f', -1, 64)
+}
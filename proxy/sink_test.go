@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/ovh/tsl/tsl"
+	"github.com/spf13/viper"
+)
+
+func TestWriteSinkPrometheusBackend(t *testing.T) {
+	defer viper.Reset()
+
+	var path, authorization, encoding string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, authorization, encoding = r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("Content-Encoding")
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	viper.Set("tsl.promql.endpoints", []string{server.URL})
+
+	series := []WarpSeries{{Class: "cpu", Labels: map[string]string{"host": "a"}, Values: [][]interface{}{{int64(1346846400000000), 1.5}}}}
+	sink := &tsl.StoreSink{Type: tsl.PrometheusSink, Backend: server.URL, Token: "TOKEN"}
+	if err := writeSink(sink, series, 1000000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if path != "/api/v1/write" || authorization != "Bearer TOKEN" || encoding != "snappy" {
+		t.Errorf("expected a snappy remote write on /api/v1/write with the TOKEN bearer token, got %s %q %q", path, authorization, encoding)
+	}
+
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatalf("unexpected snappy error: %v", err)
+	}
+	request := &promWriteRequest{}
+	if err := proto.Unmarshal(decoded, request); err != nil {
+		t.Fatalf("unexpected protobuf error: %v", err)
+	}
+	expected := "timeseries:<labels:<name:\"__name__\" value:\"cpu\" > labels:<name:\"host\" value:\"a\" > samples:<value:1.5 timestamp:1346846400000 > > "
+	if request.String() != expected {
+		t.Errorf("expected the write request %q, got %q", expected, request.String())
+	}
+}
+
+func TestFormatMetricsText(t *testing.T) {
+	series := []WarpSeries{
+		{Class: "sys.cpu", Labels: map[string]string{"host.name": "a\"b"}, Values: [][]interface{}{{int64(1346846400000000), 1.5}}},
+		{Class: "sys.cpu", Labels: map[string]string{"host.name": "c"}, Values: [][]interface{}{{int64(1346846400500000), 2.0}}},
+	}
+
+	var buffer bytes.Buffer
+	if err := formatMetricsText(&buffer, series, 1000000, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "# TYPE sys_cpu unknown\nsys_cpu{host_name=\"a\\\"b\"} 1.5 1346846400\nsys_cpu{host_name=\"c\"} 2 1346846400.5\n# EOF\n"
+	if buffer.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buffer.String())
+	}
+}
+
+func TestFormatMetricsTextCollisions(t *testing.T) {
+	tests := []struct {
+		series []WarpSeries
+		error  string
+	}{
+		{
+			[]WarpSeries{
+				{Class: "sys.cpu", Labels: map[string]string{}, Values: [][]interface{}{{int64(1), 1.0}}},
+				{Class: "sys_cpu", Labels: map[string]string{}, Values: [][]interface{}{{int64(1), 2.0}}},
+			},
+			`series "sys.cpu" and "sys_cpu" have the same metric name "sys_cpu"`,
+		},
+		{
+			[]WarpSeries{
+				{Class: "cpu", Labels: map[string]string{"host.name": "a", "host_name": "b"}, Values: [][]interface{}{{int64(1), 1.0}}},
+			},
+			`labels "host.name" and "host_name" of series "cpu" have the same name "host_name"`,
+		},
+	}
+
+	for _, test := range tests {
+		var buffer bytes.Buffer
+		err := formatMetricsText(&buffer, test.series, 1000000, false)
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("expected the error %q, got %v", test.error, err)
+		}
+		if buffer.Len() > 0 {
+			t.Errorf("expected nothing written on a collision, got %q", buffer.String())
+		}
+	}
+}
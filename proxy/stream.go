@@ -0,0 +1,339 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/ovh/tsl/middlewares"
+	"github.com/ovh/tsl/tsl"
+	"github.com/spf13/viper"
+	"golang.org/x/net/websocket"
+)
+
+// Stream events types
+const (
+	pointsEvent = "points"
+	errorEvent  = "error"
+)
+
+// Stream limits keys, all streams are counted together and per client
+const allStreamsKey = "streams"
+
+// streamEvent is a stream message: the new points of each series or an evaluation error
+type streamEvent struct {
+	Type   string       `json:"type"`
+	Series []WarpSeries `json:"series,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// streamWriter pushes the stream events to a client
+type streamWriter interface {
+	send(event streamEvent) error
+	keepAlive() error
+}
+
+// queryStream re-evaluates TSL statements and keeps the last tick sent of each series
+type queryStream struct {
+	statements []tsl.Instruction
+	evaluation *crossQuery
+	maxSeries  int
+	lastTicks  map[string]int64
+}
+
+// Stream is the API call method re-evaluating a TSL query at a refresh interval,
+// and pushing the new points of each series over Server-Sent Events or a WebSocket
+func (proxyTsl ProxyTSL) Stream(ctx echo.Context) error {
+
+	proxyTsl.ReqCounter.Inc()
+
+	request := ctx.Request()
+
+	// Read the query from the query parameter or the user body
+	tslQuery := ctx.QueryParam("query")
+	if tslQuery == "" && request.Method == http.MethodPost {
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			proxyTsl.WarnCounter.Inc()
+			return ctx.JSON(http.StatusBadRequest, tsl.NewError(err))
+		}
+		tslQuery = string(body)
+	}
+	if strings.TrimSpace(tslQuery) == "" {
+		proxyTsl.WarnCounter.Inc()
+		return ctx.JSON(http.StatusBadRequest, tsl.NewError(errors.New("expects a TSL query as query parameter or as body")))
+	}
+
+	interval, err := streamInterval(ctx.QueryParam("interval"))
+	if err != nil {
+		proxyTsl.WarnCounter.Inc()
+		return ctx.JSON(http.StatusBadRequest, tsl.NewError(err))
+	}
+
+	stream, err := newQueryStream(ctx, tslQuery)
+	if err != nil {
+		proxyTsl.WarnCounter.Inc()
+		return ctx.JSON(queryErrorStatus(err), tsl.NewError(err))
+	}
+
+	// Limit the streams open at the same time, in total and per client
+	clientKey := middlewares.ClientKey(ctx)
+	if maxStreams := viper.GetInt("tsl.stream.maxStreams"); maxStreams > 0 {
+		if !proxyTsl.streams.Acquire(allStreamsKey, maxStreams) {
+			proxyTsl.WarnCounter.Inc()
+			return ctx.JSON(http.StatusTooManyRequests, tsl.NewError(errors.New("too many streams: maximum open streams reached")))
+		}
+		defer proxyTsl.streams.Release(allStreamsKey)
+	}
+	if maxClientStreams := viper.GetInt("tsl.stream.maxClientStreams"); maxClientStreams > 0 {
+		if !proxyTsl.streams.Acquire(clientKey, maxClientStreams) {
+			proxyTsl.WarnCounter.Inc()
+			return ctx.JSON(http.StatusTooManyRequests, tsl.NewError(errors.New("too many streams: maximum open streams of the client reached")))
+		}
+		defer proxyTsl.streams.Release(clientKey)
+	}
+
+	proxyTsl.StreamGauge.Inc()
+	defer proxyTsl.StreamGauge.Dec()
+
+	// Close the streams after the maximum duration
+	var deadline <-chan time.Time
+	if maxDuration := viper.GetDuration("tsl.stream.maxDuration"); maxDuration > 0 {
+		timer := time.NewTimer(maxDuration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	if strings.EqualFold(request.Header.Get("Upgrade"), "websocket") {
+		websocket.Handler(func(conn *websocket.Conn) {
+			done := make(chan struct{})
+
+			// Read the client messages to detect the connection close
+			go func() {
+				defer close(done)
+				var message string
+				for websocket.Message.Receive(conn, &message) == nil {
+				}
+			}()
+
+			if err := stream.run(&webSocketWriter{conn: conn}, interval, done, deadline); err != nil {
+				proxyTsl.WarnCounter.Inc()
+			}
+		}).ServeHTTP(ctx.Response(), request)
+		return nil
+	}
+
+	response := ctx.Response()
+	response.Header().Set(echo.HeaderContentType, "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Header().Set("X-Accel-Buffering", "no")
+	response.WriteHeader(http.StatusOK)
+
+	writer := &serverSentEventsWriter{response: response}
+	writer.flush()
+	if err := stream.run(writer, interval, request.Context().Done(), deadline); err != nil {
+		proxyTsl.WarnCounter.Inc()
+	}
+	return nil
+}
+
+// Get the refresh interval of a stream, bounded by the minimum interval
+func streamInterval(param string) (time.Duration, error) {
+	interval := viper.GetDuration("tsl.stream.interval")
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	if param != "" {
+		var err error
+		interval, err = time.ParseDuration(param)
+		if err != nil {
+			return 0, fmt.Errorf("unvalid interval %q, expects a duration", param)
+		}
+	}
+
+	minInterval := viper.GetDuration("tsl.stream.minInterval")
+	if minInterval <= 0 {
+		minInterval = time.Second
+	}
+	if interval < minInterval {
+		return 0, fmt.Errorf("interval %v is below the minimum of %v", interval, minInterval)
+	}
+	return interval, nil
+}
+
+// Parse and check the statements of a streamed query
+func newQueryStream(ctx echo.Context, tslQuery string) (*queryStream, error) {
+	evaluation, statements, err := prepareQuery(ctx, tslQuery, headerParams(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, instruction := range statements {
+		if instruction.GetStoreSink() != nil {
+			return nil, errors.New("a store to a sink can't be streamed")
+		}
+	}
+
+	return &queryStream{
+		statements: statements,
+		evaluation: evaluation,
+		maxSeries:  viper.GetInt("tsl.stream.maxSeries"),
+		lastTicks:  make(map[string]int64),
+	}, nil
+}
+
+// Push the new points at each refresh until the client leaves or the deadline
+// A refresh starts once the previous points are written: the ticks missed by a slow client are dropped, its next push holds all the points since the last one
+func (stream *queryStream) run(writer streamWriter, interval time.Duration, done <-chan struct{}, deadline <-chan time.Time) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		series, err := stream.refresh(time.Now().UTC())
+		if err != nil {
+			err = writer.send(streamEvent{Type: errorEvent, Error: err.Error()})
+		} else if len(series) > 0 {
+			err = writer.send(streamEvent{Type: pointsEvent, Series: series})
+		} else {
+			err = writer.keepAlive()
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-done:
+			return nil
+		case <-deadline:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Evaluate the statements, returns the series points newer than the last ones sent
+func (stream *queryStream) refresh(now time.Time) ([]WarpSeries, error) {
+	stream.evaluation.now = now
+
+	updates := []WarpSeries{}
+	lastTicks := make(map[string]int64)
+	for index, instruction := range stream.statements {
+		series, err := stream.evaluation.evaluate(instruction)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, gts := range series {
+			key := fmt.Sprintf("%d:%s%s", index, gts.Class, matchingKey(gts.Labels))
+			lastTick, sent := stream.lastTicks[key]
+			if !sent {
+				lastTick = math.MinInt64
+			}
+
+			update := gts
+			update.Values = [][]interface{}{}
+			maxTick := lastTick
+			for _, point := range gts.Values {
+				tick, isTick := point[0].(int64)
+				if !isTick || tick <= lastTick {
+					continue
+				}
+				update.Values = append(update.Values, point)
+				if tick > maxTick {
+					maxTick = tick
+				}
+			}
+
+			if len(update.Values) > 0 {
+				lastTicks[key] = maxTick
+				updates = append(updates, update)
+			}
+		}
+	}
+
+	if stream.maxSeries > 0 && len(updates) > stream.maxSeries {
+		return nil, fmt.Errorf("%d series updated exceeds the stream maximum of %d", len(updates), stream.maxSeries)
+	}
+
+	for key, tick := range lastTicks {
+		stream.lastTicks[key] = tick
+	}
+	return updates, nil
+}
+
+// Get the delay after which a client not reading its stream is disconnected
+func streamWriteTimeout() time.Duration {
+	if writeTimeout := viper.GetDuration("tsl.stream.writeTimeout"); writeTimeout > 0 {
+		return writeTimeout
+	}
+	return 30 * time.Second
+}
+
+// serverSentEventsWriter pushes the stream events as Server-Sent Events
+type serverSentEventsWriter struct {
+	response *echo.Response
+}
+
+func (writer *serverSentEventsWriter) send(event streamEvent) error {
+	var data interface{} = event.Series
+	if event.Type == errorEvent {
+		data = tsl.NewError(errors.New(event.Error))
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return writer.write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event.Type, payload)))
+}
+
+func (writer *serverSentEventsWriter) keepAlive() error {
+	return writer.write([]byte(": keepalive\n\n"))
+}
+
+// Write and flush a message
+func (writer *serverSentEventsWriter) write(message []byte) error {
+	if _, err := writer.response.Write(message); err != nil {
+		return err
+	}
+	writer.flush()
+	return nil
+}
+
+// Flush the buffered messages to the client, when the response writer supports it
+func (writer *serverSentEventsWriter) flush() {
+	if flusher, ok := writer.response.Writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// webSocketWriter pushes the stream events as WebSocket JSON messages
+type webSocketWriter struct {
+	conn *websocket.Conn
+}
+
+func (writer *webSocketWriter) send(event streamEvent) error {
+	if err := writer.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout())); err != nil {
+		return err
+	}
+	return websocket.JSON.Send(writer.conn, event)
+}
+
+// Send a ping frame, answered by the client with a pong ignored by the messages reader
+func (writer *webSocketWriter) keepAlive() error {
+	if err := writer.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout())); err != nil {
+		return err
+	}
+
+	writer.conn.PayloadType = websocket.PingFrame
+	defer func() { writer.conn.PayloadType = websocket.TextFrame }()
+	_, err := writer.conn.Write([]byte{})
+	return err
+}
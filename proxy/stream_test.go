@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+	"golang.org/x/net/websocket"
+)
+
+func TestServerSentEventsKeepAlive(t *testing.T) {
+	e := echo.New()
+	errs := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := e.NewContext(r, w)
+		writer := &serverSentEventsWriter{response: ctx.Response()}
+		errs <- writer.keepAlive()
+	}))
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer res.Body.Close()
+
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected keep alive error: %v", err)
+	}
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	if err != nil || line != ": keepalive\n" {
+		t.Errorf("expected a keep alive comment, got %q: %v", line, err)
+	}
+}
+
+func TestWebSocketKeepAlive(t *testing.T) {
+	server := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		writer := &webSocketWriter{conn: conn}
+		if err := writer.keepAlive(); err != nil {
+			t.Errorf("unexpected keep alive error: %v", err)
+		}
+		if err := writer.send(streamEvent{Type: errorEvent, Error: "failed"}); err != nil {
+			t.Errorf("unexpected send error: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http"), "", server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	// The ping frame is answered by the client and isn't received as a message
+	event := streamEvent{}
+	if err := websocket.JSON.Receive(conn, &event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if event.Type != errorEvent || event.Error != "failed" {
+		t.Errorf("expected the error event after the ping, got %+v", event)
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/labstack/echo"
+	"github.com/ovh/tsl/middlewares"
+	"github.com/spf13/viper"
+)
+
+// Tenant maps a JWT tenant to the back-ends it is allowed to query
+type Tenant struct {
+	Name     string          `mapstructure:"name"`
+	Backends []TenantBackend `mapstructure:"backends"`
+}
+
+// TenantBackend is a back-end endpoint with the token used for a tenant
+type TenantBackend struct {
+	Endpoint string `mapstructure:"endpoint"`
+	Token    string `mapstructure:"token"`
+}
+
+// Get the tenant authenticated by the JWT middleware, nil without JWT authentication
+func getTenant(ctx echo.Context) (*Tenant, error) {
+	name, ok := ctx.Get(middlewares.TenantKey).(string)
+	if !ok {
+		return nil, nil
+	}
+
+	tenants := []Tenant{}
+	if err := viper.UnmarshalKey("tsl.auth.tenants", &tenants); err != nil {
+		return nil, err
+	}
+
+	for _, tenant := range tenants {
+		if tenant.Name == name {
+			return &tenant, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown tenant %q", name)
+}
+
+// Get the tenant tokens per back-end endpoint
+func (tenant *Tenant) tokens() map[string]string {
+	tokens := make(map[string]string)
+	for _, backend := range tenant.Backends {
+		tokens[backend.Endpoint] = backend.Token
+	}
+	return tokens
+}
+
+// Get the tenant allowed back-end endpoints
+func (tenant *Tenant) endpoints() []string {
+	endpoints := []string{}
+	for _, backend := range tenant.Backends {
+		endpoints = append(endpoints, backend.Endpoint)
+	}
+	return endpoints
+}
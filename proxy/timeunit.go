@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"github.com/ovh/tsl/tsl"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// warpEndpoint is a configured Warp 10 endpoint and its platform time unit, empty for the warp10 section one
+type warpEndpoint struct {
+	url      string
+	timeUnit string
+}
+
+// Get the configured Warp 10 endpoints, each one being set as an URL or as an url and a timeunit
+func configuredWarpEndpoints() []warpEndpoint {
+	endpoints := []warpEndpoint{}
+
+	items, ok := viper.Get("tsl.warp10.endpoints").([]interface{})
+	if !ok {
+		for _, url := range viper.GetStringSlice("tsl.warp10.endpoints") {
+			endpoints = append(endpoints, warpEndpoint{url: url})
+		}
+		return endpoints
+	}
+
+	for _, item := range items {
+		if url, isURL := item.(string); isURL {
+			endpoints = append(endpoints, warpEndpoint{url: url})
+			continue
+		}
+		fields := cast.ToStringMapString(item)
+		endpoints = append(endpoints, warpEndpoint{url: fields["url"], timeUnit: fields["timeunit"]})
+	}
+	return endpoints
+}
+
+// Get the platform time unit of the Warp 10 endpoints and pools declaring one
+func warpTimeUnits() map[string]string {
+	timeUnits := map[string]string{}
+	for _, endpoint := range configuredWarpEndpoints() {
+		if endpoint.timeUnit != "" {
+			timeUnits[endpoint.url] = endpoint.timeUnit
+		}
+	}
+	for name, pool := range pools {
+		if pool.Type == tsl.WARP.String() && pool.timeUnit != "" {
+			timeUnits[poolPrefix+name] = pool.timeUnit
+		}
+	}
+	return timeUnits
+}
+
+// Get a Warp 10 parser with the platform time unit of each configured endpoint
+func warpParser(name string, lineStart int) tsl.ProtoParser {
+	return tsl.ProtoParser{
+		Name:              name,
+		LineStart:         lineStart,
+		TimeUnit:          viper.GetString("tsl.warp10.timeunit"),
+		EndpointTimeUnits: warpTimeUnits(),
+	}
+}
+
+// Convert a tick between two platform time units, given as ticks per second
+func convertTick(tick int64, fromTicksPerSecond int64, toTicksPerSecond int64) int64 {
+	switch {
+	case fromTicksPerSecond > toTicksPerSecond:
+		return tick / (fromTicksPerSecond / toTicksPerSecond)
+	case fromTicksPerSecond < toTicksPerSecond:
+		return tick * (toTicksPerSecond / fromTicksPerSecond)
+	}
+	return tick
+}
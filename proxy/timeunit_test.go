@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ovh/tsl/tsl"
+	"github.com/spf13/viper"
+)
+
+// Ticks per second of each supported Warp 10 platform time unit
+var testTimeUnits = map[string]int64{"ns": 1000000000, "us": 1000000, "ms": 1000}
+
+func TestConvertTick(t *testing.T) {
+	date := time.Date(2012, 9, 5, 12, 0, 0, 0, time.UTC)
+
+	for fromUnit, fromTicks := range testTimeUnits {
+		for toUnit, toTicks := range testTimeUnits {
+			tick := date.UnixNano() / (int64(time.Second) / fromTicks)
+			expected := date.UnixNano() / (int64(time.Second) / toTicks)
+			if converted := convertTick(tick, fromTicks, toTicks); converted != expected {
+				t.Errorf("%s to %s: expected %d, got %d", fromUnit, toUnit, expected, converted)
+			}
+		}
+	}
+}
+
+func TestTickTime(t *testing.T) {
+	date := time.Date(2012, 9, 5, 12, 0, 0, 1000000, time.UTC)
+
+	for timeUnit, ticksPerSecond := range testTimeUnits {
+		tick := date.UnixNano() / (int64(time.Second) / ticksPerSecond)
+		if converted := tickTime(tick, ticksPerSecond); !converted.Equal(date) {
+			t.Errorf("time unit %s: expected %s, got %s", timeUnit, date, converted)
+		}
+	}
+}
+
+func TestParseWarpResultTimeUnit(t *testing.T) {
+	ticks := map[string]string{"ns": "1346846400000000000", "us": "1346846400000000", "ms": "1346846400000"}
+
+	for endpointUnit, endpointTicks := range testTimeUnits {
+		for queryUnit, queryTicks := range testTimeUnits {
+			res := `[[{"c":"cpu","l":{"host":"a"},"a":{},"v":[[` + ticks[endpointUnit] + `,1.5]]}]]`
+
+			series, err := parseWarpResult(res, endpointTicks, queryTicks)
+			if err != nil {
+				t.Fatalf("endpoint %s, query %s: unexpected error: %v", endpointUnit, queryUnit, err)
+			}
+			if len(series) != 1 || len(series[0].Values) != 1 {
+				t.Fatalf("endpoint %s, query %s: expected a single point, got %v", endpointUnit, queryUnit, series)
+			}
+
+			tick := series[0].Values[0][0].(int64)
+			if converted := tickTime(tick, queryTicks); !converted.Equal(time.Date(2012, 9, 5, 12, 0, 0, 0, time.UTC)) {
+				t.Errorf("endpoint %s, query %s: unexpected date %s from tick %d", endpointUnit, queryUnit, converted, tick)
+			}
+		}
+	}
+}
+
+func TestParsePromResultTimeUnit(t *testing.T) {
+	res := `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"cpu"},"values":[[1346846400.5,"2"]]}]}}`
+
+	for timeUnit, ticksPerSecond := range testTimeUnits {
+		series, err := parsePromResult(res, ticksPerSecond)
+		if err != nil {
+			t.Fatalf("time unit %s: unexpected error: %v", timeUnit, err)
+		}
+
+		tick := series[0].Values[0][0].(int64)
+		if expected := 1346846400*ticksPerSecond + ticksPerSecond/2; tick != expected {
+			t.Errorf("time unit %s: expected tick %d, got %d", timeUnit, expected, tick)
+		}
+	}
+}
+
+func TestWarpParserEndpointTimeUnits(t *testing.T) {
+	defer viper.Reset()
+	defer func(loaded map[string]*Pool) { pools = loaded }(pools)
+
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(bytes.NewBufferString(`
+tsl:
+  warp10:
+    timeunit: us
+    endpoints:
+      - http://127.0.0.1:8080
+      - url: http://127.0.0.1:8081
+        timeunit: ms
+      - url: http://127.0.0.1:8082
+        timeunit: ns
+  pools:
+    metrics:
+      type: warp10
+      timeunit: ms
+      endpoints:
+        - http://127.0.0.1:8083
+`))
+	if err != nil {
+		t.Fatalf("unexpected config error: %v", err)
+	}
+	if err := LoadPools(); err != nil {
+		t.Fatalf("unexpected pools error: %v", err)
+	}
+
+	expected := map[string]string{
+		"http://127.0.0.1:8080": "us",
+		"http://127.0.0.1:8081": "ms",
+		"http://127.0.0.1:8082": "ns",
+		"pool:metrics":          "ms",
+		"http://127.0.0.1:9999": "us",
+	}
+	protoParser := warpParser("warp 10", 0)
+	for api, timeUnit := range expected {
+		if endpointUnit := protoParser.EndpointTimeUnit(api); endpointUnit != timeUnit {
+			t.Errorf("endpoint %s: expected time unit %q, got %q", api, timeUnit, endpointUnit)
+		}
+	}
+
+	endpoints := configuredEndpoints(tsl.WARP.String())
+	for _, api := range []string{"http://127.0.0.1:8080", "http://127.0.0.1:8081", "http://127.0.0.1:8082", "pool:metrics"} {
+		if !contains(endpoints, api) {
+			t.Errorf("expected %s in the configured endpoints %v", api, endpoints)
+		}
+	}
+}
+
+func TestLoadPoolsUnsupportedTimeUnit(t *testing.T) {
+	defer viper.Reset()
+	defer func(loaded map[string]*Pool) { pools = loaded }(pools)
+
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(bytes.NewBufferString(`
+tsl:
+  pools:
+    metrics:
+      type: warp10
+      timeunit: s
+      endpoints:
+        - http://127.0.0.1:8083
+`))
+	if err != nil {
+		t.Fatalf("unexpected config error: %v", err)
+	}
+	if err := LoadPools(); err == nil {
+		t.Error("expected an error for an unsupported pool time unit")
+	}
+}
@@ -0,0 +1,266 @@
+package tsl
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// Cost is the estimated cost of a TSL statement on its back-ends
+type Cost struct {
+	Selects      int     `json:"selects"`
+	SelectAll    int     `json:"selectAll"`
+	Range        float64 `json:"range"`
+	UnknownRange bool    `json:"unknownRange"`
+	LastPoints   int64   `json:"lastPoints"`
+	Buckets      int64   `json:"buckets"`
+}
+
+// EstimateCost Estimate the cost of an instruction: its selects count, its longest time range in seconds, whether a select
+// time range can't be estimated, its last values count and its largest sampler buckets count. defaultType is the back-end type of the instructions without connect
+func (protoParser *ProtoParser) EstimateCost(instruction Instruction, now time.Time, defaultType string) Cost {
+	cost := Cost{}
+
+	if instruction.isGlobalOperator {
+		for _, operand := range instruction.globalOperator.instructions {
+			operandCost := protoParser.EstimateCost(*operand, now, defaultType)
+			cost.Selects += operandCost.Selects
+			cost.SelectAll += operandCost.SelectAll
+			cost.Range = math.Max(cost.Range, operandCost.Range)
+			cost.UnknownRange = cost.UnknownRange || operandCost.UnknownRange
+			cost.LastPoints += operandCost.LastPoints
+			if operandCost.Buckets > cost.Buckets {
+				cost.Buckets = operandCost.Buckets
+			}
+		}
+		return cost
+	}
+
+	if !instruction.hasSelect || instruction.selectStatement.isVariable {
+		return cost
+	}
+
+	selectStatement := instruction.selectStatement
+	cost.Selects = 1
+	if selectStatement.selectAll {
+		cost.SelectAll = 1
+	}
+	if selectStatement.hasLast && !selectStatement.last.isDuration {
+		if count, err := strconv.ParseInt(selectStatement.last.last, 10, 64); err == nil {
+			cost.LastPoints = count
+		}
+	}
+
+	// A meta select only lists the series, and a last values count bounds the points of a select without time range
+	selectRange, knownRange := protoParser.selectRange(instruction, now, defaultType)
+	cost.Range = selectRange
+	cost.UnknownRange = !knownRange && !instruction.isMeta && !(selectStatement.hasLast && !selectStatement.last.isDuration)
+
+	for _, framework := range selectStatement.frameworks {
+		if buckets := samplerBuckets(framework, cost.Range); buckets > cost.Buckets {
+			cost.Buckets = buckets
+		}
+	}
+	return cost
+}
+
+// DownSample Enlarge the instruction samplers spans, or reduce their counts, so that each one returns at most maxBuckets
+// buckets per series. Returns whether a sampler was changed
+func (protoParser *ProtoParser) DownSample(instruction *Instruction, now time.Time, defaultType string, maxBuckets int64) bool {
+	changed := false
+
+	if instruction.isGlobalOperator {
+		for _, operand := range instruction.globalOperator.instructions {
+			if protoParser.DownSample(operand, now, defaultType, maxBuckets) {
+				changed = true
+			}
+		}
+		return changed
+	}
+
+	selectRange, _ := protoParser.selectRange(*instruction, now, defaultType)
+
+	// Copy the frameworks and their attributes as they can be shared with a variable instruction
+	frameworks := append([]FrameworkStatement{}, instruction.selectStatement.frameworks...)
+	for index, framework := range frameworks {
+		if samplerBuckets(framework, selectRange) <= maxBuckets {
+			continue
+		}
+
+		attributes := make(map[PrefixAttributes]InternalField, len(framework.attributes))
+		for key, value := range framework.attributes {
+			attributes[key] = value
+		}
+
+		if count, hasCount := attributes[SampleAuto]; hasCount {
+			count.lit = strconv.FormatInt(maxBuckets, 10)
+			attributes[SampleAuto] = count
+		} else {
+			span := math.Ceil(selectRange / float64(maxBuckets))
+			attributes[SampleSpan] = InternalField{tokenType: DURATIONVAL, lit: strconv.FormatFloat(span, 'f', -1, 64) + "s"}
+		}
+
+		frameworks[index].attributes = attributes
+		changed = true
+	}
+
+	instruction.selectStatement.frameworks = frameworks
+	return changed
+}
+
+// Get the time range of a select in seconds, and whether it could be estimated
+func (protoParser *ProtoParser) selectRange(instruction Instruction, now time.Time, defaultType string) (float64, bool) {
+	selectStatement := instruction.selectStatement
+
+	if selectStatement.hasLast && selectStatement.last.isDuration {
+		seconds, err := durationSeconds(selectStatement.last.last)
+		return seconds, err == nil
+	}
+
+	if !selectStatement.hasFrom {
+		return 0, false
+	}
+
+	ticksPerSecond, err := protoParser.dateTicks(instruction, defaultType)
+	if err != nil {
+		return 0, false
+	}
+
+	start, okStart := costTime(selectStatement.from.from, now, ticksPerSecond)
+	end, okEnd := now, true
+	if selectStatement.from.hasTo {
+		end, okEnd = costTime(selectStatement.from.to, now, ticksPerSecond)
+	}
+	if !okStart || !okEnd {
+		return 0, false
+	}
+	return math.Max(0, end.Sub(start).Seconds()), true
+}
+
+// Get the ticks per second of an instruction integer dates: Prometheus ones are in seconds, Warp 10 ones in platform ticks
+func (protoParser *ProtoParser) dateTicks(instruction Instruction, defaultType string) (int64, error) {
+	connectType := instruction.connectStatement.connectType
+	if connectType == "" {
+		connectType = defaultType
+	}
+	if connectType == WARP.String() {
+		return TimeUnitTicks(protoParser.EndpointTimeUnit(instruction.connectStatement.api))
+	}
+	return 1, nil
+}
+
+// FixedEnd return the end date of an instruction when all its selects time ranges are fixed dates, and none of its
+// methods depends on now or stores the series in the back-end: its result won't change once its back-end holds all
+// points until this end
+func (protoParser *ProtoParser) FixedEnd(instruction Instruction, defaultType string) (time.Time, bool) {
+	if usesNow(instruction.selectStatement.frameworks) {
+		return time.Time{}, false
+	}
+	for _, framework := range instruction.selectStatement.frameworks {
+		if framework.operator == STORE && !isSinkStore(framework) {
+			return time.Time{}, false
+		}
+	}
+
+	if instruction.isGlobalOperator {
+		end := time.Time{}
+		for _, operand := range instruction.globalOperator.instructions {
+			operandEnd, ok := protoParser.FixedEnd(*operand, defaultType)
+			if !ok {
+				return time.Time{}, false
+			}
+			if operandEnd.After(end) {
+				end = operandEnd
+			}
+		}
+		return end, len(instruction.globalOperator.instructions) > 0
+	}
+
+	selectStatement := instruction.selectStatement
+	if !instruction.hasSelect || instruction.isMeta || selectStatement.isVariable || !selectStatement.hasFrom || !selectStatement.from.hasTo {
+		return time.Time{}, false
+	}
+
+	ticksPerSecond, err := protoParser.dateTicks(instruction, defaultType)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	// Time expressions evaluated from now, as now - 1d, are dates of the current query only
+	for _, field := range []InternalField{selectStatement.from.from, selectStatement.from.to} {
+		if field.isRelative || (field.tokenType != STRING && field.tokenType != INTEGER && field.tokenType != NUMBER) {
+			return time.Time{}, false
+		}
+	}
+	if _, ok := costTime(selectStatement.from.from, time.Time{}, ticksPerSecond); !ok {
+		return time.Time{}, false
+	}
+	return costTime(selectStatement.from.to, time.Time{}, ticksPerSecond)
+}
+
+// Check if a field of the methods is now
+func usesNow(frameworks []FrameworkStatement) bool {
+	isNow := func(field InternalField) bool {
+		if field.tokenType == NOW {
+			return true
+		}
+		for _, item := range field.fieldList {
+			if item.tokenType == NOW {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, framework := range frameworks {
+		for _, field := range framework.attributes {
+			if isNow(field) {
+				return true
+			}
+		}
+		for _, field := range framework.unNamedAttributes {
+			if isNow(field) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Get the buckets count of a sampler on a time range in seconds, 0 for other operators
+func samplerBuckets(framework FrameworkStatement, selectRange float64) int64 {
+	if framework.operator != SAMPLEBY && framework.operator != SAMPLE {
+		return 0
+	}
+
+	if count, ok := framework.attributes[SampleAuto]; ok {
+		if buckets, err := strconv.ParseInt(count.lit, 10, 64); err == nil {
+			return buckets
+		}
+	}
+
+	if span, ok := framework.attributes[SampleSpan]; ok && span.tokenType != NATIVEVARIABLE && selectRange > 0 {
+		if seconds, err := durationSeconds(span.lit); err == nil && seconds > 0 {
+			return int64(math.Ceil(selectRange / seconds))
+		}
+	}
+	return 0
+}
+
+// Get the date of a from field, integer dates are read in ticks
+func costTime(field InternalField, now time.Time, ticksPerSecond int64) (time.Time, bool) {
+	switch field.tokenType {
+	case NOW:
+		return now, true
+	case STRING:
+		date, err := time.Parse(time.RFC3339Nano, field.lit)
+		return date, err == nil
+	case INTEGER, NUMBER:
+		ticks, err := strconv.ParseFloat(field.lit, 64)
+		if err != nil {
+			return now, false
+		}
+		return time.Unix(0, int64(ticks/float64(ticksPerSecond)*float64(time.Second))), true
+	}
+	return now, false
+}
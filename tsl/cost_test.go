@@ -0,0 +1,156 @@
+package tsl
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEstimateCostTimeUnit(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// One hour between integer dates, in ticks of each platform time unit
+	tests := []struct {
+		timeUnit string
+		query    string
+	}{
+		{"ns", `select("cpu").from(1346846400000000000, to=1346850000000000000)`},
+		{"us", `select("cpu").from(1346846400000000, to=1346850000000000)`},
+		{"ms", `select("cpu").from(1346846400000, to=1346850000000)`},
+	}
+
+	for _, test := range tests {
+		instructions := parseInstructions(t, test.query)
+
+		protoParser := ProtoParser{Name: "admission", EndpointTimeUnits: map[string]string{"http://127.0.0.1:8080": test.timeUnit}}
+		cost := protoParser.EstimateCost(instructions[0], now, WARP.String())
+		if cost.Range != 3600 {
+			t.Errorf("time unit %q: expected a 3600s range, got %v", test.timeUnit, cost.Range)
+		}
+
+		protoParser = ProtoParser{Name: "admission", TimeUnit: test.timeUnit}
+		cost = protoParser.EstimateCost(instructions[0], now, WARP.String())
+		if cost.Range != 3600 {
+			t.Errorf("default time unit %q: expected a 3600s range, got %v", test.timeUnit, cost.Range)
+		}
+	}
+}
+
+func TestEstimateCostPrometheusSeconds(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	instructions := parseInstructions(t, `select("cpu").from(1346846400, to=1346850000)`)
+
+	// Prometheus integer dates are seconds, whatever the Warp 10 time unit
+	protoParser := ProtoParser{Name: "admission", TimeUnit: "ms"}
+	cost := protoParser.EstimateCost(instructions[0], now, PROMETHEUS.String())
+	if cost.Range != 3600 {
+		t.Errorf("expected a 3600s range, got %v", cost.Range)
+	}
+}
+
+func TestFixedEnd(t *testing.T) {
+	tests := []struct {
+		query string
+		fixed bool
+	}{
+		{`select("cpu").from("2020-01-01T00:00:00Z", to="2020-01-02T00:00:00Z")`, true},
+		{`select("cpu").from(startOfDay("2020-01-02") - 1d, to="2020-01-02")`, true},
+		{`select("cpu").from(1577836800000000, to=1577923200000000)`, true},
+		{`select("cpu").from("2020-01-01T00:00:00Z")`, false},
+		{`select("cpu").last(1d)`, false},
+		// Dates evaluated from now change with each query
+		{`select("cpu").from(now - 7d, to=now - 1d)`, false},
+		{`select("cpu").from("2020-01-01", to=startOfDay(now))`, false},
+		{`select("cpu").from(startOfMonth(now) - 1M, to="2020-01-02")`, false},
+		{`select("cpu").from("2020-01-01T00:00:00Z", to="2020-01-02T00:00:00Z").timeclip(now, 1h)`, false},
+		{`add(select("a").from("2020-01-01", to="2020-01-02"), select("b").from("2020-01-01", to=now - 1d))`, false},
+	}
+
+	protoParser := ProtoParser{Name: "cache"}
+	for _, test := range tests {
+		_, fixed := protoParser.FixedEnd(parseInstructions(t, test.query)[0], WARP.String())
+		if fixed != test.fixed {
+			t.Errorf("%s: expected a fixed end to be %v", test.query, test.fixed)
+		}
+	}
+
+	end, _ := protoParser.FixedEnd(parseInstructions(t, `add(select("a").from("2020-01-01", to="2020-01-02"), select("b").from("2020-01-01", to="2020-01-03"))`)[0], WARP.String())
+	if !end.Equal(time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the latest operand end, got %s", end)
+	}
+}
+
+func TestEstimateCost(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		query string
+		cost  Cost
+	}{
+		{`select("cpu").last(1h)`, Cost{Selects: 1, Range: 3600}},
+		{`select(*).last(1h)`, Cost{Selects: 1, SelectAll: 1, Range: 3600}},
+		{`select("cpu").last(100)`, Cost{Selects: 1, LastPoints: 100}},
+		{`select("cpu").from("2019-12-31T00:00:00Z")`, Cost{Selects: 1, Range: 86400}},
+		{`select("cpu").from("2019-12-01T00:00:00Z", to="2019-12-02T00:00:00Z").sampleBy(1m, max)`, Cost{Selects: 1, Range: 86400, Buckets: 1440}},
+		{`select("cpu").last(1d).sampleBy(30, max)`, Cost{Selects: 1, Range: 86400, Buckets: 30}},
+		{`select("cpu")`, Cost{Selects: 1, UnknownRange: true}},
+		{`select("cpu").names()`, Cost{Selects: 1}},
+		{`add(select("a").last(1h), select("b").last(2h).sampleBy(1m, max), select("c").last(10))`, Cost{Selects: 3, Range: 7200, LastPoints: 10, Buckets: 120}},
+		{`add(select("a").last(1h), select("b"))`, Cost{Selects: 2, Range: 3600, UnknownRange: true}},
+	}
+
+	protoParser := ProtoParser{Name: "admission"}
+	for _, test := range tests {
+		cost := protoParser.EstimateCost(parseInstructions(t, test.query)[0], now, WARP.String())
+		if cost != test.cost {
+			t.Errorf("%s: expected a cost of %+v, got %+v", test.query, test.cost, cost)
+		}
+	}
+}
+
+func TestEstimateCostNativeVariables(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	parser, err := NewParser(strings.NewReader(`select("cpu").from(start, to=end)`), "http://127.0.0.1:8080", "TOKEN", 0, "", "", []string{"start", "end"})
+	if err != nil {
+		t.Fatalf("unexpected parser error: %v", err)
+	}
+	parsed, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+
+	// The variables values are only known by the back-end
+	protoParser := ProtoParser{Name: "admission"}
+	cost := protoParser.EstimateCost(*parsed.Statements[0], now, WARP.String())
+	if !cost.UnknownRange {
+		t.Errorf("expected an unknown range on native variables dates, got %+v", cost)
+	}
+}
+
+func TestDownSample(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		query   string
+		changed bool
+		buckets int64
+	}{
+		{`select("cpu").last(1d).sampleBy(1m, max)`, true, 100},
+		{`select("cpu").last(1d).sampleBy(1000, max)`, true, 100},
+		{`select("cpu").last(1h).sampleBy(1m, max)`, false, 60},
+		{`select("cpu").last(1d).sampleBy(50, max)`, false, 50},
+		{`add(select("a").last(1h).sampleBy(1m, max), select("b").last(1d).sampleBy(1m, max))`, true, 100},
+	}
+
+	protoParser := ProtoParser{Name: "admission"}
+	for _, test := range tests {
+		instruction := parseInstructions(t, test.query)[0]
+		if changed := protoParser.DownSample(&instruction, now, WARP.String(), 100); changed != test.changed {
+			t.Errorf("%s: expected a down-sampling to be %v", test.query, test.changed)
+		}
+		if cost := protoParser.EstimateCost(instruction, now, WARP.String()); cost.Buckets != test.buckets {
+			t.Errorf("%s: expected %d buckets, got %d", test.query, test.buckets, cost.Buckets)
+		}
+	}
+}
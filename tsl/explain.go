@@ -0,0 +1,147 @@
+package tsl
+
+import (
+	"time"
+)
+
+// Plan describes how a TSL statement is executed on its back-end
+type Plan struct {
+	Backend       string   `json:"backend"`
+	Endpoint      string   `json:"endpoint"`
+	Start         string   `json:"start,omitempty"`
+	End           string   `json:"end,omitempty"`
+	Step          string   `json:"step,omitempty"`
+	Native        string   `json:"native"`
+	PushedDown    []string `json:"pushedDown"`
+	PostProcessed []string `json:"postProcessed"`
+	Fetches       int      `json:"fetches"`
+	Cost          *Cost    `json:"cost,omitempty"`
+}
+
+// ExplainWarpScript Generate the execution plan of an instruction on a Warp 10 back-end
+func (protoParser *ProtoParser) ExplainWarpScript(instruction Instruction, allowAuthenticate bool) (*Plan, error) {
+	warpScript, err := protoParser.GenerateWarpScript([]Instruction{instruction}, allowAuthenticate)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := protoParser.newPlan(instruction, WARP.String(), warpScript)
+
+	// Warp 10 time range is resolved on the back-end, explain it relatively to now
+	selectStatement := protoParser.getTimeStatement(instruction)
+	if selectStatement.hasFrom {
+		plan.Start = explainTime(selectStatement.from.from)
+		plan.End = "now"
+		if selectStatement.from.hasTo {
+			plan.End = explainTime(selectStatement.from.to)
+		}
+	} else if selectStatement.hasLast {
+		plan.End = "now"
+		if val, ok := selectStatement.last.options[LastTimestamp]; ok {
+			plan.End = explainTime(val)
+		}
+		if val, ok := selectStatement.last.options[LastShift]; ok {
+			plan.End += " - " + val.lit
+		}
+		if selectStatement.last.isDuration {
+			plan.Start = plan.End + " - " + selectStatement.last.last
+		}
+	}
+
+	for _, framework := range selectStatement.frameworks {
+		if framework.operator != SAMPLEBY && framework.operator != SAMPLE {
+			continue
+		}
+		if span, ok := framework.attributes[SampleSpan]; ok {
+			plan.Step = span.lit
+		}
+		break
+	}
+
+	return plan, nil
+}
+
+// ExplainPromQl Generate the execution plan of an instruction on a Prometheus back-end
+func (protoParser *ProtoParser) ExplainPromQl(instruction Instruction, now time.Time) (*Plan, error) {
+	promQl, err := protoParser.GeneratePromQl(instruction, now)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := protoParser.newPlan(instruction, PROMETHEUS.String(), promQl.Query)
+	plan.Start = promQl.Start
+	plan.End = promQl.End
+	plan.Step = promQl.Step
+
+	return plan, nil
+}
+
+// Load the plan fields common to all back-ends
+func (protoParser *ProtoParser) newPlan(instruction Instruction, backend string, native string) *Plan {
+	plan := &Plan{
+		Backend:       backend,
+		Endpoint:      instruction.GetConnectAPI(),
+		Native:        native,
+		PushedDown:    []string{},
+		PostProcessed: []string{},
+	}
+
+	// All operators are executed by the back-end
+	plan.PushedDown = explainFrameworks(instruction, plan.PushedDown)
+
+	// A store to a sink is written by TSL once the back-end result is received
+	if instruction.GetStoreSink() != nil {
+		plan.PushedDown = plan.PushedDown[:len(plan.PushedDown)-1]
+		plan.PostProcessed = append(plan.PostProcessed, STORE.String())
+	}
+
+	// Meta-data statements find series without fetching their points
+	if instruction.IsMeta() {
+		return plan
+	}
+
+	// Identical fetches of a statement are executed once
+	counts := make(map[string]int)
+	fetches := []string{}
+	if err := protoParser.countFetches([]Instruction{instruction}, counts, &fetches); err == nil {
+		plan.Fetches = len(fetches)
+	}
+
+	return plan
+}
+
+// Get the select statement holding the time range of an instruction
+func (protoParser *ProtoParser) getTimeStatement(instruction Instruction) SelectStatement {
+	if instruction.isGlobalOperator && len(instruction.globalOperator.instructions) > 0 {
+		inner := protoParser.getTimeStatement(*instruction.globalOperator.instructions[0])
+		inner.frameworks = append(inner.frameworks, instruction.selectStatement.frameworks...)
+		return inner
+	}
+	return instruction.selectStatement
+}
+
+// List the operators names of an instruction
+func explainFrameworks(instruction Instruction, operators []string) []string {
+	if instruction.isGlobalOperator {
+		for _, gOpInstruction := range instruction.globalOperator.instructions {
+			operators = explainFrameworks(*gOpInstruction, operators)
+		}
+		operators = append(operators, instruction.globalOperator.operator.String())
+	}
+
+	for _, framework := range instruction.selectStatement.frameworks {
+		operators = append(operators, framework.operator.String())
+	}
+	return operators
+}
+
+// Get a readable time value
+func explainTime(field InternalField) string {
+	if field.tokenType == NOW {
+		return "now"
+	}
+	if field.tokenType == NATIVEVARIABLE {
+		return "$" + field.lit
+	}
+	return field.lit
+}
@@ -0,0 +1,30 @@
+package tsl
+
+import (
+	"testing"
+)
+
+func TestExplainWarpScriptFetches(t *testing.T) {
+	tests := []struct {
+		query   string
+		fetches int
+	}{
+		{`select("cpu").last(1h)`, 1},
+		{`select("cpu").names()`, 0},
+		{`select("cpu").labels("host")`, 0},
+		{`add(select("cpu").last(1h), select("mem").last(1h))`, 2},
+	}
+
+	for _, test := range tests {
+		instructions := parseInstructions(t, test.query)
+
+		protoParser := ProtoParser{Name: "warp 10"}
+		plan, err := protoParser.ExplainWarpScript(instructions[0], false)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.query, err)
+		}
+		if plan.Fetches != test.fetches {
+			t.Errorf("%s: expected %d fetches, got %d", test.query, test.fetches, plan.Fetches)
+		}
+	}
+}
@@ -35,6 +35,12 @@ var toPromQl = [...]string{
 	SORTDESC:       "sort_desc",
 	TOPN:           "topk",
 	BOTTOMN:        "bottomk",
+	POW:            "^",
+	MOD:            "%",
+
+	HISTOGRAMQUANTILE: "histogram_quantile",
+	HOLTWINTERS:       "holt_winters",
+	PREDICTLINEAR:     "predict_linear",
 }
 
 // Ql main syntax
@@ -53,6 +59,11 @@ func (protoParser *ProtoParser) GeneratePromQl(instruction Instruction, now time
 
 	promql := &Ql{}
 
+	if instruction.GetCrossBackendOperator() != nil {
+		message := "operator " + instruction.globalOperator.operator.String() + " between series of different back-ends can only be computed by the TSL proxy"
+		return nil, protoParser.NewProtoError(message, instruction.globalOperator.pos)
+	}
+
 	if instruction.hasSelect {
 		return protoParser.promSelectQuery(instruction, now)
 	} else if instruction.isGlobalOperator {
@@ -203,6 +214,11 @@ func (protoParser *ProtoParser) promSelectQuery(instruction Instruction, now tim
 			if err != nil {
 				return nil, err
 			}
+
+			promql.Start, err = protoParser.promCalendarStart(instruction.selectStatement.frameworks[0], promql)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -245,6 +261,29 @@ func promWhereFields(query string, fields []WhereField) string {
 	return buffer.String()
 }
 
+// Align daily and weekly sampling query start on the sampler timezone midnight
+func (protoParser *ProtoParser) promCalendarStart(sampleBy FrameworkStatement, promql *Ql) (string, error) {
+	timezone, hasTimezone := sampleBy.attributes[Timezone]
+	if !hasTimezone {
+		return promql.Start, nil
+	}
+
+	if !strings.HasSuffix(promql.Step, "d") && !strings.HasSuffix(promql.Step, "w") {
+		return promql.Start, nil
+	}
+
+	location, err := protoParser.promLocation(timezone, sampleBy.pos)
+	if err != nil {
+		return "", err
+	}
+
+	start := promTime(promql.Start).In(location)
+	midnight := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, location)
+
+	startSeconds := float64(midnight.UnixNano()/int64(time.Millisecond)) / 1000.0
+	return strconv.FormatFloat(startSeconds, 'f', -1, 64), nil
+}
+
 // Load promQL sampleBy
 func (protoParser *ProtoParser) promSampleBy(sampleBy FrameworkStatement) (string, error) {
 	if agg, hasAggregator := sampleBy.attributes[SampleAggregator]; hasAggregator {
@@ -280,6 +319,18 @@ func (protoParser *ProtoParser) promFrameworksOp(frameworks []FrameworkStatement
 			continue
 		}
 
+		// A store is written by TSL on the statement result, to its sink or by remote write with a token
+		if framework.operator == STORE {
+			if index != len(frameworks)-1 {
+				message := "store must be the last method of a Prometheus statement"
+				if isSinkStore(framework) {
+					message = "a store to a " + framework.unNamedAttributes[0].lit + " sink must be the last method of a statement"
+				}
+				return "", hasKeepLastValue, protoParser.NewProtoError(message, framework.pos)
+			}
+			continue
+		}
+
 		if hasKeepLastValue {
 			message := "keepLastValues need to be the last method call on a Prometheus query"
 			return "", hasKeepLastValue, protoParser.NewProtoError(message, framework.pos)
@@ -301,7 +352,7 @@ func (protoParser *ProtoParser) promFrameworksOp(frameworks []FrameworkStatement
 			message := "sampling must be the first operation set"
 			return "", hasKeepLastValue, protoParser.NewProtoError(message, framework.pos)
 
-		case ADDSERIES, ANDL, SUBSERIES, MULSERIES, DIVSERIES, EQUAL, GREATEROREQUAL, GREATERTHAN, NOTEQUAL, LESSOREQUAL, LESSTHAN, ORL:
+		case ADDSERIES, ANDL, SUBSERIES, MULSERIES, DIVSERIES, EQUAL, GREATEROREQUAL, GREATERTHAN, NOTEQUAL, LESSOREQUAL, LESSTHAN, ORL, MOD, POW:
 			suffixGroup, err := protoParser.promArithmeticOperators(framework)
 			if err != nil {
 				return "", hasKeepLastValue, err
@@ -335,6 +386,34 @@ func (protoParser *ProtoParser) promFrameworksOp(frameworks []FrameworkStatement
 			buffer.WriteString(promStatement)
 			hasWindowMapper = true
 
+		case DERIV, HOLTWINTERS, PREDICTLINEAR:
+
+			if hasWindowMapper {
+				message := "over_time " + framework.operator.String() + " methods can be done only once per query"
+				return "", hasKeepLastValue, protoParser.NewProtoError(message, framework.pos)
+			}
+
+			promStatement, err := protoParser.promTrend(promql.Query, framework, hasOffset, offset, promql.Step)
+			if err != nil {
+				return "", hasKeepLastValue, err
+			}
+			buffer.WriteString(promStatement)
+			hasWindowMapper = true
+
+		case BANDS, OUTLIERS, ZSCORE:
+
+			if hasWindowMapper {
+				message := "over_time " + framework.operator.String() + " methods can be done only once per query"
+				return "", hasKeepLastValue, protoParser.NewProtoError(message, framework.pos)
+			}
+
+			promStatement, err := protoParser.promAnomaly(promql, framework, hasOffset, offset)
+			if err != nil {
+				return "", hasKeepLastValue, err
+			}
+			buffer.WriteString(promStatement)
+			hasWindowMapper = true
+
 		case GROUPBY, GROUP, GROUPWITHOUT:
 			promStatement, suffixGroup, err := protoParser.promGroup(framework)
 			suffix.WriteString(suffixGroup)
@@ -343,7 +422,32 @@ func (protoParser *ProtoParser) promFrameworksOp(frameworks []FrameworkStatement
 			}
 			prefix = append(prefix, promStatement)
 
-		case ABS, DAY, LN, LOG2, LOG10, CEIL, FLOOR, ROUND, HOUR, MAXWITH, MINUTE, MINWITH, MONTH, SQRT, RESETS, TIMESTAMP, YEAR, WEEKDAY, SORT, SORTDESC, TOPN, BOTTOMN:
+		case DAY, HOUR, MINUTE, MONTH, WEEKDAY, YEAR:
+			promStatement, suffixGroup, err := protoParser.promCalendar(framework, promql)
+			suffix.WriteString(suffixGroup)
+			if err != nil {
+				return "", hasKeepLastValue, err
+			}
+
+			// Append to request prefix
+			prefix = append(prefix, promStatement)
+
+		case HISTOGRAMFRACTION:
+			expression := promExpression(prefix, buffer.String(), suffix.String(), promql.Query, hasWindowMapper, hasOffset, offset)
+			fraction, err := protoParser.promHistogramFraction(expression, framework)
+			if err != nil {
+				return "", hasKeepLastValue, err
+			}
+
+			// The fraction is the new query body, later methods are applied on it
+			prefix = make([]string, 0)
+			suffix.Reset()
+			buffer.Reset()
+			buffer.WriteString(fraction)
+			hasWindowMapper = true
+
+		case ABS, LN, LOG2, LOG10, CEIL, FLOOR, ROUND, MAXWITH, MINWITH, SQRT, RESETS, TIMESTAMP, SORT, SORTDESC, TOPN, BOTTOMN,
+			HISTOGRAMQUANTILE, CLAMP, COS, EXP, SGN, SIN, TAN:
 			promStatement, suffixGroup, err := protoParser.promOperator(framework)
 			suffix.WriteString(suffixGroup)
 			if err != nil {
@@ -360,29 +464,61 @@ func (protoParser *ProtoParser) promFrameworksOp(frameworks []FrameworkStatement
 
 	}
 
+	return promExpression(prefix, buffer.String(), suffix.String(), promql.Query, hasWindowMapper, hasOffset, offset), hasKeepLastValue, nil
+}
+
+// promExpression assembles the query of the methods generated so far around the statement selector
+func promExpression(prefix []string, body string, suffix string, query string, hasWindowMapper bool, hasOffset bool, offset string) string {
 	// Reverse prefix string array
-	last := len(prefix) - 1
-	for i := 0; i < len(prefix)/2; i++ {
-		prefix[i], prefix[last-i] = prefix[last-i], prefix[i]
+	reversed := make([]string, len(prefix))
+	for i := range prefix {
+		reversed[len(prefix)-1-i] = prefix[i]
 	}
 
 	// Returned sampled metrics
 	if hasWindowMapper {
-		resString := strings.Join(prefix, "") + buffer.String() + suffix.String()
-		return resString, hasKeepLastValue, nil
+		return strings.Join(reversed, "") + body + suffix
 	}
 
 	// Returned shifted metrics
 	if hasOffset {
-		buffer.WriteString(promql.Query + " offset " + offset + ")")
-
-		resString := strings.Join(prefix, "") + buffer.String() + suffix.String()
-		return resString, hasKeepLastValue, nil
+		return strings.Join(reversed, "") + body + query + " offset " + offset + ")" + suffix
 	}
 
 	// Return operatored metrics
-	resString := strings.Join(prefix, "") + promql.Query + suffix.String()
-	return resString, hasKeepLastValue, nil
+	return strings.Join(reversed, "") + query + suffix
+}
+
+// promHistogramFraction generate the fraction of observations between two bounds from classic buckets series:
+// the difference of the upper and lower bounds buckets divided by the +Inf bucket. Bounds must be buckets le values,
+// a missing lower bucket counting as 0 when the lower bound is not positive
+func (protoParser *ProtoParser) promHistogramFraction(expression string, framework FrameworkStatement) (string, error) {
+	bounds := make([]string, 2)
+	for index := range bounds {
+		bound := framework.unNamedAttributes[index]
+		if bound.tokenType == NATIVEVARIABLE {
+			message := framework.operator.String() + " doesn't support native variables in TSL for " + protoParser.Name
+			return "", protoParser.NewProtoError(message, framework.pos)
+		}
+		value, err := strconv.ParseFloat(bound.lit, 64)
+		if err != nil {
+			message := framework.operator.String() + " expects number bounds"
+			return "", protoParser.NewProtoError(message, framework.pos)
+		}
+		bounds[index] = strconv.FormatFloat(value, 'f', -1, 64)
+	}
+
+	// Select a bucket by joining the series, with le values normalized as "1" for "1.0", on a constant vector holding its le
+	bucket := func(le string) string {
+		return fmt.Sprintf("sum without(le) (label_replace(%s, \"le\", \"$1\", \"le\", \"(.+)\\\\.0+\") * on(le) group_left() label_replace(vector(1), \"le\", %q, \"\", \"\"))", expression, le)
+	}
+
+	lower := bucket(bounds[0])
+	if !strings.HasPrefix(bounds[0], "-") && bounds[0] != "0" {
+		return "((" + bucket(bounds[1]) + " - " + lower + ") / " + bucket("+Inf") + ")", nil
+	}
+	upper := bucket(bounds[1])
+	return "((" + upper + " - (" + lower + " or " + upper + " * 0)) / " + bucket("+Inf") + ")", nil
 }
 
 func (protoParser *ProtoParser) promArithmeticOperators(framework FrameworkStatement) (string, error) {
@@ -422,9 +558,25 @@ func (protoParser *ProtoParser) promOperator(framework FrameworkStatement) (stri
 		operator = toPromQl[framework.operator]
 		suffix = "," + framework.attributes[MapperValue].lit + ")"
 
+	case CLAMP:
+		suffix = "," + framework.unNamedAttributes[0].lit + "," + framework.unNamedAttributes[1].lit + ")"
+		return operator + prefix, suffix, nil
+
 	case TOPN, BOTTOMN:
 		operator = toPromQl[framework.operator]
 		prefix = prefix + framework.attributes[NValue].lit + ","
+
+	case HISTOGRAMQUANTILE:
+		operator = toPromQl[framework.operator]
+		for index := 0; index < len(framework.unNamedAttributes); index++ {
+			bound := framework.unNamedAttributes[index]
+			if bound.tokenType == NATIVEVARIABLE {
+				message := framework.operator.String() + " doesn't support native variables in TSL for " + protoParser.Name
+				return "", "", protoParser.NewProtoError(message, framework.pos)
+			}
+			prefix = prefix + bound.lit + ","
+		}
+		return operator + prefix, suffix, nil
 	}
 
 	if len(framework.unNamedAttributes) > 0 {
@@ -437,6 +589,60 @@ func (protoParser *ProtoParser) promOperator(framework FrameworkStatement) (stri
 	return operator + prefix, suffix, nil
 }
 
+// promCalendar generate a calendar function, shifting values of the timezone offset at query end
+// The offset is fixed: points before a daylight saving time change inside the query range are shifted by the offsets difference
+func (protoParser *ProtoParser) promCalendar(framework FrameworkStatement, promql *Ql) (string, string, error) {
+	operator, suffix, err := protoParser.promOperator(framework)
+	if err != nil {
+		return "", "", err
+	}
+
+	timezone, hasTimezone := framework.attributes[Timezone]
+	if !hasTimezone {
+		return operator, suffix, nil
+	}
+
+	location, err := protoParser.promLocation(timezone, framework.pos)
+	if err != nil {
+		return "", "", err
+	}
+
+	_, offset := promTime(promql.End).In(location).Zone()
+	if offset == 0 {
+		return operator, suffix, nil
+	}
+	if offset < 0 {
+		return operator, " - " + strconv.Itoa(-offset) + suffix, nil
+	}
+	return operator, " + " + strconv.Itoa(offset) + suffix, nil
+}
+
+// promLocation load a timezone location
+func (protoParser *ProtoParser) promLocation(timezone InternalField, pos Pos) (*time.Location, error) {
+	if timezone.tokenType == NATIVEVARIABLE {
+		message := "timezone doesn't support native variables in TSL for " + protoParser.Name
+		return nil, protoParser.NewProtoError(message, pos)
+	}
+
+	location, err := time.LoadLocation(timezone.lit)
+	if err != nil {
+		message := "unvalid timezone " + timezone.lit
+		return nil, protoParser.NewProtoError(message, pos)
+	}
+	return location, nil
+}
+
+// promTime parse a query start or end time, when it can't be parsed returns current time
+func promTime(value string) time.Time {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second)))
+	}
+	if date, err := time.Parse(time.RFC3339, value); err == nil {
+		return date
+	}
+	return time.Now()
+}
+
 func (protoParser *ProtoParser) promGroup(framework FrameworkStatement) (string, string, error) {
 	// Set current operator
 	operator := framework.attributes[Aggregator].lit
@@ -567,3 +773,133 @@ func (protoParser *ProtoParser) promOverTime(query string, framework FrameworkSt
 
 	return functionName, nil
 }
+
+// promTrend generate a deriv, predict_linear or holt_winters statement on the window range (equals to step by default)
+func (protoParser *ProtoParser) promTrend(query string, framework FrameworkStatement, hasShift bool, offset string, step string) (string, error) {
+
+	span := step
+	if window, hasWindow := framework.attributes[MapperSampling]; hasWindow {
+		span = window.lit
+	}
+
+	operator := framework.operator.String()
+	if framework.operator != DERIV {
+		operator = toPromQl[framework.operator]
+	}
+
+	functionName := operator + "(" + query + "[" + span + "]"
+
+	if hasShift {
+		functionName = functionName + " offset " + offset
+	}
+
+	switch framework.operator {
+	case PREDICTLINEAR:
+		seconds, err := promDurationSeconds(framework.attributes[MapperValue].lit)
+		if err != nil {
+			message := framework.operator.String() + " expects a valid duration: " + err.Error()
+			return "", protoParser.NewProtoError(message, framework.pos)
+		}
+		functionName = functionName + "," + seconds
+	case HOLTWINTERS:
+		functionName = functionName + "," + framework.unNamedAttributes[0].lit + "," + framework.unNamedAttributes[1].lit
+	}
+
+	return functionName + ")", nil
+}
+
+// promAnomaly generate a zscore, an outliers or a bands statement based on avg_over_time, stddev_over_time and quantile_over_time.
+// Without window, the statistics are computed once on the complete query range evaluated at its end, as Warp 10 does on the complete series
+func (protoParser *ProtoParser) promAnomaly(promql *Ql, framework FrameworkStatement, hasShift bool, offset string) (string, error) {
+
+	var span string
+	window, hasWindow := framework.attributes[MapperSampling]
+	if hasWindow {
+		span = window.lit
+	} else {
+		start, startErr := strconv.ParseFloat(promql.Start, 64)
+		end, endErr := strconv.ParseFloat(promql.End, 64)
+		if startErr != nil || endErr != nil || end <= start {
+			message := framework.operator.String() + " expects a window duration when query range can't be computed"
+			return "", protoParser.NewProtoError(message, framework.pos)
+		}
+		span = strconv.FormatInt(int64(end-start), 10) + "s"
+	}
+
+	sample := promql.Query
+	rangeSelector := promql.Query + "[" + span + "]"
+	if hasShift {
+		sample = sample + " offset " + offset
+		rangeSelector = rangeSelector + " offset " + offset
+	}
+	if !hasWindow {
+		rangeSelector = rangeSelector + " @ end()"
+	}
+
+	mean := "avg_over_time(" + rangeSelector + ")"
+	stddev := "stddev_over_time(" + rangeSelector + ")"
+
+	switch framework.operator {
+	case ZSCORE:
+		return "((" + sample + " - " + mean + ") / " + stddev + ")", nil
+
+	case OUTLIERS:
+		if framework.unNamedAttributes[0].lit != "mad" {
+			message := "the " + framework.unNamedAttributes[0].lit + " method of " + framework.operator.String() + " is an iterative test not available in TSL for " + protoParser.Name + ", use the mad method"
+			return "", protoParser.NewProtoError(message, framework.pos)
+		}
+
+		// Modified z-score: deviation to the median divided by the median absolute deviation scaled to the standard deviation
+		median := "quantile_over_time(0.5, " + rangeSelector + ")"
+		deviation := "abs(" + sample + " - " + median + ")"
+		mad := "(1.4826 * quantile_over_time(0.5, " + deviation + "[" + span + ":" + promql.Step + "] @ end()))"
+		threshold := framework.attributes[MapperValue].lit
+
+		asBoolean, hasBoolean := framework.unNamedAttributes[2]
+		if hasBoolean && asBoolean.tokenType == TRUE {
+			return "(" + deviation + " / " + mad + " > bool " + threshold + ")", nil
+		}
+		return "(" + sample + " and " + deviation + " / " + mad + " > " + threshold + ")", nil
+	}
+
+	deviation := framework.attributes[MapperValue].lit + " * " + stddev
+	upper := "label_replace(" + mean + " + " + deviation + ", \"band\", \"upper\", \"\", \"\")"
+	lower := "label_replace(" + mean + " - " + deviation + ", \"band\", \"lower\", \"\", \"\")"
+
+	return "(" + upper + " or " + lower + ")", nil
+}
+
+// promDurationSeconds convert a TSL duration into a number of seconds
+func promDurationSeconds(duration string) (string, error) {
+	seconds, err := durationSeconds(duration)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(seconds, 'f', -1, 64), nil
+}
+
+// durationSeconds convert a TSL duration into a float number of seconds
+func durationSeconds(duration string) (float64, error) {
+	unit := strings.TrimLeft(duration, "-0123456789.")
+	value, err := strconv.ParseFloat(strings.TrimSuffix(duration, unit), 64)
+	if err != nil {
+		return 0, err
+	}
+
+	toSeconds := map[string]float64{
+		"w":  7 * 24 * 3600,
+		"d":  24 * 3600,
+		"h":  3600,
+		"m":  60,
+		"s":  1,
+		"ms": 1e-3,
+		"us": 1e-6,
+		"ns": 1e-9,
+	}
+
+	factor, ok := toSeconds[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown duration unit %q", unit)
+	}
+	return value * factor, nil
+}
@@ -0,0 +1,214 @@
+package tsl
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func generatePromQl(t *testing.T, query string) *Ql {
+	t.Helper()
+
+	instructions := parseInstructions(t, query)
+	if len(instructions) != 1 {
+		t.Fatalf("expected a single instruction for %q, got %d", query, len(instructions))
+	}
+
+	protoParser := ProtoParser{Name: "prometheus"}
+	promql, err := protoParser.GeneratePromQl(instructions[0], time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("unexpected error on %q: %v", query, err)
+	}
+	return promql
+}
+
+func TestGeneratePromQlGroupOperator(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{
+			`mul(select("http_requests").last(1h).sampleBy(1m, last), select("instance_info").last(1h).sampleBy(1m, last)).on("instance").groupLeft()`,
+			"http_requests * on(instance) group_left instance_info",
+		},
+		{
+			`mul(select("http_requests").last(1h).sampleBy(1m, last), select("instance_info").last(1h).sampleBy(1m, last)).on("instance").groupLeft("version", "dc")`,
+			"http_requests * on(instance) group_left(version,dc) instance_info",
+		},
+		{
+			`mul(select("instance_info").last(1h).sampleBy(1m, last), select("http_requests").last(1h).sampleBy(1m, last)).ignoring("job").groupRight("version")`,
+			"instance_info * ignoring(job) group_right(version) http_requests",
+		},
+	}
+
+	for _, test := range tests {
+		promql := generatePromQl(t, test.query)
+		if promql.Query != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.query, test.expected, promql.Query)
+		}
+	}
+}
+
+func TestHistogramFractionBackends(t *testing.T) {
+	bucket := func(le string) string {
+		return `sum without(le) (label_replace(latency, "le", "$1", "le", "(.+)\\.0+") * on(le) group_left() label_replace(vector(1), "le", "` + le + `", "", ""))`
+	}
+
+	tests := []struct {
+		query    string
+		promql   string
+		warpLoad string
+	}{
+		{
+			`select("latency").last(1h).sampleBy(1m, last).histogramFraction(0.1, 0.5)`,
+			"((" + bucket("0.5") + " - " + bucket("0.1") + ") / " + bucket("+Inf") + ")",
+			"0.1  TODOUBLE 'histLower' STORE\n0.5  TODOUBLE 'histUpper' STORE\n",
+		},
+		{
+			// A lower bound of 0 or below counts as 0 without bucket
+			`select("latency").last(1h).sampleBy(1m, last).histogramFraction(0, 1)`,
+			"((" + bucket("1") + " - (" + bucket("0") + " or " + bucket("1") + " * 0)) / " + bucket("+Inf") + ")",
+			"0.0  TODOUBLE 'histLower' STORE\n1.0  TODOUBLE 'histUpper' STORE\n",
+		},
+	}
+
+	for _, test := range tests {
+		promql := generatePromQl(t, test.query)
+		if promql.Query != test.promql {
+			t.Errorf("%s: expected %q, got %q", test.query, test.promql, promql.Query)
+		}
+
+		// On Warp 10, bounds match buckets le values exactly and a missing non positive lower bucket counts as 0
+		protoParser := ProtoParser{Name: "warp 10"}
+		warpScript, err := protoParser.GenerateWarpScript(parseInstructions(t, test.query), false)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.query, err)
+		}
+		for _, expected := range []string{
+			test.warpLoad,
+			"<% $histCurrentLe $histBound == %>\n",
+			"$histLower @histRankAt <% DUP ISNaN $histLower 0.0 <= && %> <% DROP 0.0 %> IFT\n",
+		} {
+			if !strings.Contains(warpScript, expected) {
+				t.Errorf("%s: expected %q in %q", test.query, expected, warpScript)
+			}
+		}
+		if strings.Contains(warpScript, "histPreviousLe") {
+			t.Errorf("%s: expected fraction bounds not to be interpolated, got %q", test.query, warpScript)
+		}
+	}
+}
+
+func TestGeneratePromQlTrendOperators(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{`select("cpu").last(1h).sampleBy(1m, last).deriv()`, "deriv(cpu[1m])"},
+		{`select("cpu").last(1h).sampleBy(1m, last).deriv(10m)`, "deriv(cpu[10m])"},
+		{`select("cpu").last(1h).sampleBy(1m, last).predictLinear(4h, 10m)`, "predict_linear(cpu[10m],14400)"},
+		{`select("cpu").last(1h).sampleBy(1m, last).holtWinters(0.5, 0.3)`, "holt_winters(cpu[1m],0.5,0.3)"},
+	}
+
+	for _, test := range tests {
+		promql := generatePromQl(t, test.query)
+		if promql.Query != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.query, test.expected, promql.Query)
+		}
+	}
+
+	// Forecast is only available on Warp 10
+	protoParser := ProtoParser{Name: "prometheus"}
+	instructions := parseInstructions(t, `select("cpu").last(1h).sampleBy(1m, last).forecast(1h)`)
+	if _, err := protoParser.GeneratePromQl(instructions[0], time.Now()); err == nil || !strings.Contains(err.Error(), "operator forecast not supported") {
+		t.Errorf("expected forecast not to be supported, got %v", err)
+	}
+}
+
+func TestGeneratePromQlAnomalyOperators(t *testing.T) {
+	mad := func(step string) string {
+		return "abs(cpu - quantile_over_time(0.5, cpu[3600s] @ end())) / (1.4826 * quantile_over_time(0.5, abs(cpu - quantile_over_time(0.5, cpu[3600s] @ end()))[3600s:" + step + "] @ end()))"
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+		step     string
+	}{
+		{`select("cpu").last(1h).zscore()`, "((cpu - avg_over_time(cpu[3600s] @ end())) / stddev_over_time(cpu[3600s] @ end()))", "1m"},
+		{`select("cpu").last(1h).sampleBy(5m, last).zscore(1h)`, "((cpu - avg_over_time(cpu[1h])) / stddev_over_time(cpu[1h]))", "5m"},
+		{`select("cpu").last(1h).outliers("mad", 3.5)`, "(cpu and " + mad("1m") + " > 3.5)", "1m"},
+		{`select("cpu").last(1h).sampleBy(5m, last).outliers("mad", 3.5, true)`, "(" + mad("5m") + " > bool 3.5)", "5m"},
+		{`select("cpu").last(1h).bands(1h, 2)`, `(label_replace(avg_over_time(cpu[1h]) + 2 * stddev_over_time(cpu[1h]), "band", "upper", "", "") or label_replace(avg_over_time(cpu[1h]) - 2 * stddev_over_time(cpu[1h]), "band", "lower", "", ""))`, "1m"},
+	}
+
+	for _, test := range tests {
+		promql := generatePromQl(t, test.query)
+		if promql.Query != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.query, test.expected, promql.Query)
+		}
+		if promql.Step != test.step {
+			t.Errorf("%s: expected a %q step, got %q", test.query, test.step, promql.Step)
+		}
+	}
+
+	// The esd test is iterative
+	protoParser := ProtoParser{Name: "prometheus"}
+	instructions := parseInstructions(t, `select("cpu").last(1h).outliers("esd", 5)`)
+	if _, err := protoParser.GeneratePromQl(instructions[0], time.Now()); err == nil || !strings.Contains(err.Error(), "the esd method of outliers is an iterative test") {
+		t.Errorf("expected the esd method not to be supported, got %v", err)
+	}
+}
+
+func TestGeneratePromQlMathMappers(t *testing.T) {
+	tests := []struct {
+		method   string
+		expected string
+	}{
+		{"pow(2)", "cpu ^ 2"},
+		{"exp()", "exp(cpu)"},
+		{"sin()", "sin(cpu)"},
+		{"cos()", "cos(cpu)"},
+		{"tan()", "tan(cpu)"},
+		{"sgn()", "sgn(cpu)"},
+		{"mod(60)", "cpu % 60"},
+		{"clamp(-1.5, 2)", "clamp(cpu,-1.5,2)"},
+	}
+
+	for _, test := range tests {
+		promql := generatePromQl(t, `select("cpu").last(1h).sampleBy(1m, last).`+test.method)
+		if promql.Query != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.method, test.expected, promql.Query)
+		}
+	}
+}
+
+func TestGeneratePromQlTimezone(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{`select("cpu").last(1h).sampleBy(1m, last).hour()`, "hour(cpu)"},
+		// The offset is the one of the timezone at the query end, in winter
+		{`select("cpu").last(1h).sampleBy(1m, last).hour(tz="Europe/Paris")`, "hour(cpu + 3600)"},
+		{`select("cpu").last(1h).sampleBy(1m, last).day("America/New_York")`, "day_of_month(cpu - 18000)"},
+	}
+
+	for _, test := range tests {
+		promql := generatePromQl(t, test.query)
+		if promql.Query != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.query, test.expected, promql.Query)
+		}
+	}
+
+	// In summer, the daylight saving time offset is used
+	protoParser := ProtoParser{Name: "prometheus"}
+	instructions := parseInstructions(t, `select("cpu").last(1h).sampleBy(1m, last).hour(tz="Europe/Paris")`)
+	promql, err := protoParser.GeneratePromQl(instructions[0], time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if promql.Query != "hour(cpu + 7200)" {
+		t.Errorf("expected a summer offset, got %q", promql.Query)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"strings"
+	"time"
 )
 
 const (
@@ -39,6 +40,13 @@ var toWarpScript = [...]string{
 	LOG2:             "2 mapper.log",
 	LOG10:            "10 mapper.log",
 	LOGN:             "mapper.log",
+	EXP:              "e mapper.exp",
+	POW:              "mapper.pow",
+	COS:              "COS",
+	SIN:              "SIN",
+	TAN:              "TAN",
+	SGN:              "SIGNUM",
+	MOD:              "%",
 	BOTTOMNBY:        "SORTBY",
 	SORTBY:           "SORTBY",
 	SORTDESCBY:       "SORTBY REVERSE",
@@ -56,11 +64,55 @@ var toWarpScript = [...]string{
 	MEAN:             "mean",
 }
 
+// Number of platform ticks per second for each supported Warp 10 time unit
+var timeUnits = map[string]int64{
+	"ns": 1000000000,
+	"us": 1000000,
+	"ms": 1000,
+}
+
+// TimeUnitTicks return the number of Warp 10 platform ticks per second of a time unit, micro-seconds by default
+func TimeUnitTicks(timeUnit string) (int64, error) {
+	if timeUnit == "" {
+		return timeUnits["us"], nil
+	}
+	ticks, ok := timeUnits[timeUnit]
+	if !ok {
+		return 0, fmt.Errorf("unsupported time unit %q, expects ns, us or ms", timeUnit)
+	}
+	return ticks, nil
+}
+
+// EndpointTimeUnit return the Warp 10 platform time unit of an endpoint, the default one when it isn't set
+func (protoParser *ProtoParser) EndpointTimeUnit(api string) string {
+	if timeUnit, ok := protoParser.EndpointTimeUnits[api]; ok && timeUnit != "" {
+		return timeUnit
+	}
+	return protoParser.TimeUnit
+}
+
 // GenerateWarpScript Generate Global WarpScript to execute from an instruction list
 func (protoParser *ProtoParser) GenerateWarpScript(instructions []Instruction, allowAuthenticate bool) (string, error) {
 	var buffer bytes.Buffer
 
-	buffer.WriteString("NOW 'now' STORE\n")
+	// Ensure the platform time unit matches the endpoint one as all integer ticks are platform ticks
+	api := ""
+	if len(instructions) > 0 {
+		api = instructions[0].connectStatement.api
+	}
+	if timeUnit := protoParser.EndpointTimeUnit(api); timeUnit != "" {
+		ticks, err := TimeUnitTicks(timeUnit)
+		if err != nil {
+			return "", NewError(fmt.Errorf("Cannot execute query on %s back-end: %s", protoParser.Name, err.Error()))
+		}
+		buffer.WriteString(fmt.Sprintf("STU %d != <%% 'TSL expects a Warp 10 platform time unit in %s' MSGFAIL %%> IFT\n", ticks, timeUnit))
+	}
+
+	if protoParser.Now.IsZero() {
+		buffer.WriteString("NOW 'now' STORE\n")
+	} else {
+		buffer.WriteString(fmt.Sprintf("'%s' TOTIMESTAMP 'now' STORE\n", protoParser.Now.UTC().Format(time.RFC3339Nano)))
+	}
 	buffer.WriteString("\n")
 
 	// In case stack authentication is allowed in configuration
@@ -88,8 +140,20 @@ func (protoParser *ProtoParser) GenerateWarpScript(instructions []Instruction, a
 		}
 	}
 
+	// Fetch once the series used by several statements
+	sharedFetches, err := protoParser.getSharedFetches(instructions)
+	if err != nil {
+		return "", err
+	}
+	buffer.WriteString(sharedFetches)
+
 	for _, instruction := range instructions {
 
+		if instruction.GetCrossBackendOperator() != nil {
+			message := "operator " + instruction.globalOperator.operator.String() + " between series of different back-ends can only be computed by the TSL proxy"
+			return "", protoParser.NewProtoError(message, instruction.globalOperator.pos)
+		}
+
 		warpScript, err := protoParser.processWarpScriptInstruction(instruction, "")
 		if err != nil {
 			return "", err
@@ -100,6 +164,79 @@ func (protoParser *ProtoParser) GenerateWarpScript(instructions []Instruction, a
 	return buffer.String(), nil
 }
 
+// Detect identical fetches across all statements, store them once and keep their variable name to reuse them
+func (protoParser *ProtoParser) getSharedFetches(instructions []Instruction) (string, error) {
+	var buffer bytes.Buffer
+
+	counts := make(map[string]int)
+	fetches := []string{}
+
+	err := protoParser.countFetches(instructions, counts, &fetches)
+	if err != nil {
+		return "", err
+	}
+
+	protoParser.sharedFetches = make(map[string]string)
+	for _, fetch := range fetches {
+		if counts[fetch] < 2 {
+			continue
+		}
+
+		// Native variables may be updated between statements: only share fetches depending on now
+		if strings.Contains(strings.Replace(fetch, "$now", "", -1), "$") {
+			continue
+		}
+
+		name := fmt.Sprintf("sharedFetch%d", len(protoParser.sharedFetches))
+		protoParser.sharedFetches[fetch] = name
+
+		buffer.WriteString(fetch)
+		buffer.WriteString("\n")
+		buffer.WriteString("'" + name + "' STORE\n")
+	}
+
+	if len(protoParser.sharedFetches) > 0 {
+		buffer.WriteString("\n")
+	}
+	return buffer.String(), nil
+}
+
+// Count each fetch of an instruction list, including the ones of global operators
+func (protoParser *ProtoParser) countFetches(instructions []Instruction, counts map[string]int, fetches *[]string) error {
+	for _, instruction := range instructions {
+		if instruction.isMeta && !(instruction.hasSelect && instruction.selectStatement.isVariable) {
+			continue
+		}
+
+		if instruction.hasSelect {
+			if len(instruction.createStatement.createSeries) > 0 || instruction.selectStatement.isVariable {
+				continue
+			}
+
+			fetch, err := protoParser.getFetch(instruction.selectStatement, instruction.connectStatement.token, "")
+			if err != nil {
+				return err
+			}
+
+			if counts[fetch] == 0 {
+				*fetches = append(*fetches, fetch)
+			}
+			counts[fetch]++
+		} else if instruction.isGlobalOperator {
+			gOpInstructions := make([]Instruction, len(instruction.globalOperator.instructions))
+			for index, gOpInstruction := range instruction.globalOperator.instructions {
+				gOpInstructions[index] = *gOpInstruction
+			}
+
+			err := protoParser.countFetches(gOpInstructions, counts, fetches)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (protoParser *ProtoParser) processWarpScriptInstruction(instruction Instruction, prefix string) (string, error) {
 	var buffer bytes.Buffer
 
@@ -132,6 +269,12 @@ func (protoParser *ProtoParser) processWarpScriptInstruction(instruction Instruc
 					return "", nil
 				}
 
+				// Reuse a shared fetch on a copy as some operators update series in place
+				shared, _ := protoParser.getFetch(instruction.selectStatement, instruction.connectStatement.token, "")
+				if name, ok := protoParser.sharedFetches[shared]; ok {
+					fetch = "$" + name + " <% DROP CLONE SWAP DROP %> LMAP"
+				}
+
 				buffer.WriteString(fetch)
 			}
 		}
@@ -159,14 +302,13 @@ func (protoParser *ProtoParser) processWarpScriptInstruction(instruction Instruc
 func (protoParser *ProtoParser) writeGlobalOperators(gOp GlobalOperator, prefix string, selectStatement SelectStatement) (string, error) {
 	var buffer bytes.Buffer
 
-	buffer.WriteString(prefix)
-
+	// Many-to-one and one-to-many matching can't be done using a single APPLY
 	if gOp.group.lit != "" {
-
-		message := "TSL doesn't allow " + gOp.group.tokenType.String() + "methods"
-		return "", protoParser.NewProtoError(message, gOp.pos)
+		return protoParser.writeGroupOperator(gOp, prefix, selectStatement)
 	}
 
+	buffer.WriteString(prefix)
+
 	// When all is set, use all existing labels to generate equivalence class
 	if gOp.isIgnoring {
 		buffer.WriteString("[] 'operatorLabels' STORE\n")
@@ -205,20 +347,137 @@ func (protoParser *ProtoParser) writeGlobalOperators(gOp GlobalOperator, prefix
 		buffer.WriteString(labels + " \n")
 	}
 	buffer.WriteString(prefix + "  ")
+	buffer.WriteString(protoParser.getOperatorString(gOp.operator) + " \n")
+	buffer.WriteString(prefix)
+	buffer.WriteString("] \n")
+	buffer.WriteString(prefix)
+	buffer.WriteString("APPLY \n")
+	op, err := protoParser.getFrameworksOp(selectStatement, prefix)
 
-	operator := "op."
+	if err != nil {
+		return "", err
+	}
+	buffer.WriteString(op)
+	return buffer.String(), nil
+}
 
-	switch gOp.operator {
-	case EQUAL, GREATEROREQUAL, GREATERTHAN, LESSOREQUAL, LESSTHAN, NOTEQUAL:
-		operator += toWarpScript[gOp.operator]
-	default:
-		operator += gOp.operator.String()
+// Write a groupLeft or a groupRight operator: each series of the "many" side is matched with a single series of the "one" side
+func (protoParser *ProtoParser) writeGroupOperator(gOp GlobalOperator, prefix string, selectStatement SelectStatement) (string, error) {
+	var buffer bytes.Buffer
+
+	if len(gOp.instructions) != 2 {
+		message := gOp.group.tokenType.String() + " expects exactly two series sets in operator " + gOp.operator.String()
+		return "", protoParser.NewProtoError(message, gOp.pos)
 	}
-	buffer.WriteString(operator + " \n")
+
+	buffer.WriteString(prefix)
+	buffer.WriteString("[ \n")
+
+	for _, gOpInstruction := range gOp.instructions {
+
+		warpScript, err := protoParser.processWarpScriptInstruction(*gOpInstruction, prefix+"  ")
+		if err != nil {
+			return "", err
+		}
+		buffer.WriteString(warpScript)
+	}
+
 	buffer.WriteString(prefix)
 	buffer.WriteString("] \n")
+
+	// The right operand is on top of the stack
 	buffer.WriteString(prefix)
-	buffer.WriteString("APPLY \n")
+	if gOp.group.tokenType == GROUPLEFT {
+		buffer.WriteString("LIST-> DROP 'groupOne' STORE 'groupMany' STORE\n")
+	} else {
+		buffer.WriteString("LIST-> DROP 'groupMany' STORE 'groupOne' STORE\n")
+	}
+
+	// Macro computing the matching key of a series based on the on or ignoring labels
+	buffer.WriteString(prefix)
+	if gOp.isIgnoring {
+		buffer.WriteString("<% LABELS 'groupMatchLabels' STORE $groupMatchLabels KEYLIST ->SET ")
+		buffer.WriteString(protoParser.getLabelsListString(gOp.ignoring))
+		buffer.WriteString(" ->SET DIFFERENCE SET-> LSORT <% DROP DUP $groupMatchLabels SWAP GET 2 ->LIST %> LMAP ->JSON %> 'groupMatchKey' STORE\n")
+	} else {
+		buffer.WriteString("<% LABELS 'groupMatchLabels' STORE ")
+		buffer.WriteString(protoParser.getLabelsListString(gOp.labels))
+		buffer.WriteString(" <% DROP $groupMatchLabels SWAP GET <% DUP ISNULL %> <% DROP '' %> IFT %> LMAP ->JSON %> 'groupMatchKey' STORE\n")
+	}
+
+	// Index the "one" side per matching key, a key must be unique
+	buffer.WriteString(prefix)
+	buffer.WriteString("{} 'groupOneIndex' STORE\n")
+	buffer.WriteString(prefix)
+	buffer.WriteString("$groupOne\n")
+	buffer.WriteString(prefix)
+	buffer.WriteString("<%\n")
+	buffer.WriteString(prefix + "  ")
+	buffer.WriteString("DUP @groupMatchKey 'groupKey' STORE\n")
+	buffer.WriteString(prefix + "  ")
+	buffer.WriteString("<% $groupOneIndex $groupKey CONTAINSKEY SWAP DROP %>\n")
+	buffer.WriteString(prefix + "  ")
+	buffer.WriteString("<% 'multiple matches for labels: many-to-one matching must be explicit (" + gOp.group.tokenType.String() + ")' MSGFAIL %>\n")
+	buffer.WriteString(prefix + "  ")
+	buffer.WriteString("IFT\n")
+	buffer.WriteString(prefix + "  ")
+	buffer.WriteString("$groupOneIndex SWAP $groupKey PUT DROP\n")
+	buffer.WriteString(prefix)
+	buffer.WriteString("%>\n")
+	buffer.WriteString(prefix)
+	buffer.WriteString("FOREACH\n")
+
+	// Operands order is kept as written by the user
+	operands := "[ $groupManySeries ] [ $groupOneSeries ]"
+	if gOp.group.tokenType == GROUPRIGHT {
+		operands = "[ $groupOneSeries ] [ $groupManySeries ]"
+	}
+
+	// Compute the operator for each "many" series having a match, and copy the group labels from the "one" side
+	buffer.WriteString(prefix)
+	buffer.WriteString("[\n")
+	buffer.WriteString(prefix)
+	buffer.WriteString("$groupMany\n")
+	buffer.WriteString(prefix)
+	buffer.WriteString("<%\n")
+	buffer.WriteString(prefix + "  ")
+	buffer.WriteString("'groupManySeries' STORE\n")
+	buffer.WriteString(prefix + "  ")
+	buffer.WriteString("$groupManySeries @groupMatchKey 'groupKey' STORE\n")
+	buffer.WriteString(prefix + "  ")
+	buffer.WriteString("<% $groupOneIndex $groupKey CONTAINSKEY SWAP DROP %>\n")
+	buffer.WriteString(prefix + "  ")
+	buffer.WriteString("<%\n")
+	buffer.WriteString(prefix + "    ")
+	buffer.WriteString("$groupOneIndex $groupKey GET 'groupOneSeries' STORE\n")
+	buffer.WriteString(prefix + "    ")
+	buffer.WriteString("[ " + operands + " [] " + protoParser.getOperatorString(gOp.operator) + " ] APPLY 0 GET\n")
+	buffer.WriteString(prefix + "    ")
+	buffer.WriteString("$groupManySeries NAME RENAME $groupManySeries LABELS RELABEL\n")
+
+	if len(gOp.groupLabels) > 0 {
+		buffer.WriteString(prefix + "    ")
+		buffer.WriteString("$groupOneSeries LABELS 'groupOneLabels' STORE\n")
+		buffer.WriteString(prefix + "    ")
+		buffer.WriteString("{ ")
+		for _, label := range gOp.groupLabels {
+			labelKey := protoParser.getStringValue(label)
+			buffer.WriteString(labelKey + "$groupOneLabels " + labelKey + "GET <% DUP ISNULL %> <% DROP '' %> IFT ")
+		}
+		buffer.WriteString("} RELABEL\n")
+	}
+
+	buffer.WriteString(prefix + "  ")
+	buffer.WriteString("%>\n")
+	buffer.WriteString(prefix + "  ")
+	buffer.WriteString("IFT\n")
+	buffer.WriteString(prefix)
+	buffer.WriteString("%>\n")
+	buffer.WriteString(prefix)
+	buffer.WriteString("FOREACH\n")
+	buffer.WriteString(prefix)
+	buffer.WriteString("]\n")
+
 	op, err := protoParser.getFrameworksOp(selectStatement, prefix)
 
 	if err != nil {
@@ -228,13 +487,31 @@ func (protoParser *ProtoParser) writeGlobalOperators(gOp GlobalOperator, prefix
 	return buffer.String(), nil
 }
 
+// getOperatorString returns the Warp 10 operator used to apply a global operator
+func (protoParser *ProtoParser) getOperatorString(operator Token) string {
+	switch operator {
+	case EQUAL, GREATEROREQUAL, GREATERTHAN, LESSOREQUAL, LESSTHAN, NOTEQUAL:
+		return "op." + toWarpScript[operator]
+	}
+	return "op." + operator.String()
+}
+
 // Generate each individual method statement
 func (protoParser *ProtoParser) getFrameworksOp(selectStatement SelectStatement, prefix string) (string, error) {
 	var buffer bytes.Buffer
 
 	var sampleSpan string
 
-	for _, framework := range selectStatement.frameworks {
+	for index, framework := range selectStatement.frameworks {
+
+		// A store to a sink is written by TSL on the statement result
+		if isSinkStore(framework) {
+			if index != len(selectStatement.frameworks)-1 {
+				message := "a store to a " + framework.unNamedAttributes[0].lit + " sink must be the last method of a statement"
+				return "", protoParser.NewProtoError(message, framework.pos)
+			}
+			continue
+		}
 
 		buffer.WriteString(prefix)
 		switch framework.operator {
@@ -249,7 +526,8 @@ func (protoParser *ProtoParser) getFrameworksOp(selectStatement SelectStatement,
 			buffer.WriteString("\n")
 		case ABS, ADDSERIES, ANDL, CEIL, COUNT, DAY, DELTA, DIVSERIES, EQUAL, FLOOR, GREATERTHAN, GREATEROREQUAL, LESSTHAN, LESSOREQUAL,
 			LN, LOG2, LOG10, LOGN, HOUR, MAX, MAXWITH, MEAN, MEDIAN, MIN, MINWITH, MINUTE, MONTH, MULSERIES, NOTEQUAL, ORL, RATE, STDDEV, STDVAR, SUBSERIES,
-			ROUND, SQRT, SUM, TIMESTAMP, WEEKDAY, YEAR, JOIN, PERCENTILE, CUMULATIVE, WINDOW, FINITE, TOBOOLEAN, TODOUBLE, TOLONG, TOSTRING:
+			ROUND, SQRT, SUM, TIMESTAMP, WEEKDAY, YEAR, JOIN, PERCENTILE, CUMULATIVE, WINDOW, FINITE, TOBOOLEAN, TODOUBLE, TOLONG, TOSTRING,
+			CLAMP, COS, EXP, MOD, POW, SGN, SIN, TAN:
 
 			buffer.WriteString(protoParser.getMapper(framework, sampleSpan))
 			buffer.WriteString("\n")
@@ -260,6 +538,27 @@ func (protoParser *ProtoParser) getFrameworksOp(selectStatement SelectStatement,
 			}
 			buffer.WriteString(pop)
 			buffer.WriteString("\n")
+		case BANDS, OUTLIERS, ZSCORE:
+			anomaly, err := protoParser.anomaly(framework, prefix)
+			if err != nil {
+				return "", err
+			}
+			buffer.WriteString(anomaly)
+			buffer.WriteString("\n")
+		case DERIV, FORECAST, HOLTWINTERS, PREDICTLINEAR:
+			trend, err := protoParser.trend(framework, prefix, sampleSpan)
+			if err != nil {
+				return "", err
+			}
+			buffer.WriteString(trend)
+			buffer.WriteString("\n")
+		case HISTOGRAMQUANTILE, HISTOGRAMFRACTION:
+			histogram, err := protoParser.histogram(framework, prefix)
+			if err != nil {
+				return "", err
+			}
+			buffer.WriteString(histogram)
+			buffer.WriteString("\n")
 		case QUANTIZE:
 			quantize, err := protoParser.quantize(framework, prefix)
 			if err != nil {
@@ -766,10 +1065,38 @@ func (protoParser *ProtoParser) getBucketize(selectStatement SelectStatement, fr
 		}
 	}
 
-	if strings.HasSuffix(shiftSpan, "M") {
-		bucketSpan := strings.TrimSuffix(shiftSpan, "M")
+	// Calendar sampling: months, or days and weeks in a given timezone
+	timezone := ""
+	if attribute, ok := framework.attributes[Timezone]; ok {
+		timezone = protoParser.getLit(attribute)
+	}
+
+	calendarSpan := ""
+	if attribute, ok := framework.attributes[SampleSpan]; ok && attribute.tokenType == DURATIONVAL {
+		calendarSpan = attribute.lit
+	}
+
+	isCalendar := strings.HasSuffix(shiftSpan, "M")
+	period := "ADDMONTHS"
+	truncate := "1 2 SET 0 3 SET 0 4 SET 0 5 SET 0 6 SET"
+	bucketSpan := strings.TrimSuffix(shiftSpan, "M")
+	calendarBucketizer := "bucketizer.last"
+
+	if timezone != "" && (strings.HasSuffix(calendarSpan, "d") || strings.HasSuffix(calendarSpan, "w")) {
+		isCalendar = true
+		period = "ADDDAYS"
+		truncate = "0 3 SET 0 4 SET 0 5 SET 0 6 SET"
+		calendarBucketizer = bucketizer
+		if strings.HasSuffix(calendarSpan, "w") {
+			bucketSpan = strings.TrimSuffix(calendarSpan, "w") + " 7 *"
+		} else {
+			bucketSpan = strings.TrimSuffix(calendarSpan, "d")
+		}
+	}
+
+	if isCalendar {
 		bucketize := "<% \n"
-		bucketize += lastbucket + " TSELEMENTS 1 2 SET 0 3 SET 0 4 SET 0 5 SET 0 6 SET TSELEMENTS-> 1 ADDMONTHS 'endBucketizeMonth' STORE "
+		bucketize += lastbucket + " " + timezone + "TSELEMENTS " + truncate + " " + timezone + "TSELEMENTS-> " + timezone + "1 " + period + " 'endBucketizeMonth' STORE "
 		bucketize += `
 		$raw
 		<%
@@ -783,15 +1110,15 @@ func (protoParser *ProtoParser) getBucketize(selectStatement SelectStatement, fr
 			[ 
 				$tickBucketizeMonth 
 				$tickBucketizeMonth 
-				-1 ` + bucketSpan + ` * ADDMONTHS
+				` + timezone + `-1 ` + bucketSpan + ` * ` + period + `
 			]
 			+ 'clipTicks' STORE
-			$tickBucketizeMonth -1 ` + bucketSpan + ` * ADDMONTHS 'tickBucketizeMonth' STORE
+			$tickBucketizeMonth ` + timezone + `-1 ` + bucketSpan + ` * ` + period + ` 'tickBucketizeMonth' STORE
 			%>
 			WHILE
 			$clipTicks
 			CLIP FLATTEN NONEMPTY
-			[ SWAP bucketizer.last 0 0 1 ] BUCKETIZE 
+			[ SWAP ` + calendarBucketizer + ` 0 0 1 ] BUCKETIZE 
 			<%
 				DROP 
 				DUP
@@ -799,8 +1126,8 @@ func (protoParser *ProtoParser) getBucketize(selectStatement SelectStatement, fr
 				SWAP
 				DUP
 				FIRSTTICK 'firstTickBucketized' STORE
-				$firstTickBucketized TSELEMENTS
-				1 2 SET 0 3 SET 0 4 SET 0 5 SET 0 6 SET TSELEMENTS->
+				$firstTickBucketized ` + timezone + `TSELEMENTS
+				` + truncate + ` ` + timezone + `TSELEMENTS->
 				SWAP
 				$firstTickBucketized ATTICK
 				4 GET 'valueBucketized' STORE
@@ -987,12 +1314,34 @@ func (protoParser *ProtoParser) getMapper(framework FrameworkStatement, sampleSp
 		return mapper
 	}
 
+	// Clamp values between min and max
+	if framework.operator == CLAMP {
+		min := protoParser.getLit(framework.unNamedAttributes[0])
+		max := protoParser.getLit(framework.unNamedAttributes[1])
+		return "[ SWAP " + min + " " + toWarpScript[MAXWITH] + " 0 0 0 ] MAP [ SWAP " + max + " " + toWarpScript[MINWITH] + " 0 0 0 ] MAP "
+	}
+
+	// No native mapper: apply the WarpScript function on each value
+	switch framework.operator {
+	case COS, MOD, SGN, SIN, TAN:
+		function := toWarpScript[framework.operator]
+		if attribute, ok := framework.attributes[MapperValue]; ok {
+			function = protoParser.getLit(attribute) + " " + function
+		}
+		return "[ SWAP <% 'mapping' STORE [ $mapping 0 GET NaN NaN NaN $mapping 7 GET 0 GET TODOUBLE " + function + " ] %> MACROMAPPER 0 0 0 ] MAP "
+	}
+
 	operator := framework.operator.String()
 	mapper := "mapper." + operator
 
 	switch framework.operator {
-	case STDDEV, STDVAR, LOG2, LOG10, LOGN, LN, DAY, MAXWITH, MINUTE, MINWITH, HOUR, MONTH, WEEKDAY, YEAR, TIMESTAMP:
+	case STDDEV, STDVAR, LOG2, LOG10, LOGN, LN, MAXWITH, MINWITH, TIMESTAMP, EXP, POW:
+		mapper = toWarpScript[framework.operator]
+	case DAY, HOUR, MINUTE, MONTH, WEEKDAY, YEAR:
 		mapper = toWarpScript[framework.operator]
+		if timezone, hasTimezone := framework.attributes[Timezone]; hasTimezone {
+			mapper = protoParser.getLit(timezone) + strings.TrimPrefix(mapper, "'UTC' ")
+		}
 	case EQUAL, GREATEROREQUAL, GREATERTHAN, LESSOREQUAL, LESSTHAN, NOTEQUAL:
 		mapper = "mapper." + toWarpScript[framework.operator]
 	case CUMULATIVE, WINDOW:
@@ -1222,6 +1571,331 @@ func (protoParser *ProtoParser) quantize(framework FrameworkStatement, prefix st
 	return buffer.String(), nil
 }
 
+// histogram generate WarpScript line for a histogramQuantile or a histogramFraction statement
+// Series are reduced on all their labels except "le". Quantiles are interpolated inside buckets as Prometheus does,
+// and fractions bounds are matched exactly on buckets "le" values as the generated PromQL does
+func (protoParser *ProtoParser) histogram(framework FrameworkStatement, prefix string) (string, error) {
+	var buffer bytes.Buffer
+
+	if framework.operator == HISTOGRAMQUANTILE {
+		quantile, ok := framework.unNamedAttributes[0]
+		if !ok {
+			message := framework.operator.String() + " expects a quantile"
+			return "", protoParser.NewProtoError(message, framework.pos)
+		}
+		buffer.WriteString(protoParser.getLit(quantile) + " 'histQuantile' STORE\n")
+	} else {
+		lower, hasLower := framework.unNamedAttributes[0]
+		upper, hasUpper := framework.unNamedAttributes[1]
+		if !hasLower || !hasUpper {
+			message := framework.operator.String() + " expects a lower and an upper bound"
+			return "", protoParser.NewProtoError(message, framework.pos)
+		}
+		buffer.WriteString(protoParser.getLit(lower) + " TODOUBLE 'histLower' STORE\n")
+		buffer.WriteString(prefix + protoParser.getLit(upper) + " TODOUBLE 'histUpper' STORE\n")
+	}
+
+	// Load current tick buckets as a sorted list of [ le value ]
+	buffer.WriteString(prefix + `<%
+    DUP 0 GET 'histTick' STORE
+    DUP 2 GET 'histLabels' STORE
+    7 GET 'histValues' STORE
+    [
+    0 $histValues SIZE 1 -
+    <%
+        'histIndex' STORE
+        $histLabels $histIndex GET 'le' GET 'histLe' STORE
+        $histValues $histIndex GET 'histValue' STORE
+        <% $histLe ISNULL $histValue ISNULL || ! %>
+        <%
+            $histLe <% DUP '+Inf' == %> <% DROP 'Infinity' %> IFT TODOUBLE
+            $histValue TODOUBLE
+            2 ->LIST
+        %>
+        IFT
+    %>
+    FOR
+    ]
+    <% 0 GET %> SORTBY 'histBuckets' STORE
+    <% $histBuckets SIZE 2 < <% true %> <% $histBuckets DUP SIZE 1 - GET 0 GET 'Infinity' TODOUBLE != %> IFTE %>
+    <% [ $histTick NaN NaN NaN NaN ] %>
+    <%
+        $histBuckets DUP SIZE 1 - GET 1 GET 'histCount' STORE
+`)
+
+	if framework.operator == HISTOGRAMQUANTILE {
+		buffer.WriteString(prefix + `        $histQuantile $histCount * 'histRank' STORE
+        0.0 'histPreviousLe' STORE
+        0.0 'histPreviousCount' STORE
+        NaN 'histResult' STORE
+        $histBuckets
+        <%
+            LIST-> DROP 'histCurrentCount' STORE 'histCurrentLe' STORE
+            <% $histResult ISNaN $histCurrentCount $histRank >= && %>
+            <%
+                <% $histCurrentLe 'Infinity' TODOUBLE == %>
+                <% $histPreviousLe %>
+                <% $histCurrentLe 0.0 <= $histPreviousCount 0.0 == && %>
+                <% $histCurrentLe %>
+                <%
+                    $histPreviousLe
+                    $histCurrentLe $histPreviousLe -
+                    $histRank $histPreviousCount - $histCurrentCount $histPreviousCount - /
+                    * +
+                %>
+                3 SWITCH
+                'histResult' STORE
+            %>
+            IFT
+            $histCurrentLe 'histPreviousLe' STORE
+            $histCurrentCount 'histPreviousCount' STORE
+        %>
+        FOREACH
+        [ $histTick NaN NaN NaN $histResult ]
+`)
+	} else {
+		buffer.WriteString(prefix + `        <%
+            'histBound' STORE
+            NaN 'histRankResult' STORE
+            $histBuckets
+            <%
+                LIST-> DROP 'histCurrentCount' STORE 'histCurrentLe' STORE
+                <% $histCurrentLe $histBound == %>
+                <% $histCurrentCount 'histRankResult' STORE %>
+                IFT
+            %>
+            FOREACH
+            $histRankResult
+        %>
+        'histRankAt' STORE
+        $histUpper @histRankAt
+        $histLower @histRankAt <% DUP ISNaN $histLower 0.0 <= && %> <% DROP 0.0 %> IFT
+        - $histCount / 'histResult' STORE
+        [ $histTick NaN NaN NaN $histResult ]
+`)
+	}
+
+	buffer.WriteString(prefix + `    %>
+    IFTE
+%>
+MACROREDUCER 'histReducer' STORE
+`)
+	buffer.WriteString(prefix + "[ SWAP DUP <% DROP LABELS KEYLIST %> LMAP FLATTEN UNIQUE ->SET [ 'le' ] ->SET DIFFERENCE SET-> $histReducer ] REDUCE")
+
+	return buffer.String(), nil
+}
+
+// linearRegression generate a WarpScript macro computing the least squares slope (per second) and intercept
+// of the $lrTicks and $lrValues lists, the intercept being computed at the $lrOrigin tick
+func (protoParser *ProtoParser) linearRegression(prefix string) string {
+	return prefix + `<%
+    $lrTicks SIZE TODOUBLE 'lrSize' STORE
+    0.0 'lrSumX' STORE
+    0.0 'lrSumY' STORE
+    0.0 'lrSumXY' STORE
+    0.0 'lrSumXX' STORE
+    0 $lrTicks SIZE 1 -
+    <%
+        'lrIndex' STORE
+        $lrTicks $lrIndex GET $lrOrigin - TODOUBLE 1 s / 'lrX' STORE
+        $lrValues $lrIndex GET TODOUBLE 'lrY' STORE
+        $lrSumX $lrX + 'lrSumX' STORE
+        $lrSumY $lrY + 'lrSumY' STORE
+        $lrSumXY $lrX $lrY * + 'lrSumXY' STORE
+        $lrSumXX $lrX $lrX * + 'lrSumXX' STORE
+    %>
+    FOR
+    $lrSize $lrSumXX * $lrSumX $lrSumX * - 'lrDenominator' STORE
+    <% $lrDenominator 0.0 == %>
+    <% NaN 'lrSlope' STORE NaN 'lrIntercept' STORE %>
+    <%
+        $lrSize $lrSumXY * $lrSumX $lrSumY * - $lrDenominator / 'lrSlope' STORE
+        $lrSumY $lrSlope $lrSumX * - $lrSize / 'lrIntercept' STORE
+    %>
+    IFTE
+%>
+'linearRegression' STORE
+`
+}
+
+// trend generate WarpScript line for a deriv, predictLinear, holtWinters or forecast statement
+func (protoParser *ProtoParser) trend(framework FrameworkStatement, prefix string, sampleSpan string) (string, error) {
+	var buffer bytes.Buffer
+
+	if framework.operator == FORECAST {
+		span, ok := framework.attributes[MapperValue]
+		if !ok {
+			message := framework.operator.String() + " expects a span duration"
+			return "", protoParser.NewProtoError(message, framework.pos)
+		}
+
+		// Extend each series with the values of its linear regression, one per bucket span
+		buffer.WriteString(protoParser.linearRegression(""))
+		buffer.WriteString(prefix + `<%
+    DROP
+    SORT 'forecastSeries' STORE
+    <% $forecastSeries SIZE 2 < %>
+    <% $forecastSeries %>
+    <%
+        $forecastSeries TICKS 'lrTicks' STORE
+        $lrTicks DUP SIZE 1 - GET $lrTicks DUP SIZE 2 - GET - 'forecastBucketSpan' STORE
+        $forecastSeries VALUES 'lrValues' STORE
+        $forecastSeries LASTTICK 'lrOrigin' STORE
+        @linearRegression
+        $forecastSeries
+        1 ` + protoParser.parseShift(span.lit) + ` $forecastBucketSpan /
+        <%
+            $forecastBucketSpan * 'forecastDelta' STORE
+            $lrOrigin $forecastDelta + NaN NaN NaN
+            $lrIntercept $lrSlope $forecastDelta TODOUBLE 1 s / * +
+            ADDVALUE
+        %>
+        FOR
+    %>
+    IFTE
+%>
+LMAP`)
+		return buffer.String(), nil
+	}
+
+	// Sliding window: the sampling span by default as the Prometheus step, or all the ticks of the window duration
+	pre := "1"
+	if sampleSpan != "" {
+		pre = sampleSpan + " -1 *"
+	}
+	if window, ok := framework.attributes[MapperSampling]; ok {
+		pre = "-" + protoParser.parseShift(window.lit)
+	}
+
+	if framework.operator == HOLTWINTERS {
+		buffer.WriteString(protoParser.getLit(framework.unNamedAttributes[0]) + " 'hwSmoothing' STORE\n")
+		buffer.WriteString(prefix + protoParser.getLit(framework.unNamedAttributes[1]) + " 'hwTrend' STORE\n")
+		buffer.WriteString(prefix + `<%
+    'window' STORE
+    $window 0 GET 'hwTick' STORE
+    $window 7 GET 'hwValues' STORE
+    <% $hwValues SIZE 2 < %>
+    <% [ $hwTick NaN NaN NaN NaN ] %>
+    <%
+        $hwValues 0 GET TODOUBLE 'hwPrevious' STORE
+        $hwPrevious 'hwLevel' STORE
+        $hwValues 1 GET TODOUBLE $hwPrevious - 'hwSlope' STORE
+        1 $hwValues SIZE 1 -
+        <%
+            'hwIndex' STORE
+            <% $hwIndex 1 > %>
+            <% $hwTrend $hwLevel $hwPrevious - * 1.0 $hwTrend - $hwSlope * + 'hwSlope' STORE %>
+            IFT
+            $hwLevel 'hwPrevious' STORE
+            $hwSmoothing $hwValues $hwIndex GET TODOUBLE * 1.0 $hwSmoothing - $hwLevel $hwSlope + * + 'hwLevel' STORE
+        %>
+        FOR
+        [ $hwTick NaN NaN NaN $hwLevel ]
+    %>
+    IFTE
+%>
+MACROMAPPER 'trendMapper' STORE
+`)
+		buffer.WriteString(prefix + "[ SWAP $trendMapper " + pre + " 0 0 ] MAP")
+		return buffer.String(), nil
+	}
+
+	// deriv returns the regression slope, predictLinear the value predicted after the duration parameter
+	result := "$lrSlope"
+	if framework.operator == PREDICTLINEAR {
+		duration, ok := framework.attributes[MapperValue]
+		if !ok {
+			message := framework.operator.String() + " expects a prediction duration"
+			return "", protoParser.NewProtoError(message, framework.pos)
+		}
+		result = "$lrIntercept $lrSlope " + protoParser.parseShift(duration.lit) + " TODOUBLE 1 s / * +"
+	}
+
+	buffer.WriteString(protoParser.linearRegression(""))
+	buffer.WriteString(prefix + `<%
+    'window' STORE
+    $window 0 GET 'lrOrigin' STORE
+    $window 3 GET 'lrTicks' STORE
+    $window 7 GET 'lrValues' STORE
+    <% $lrTicks SIZE 2 < %>
+    <% [ $lrOrigin NaN NaN NaN NaN ] %>
+    <%
+        @linearRegression
+        [ $lrOrigin NaN NaN NaN ` + result + ` ]
+    %>
+    IFTE
+%>
+MACROMAPPER 'trendMapper' STORE
+`)
+	buffer.WriteString(prefix + "[ SWAP $trendMapper " + pre + " 0 0 ] MAP")
+
+	return buffer.String(), nil
+}
+
+// anomaly generate WarpScript line for a zscore, outliers or bands statement
+func (protoParser *ProtoParser) anomaly(framework FrameworkStatement, prefix string) (string, error) {
+	var buffer bytes.Buffer
+
+	// Z-score on the complete series
+	if framework.operator == ZSCORE {
+		if _, hasWindow := framework.attributes[MapperSampling]; !hasWindow {
+			buffer.WriteString("<% DROP [ SWAP mapper.todouble 0 0 0 ] MAP 0 GET false ZSCORE %> LMAP")
+			return buffer.String(), nil
+		}
+	}
+
+	if framework.operator == OUTLIERS {
+		method := framework.unNamedAttributes[0].lit
+		threshold := framework.attributes[MapperValue].lit
+
+		buffer.WriteString("<%\n")
+		buffer.WriteString(prefix + "    DROP [ SWAP mapper.todouble 0 0 0 ] MAP 0 GET 'outlierSeries' STORE\n")
+		if method == "esd" {
+			buffer.WriteString(prefix + "    $outlierSeries " + threshold + " false ESDTEST 'outlierTicks' STORE\n")
+		} else {
+			buffer.WriteString(prefix + "    [ $outlierSeries true ZSCORE mapper.abs 0 0 0 ] MAP 0 GET " + threshold + " THRESHOLDTEST 'outlierTicks' STORE\n")
+		}
+
+		// Returns a boolean series or only the flagged points
+		asBoolean, hasBoolean := framework.unNamedAttributes[2]
+		if hasBoolean && asBoolean.tokenType == TRUE {
+			buffer.WriteString(prefix + "    [ $outlierSeries false mapper.replace 0 0 0 ] MAP 0 GET\n")
+			buffer.WriteString(prefix + "    $outlierTicks <% NaN NaN NaN true SETVALUE %> FOREACH\n")
+		} else {
+			buffer.WriteString(prefix + "    $outlierSeries CLONEEMPTY\n")
+			buffer.WriteString(prefix + "    $outlierTicks <% 'outlierTick' STORE $outlierSeries $outlierTick ATTICK LIST-> DROP ADDVALUE %> FOREACH\n")
+		}
+		buffer.WriteString(prefix + "%>\n")
+		buffer.WriteString(prefix + "LMAP")
+		return buffer.String(), nil
+	}
+
+	// Sliding mean and standard deviation on the window duration
+	pre := "-" + protoParser.parseShift(framework.attributes[MapperSampling].lit)
+
+	buffer.WriteString("<%\n")
+	buffer.WriteString(prefix + "    DROP 'anomalySeries' STORE\n")
+	buffer.WriteString(prefix + "    [ $anomalySeries mapper.mean " + pre + " 0 0 ] MAP 'anomalyMean' STORE\n")
+	buffer.WriteString(prefix + "    [ $anomalySeries " + toWarpScript[STDDEV] + " " + pre + " 0 0 ] MAP 'anomalyStd' STORE\n")
+
+	if framework.operator == ZSCORE {
+		buffer.WriteString(prefix + "    [ [ $anomalySeries ] $anomalyMean [] op.sub ] APPLY 'anomalyDeviation' STORE\n")
+		buffer.WriteString(prefix + "    [ $anomalyDeviation $anomalyStd [] op.div ] APPLY 0 GET\n")
+	} else {
+		buffer.WriteString(prefix + "    [ $anomalyStd " + framework.attributes[MapperValue].lit + " mapper.mul 0 0 0 ] MAP 'anomalyDeviation' STORE\n")
+		buffer.WriteString(prefix + "    [ $anomalyMean $anomalyDeviation [] op.add ] APPLY 0 GET { 'band' 'upper' } RELABEL\n")
+		buffer.WriteString(prefix + "    [ $anomalyMean $anomalyDeviation [] op.sub ] APPLY 0 GET { 'band' 'lower' } RELABEL\n")
+		buffer.WriteString(prefix + "    2 ->LIST\n")
+	}
+	buffer.WriteString(prefix + "%>\n")
+	buffer.WriteString(prefix + "LMAP")
+
+	if framework.operator == BANDS {
+		buffer.WriteString(" FLATTEN")
+	}
+	return buffer.String(), nil
+}
+
 // operators generate WarpScript line for an individual statement
 func (protoParser *ProtoParser) operators(framework FrameworkStatement) string {
 	operatorString := toWarpScript[framework.operator]
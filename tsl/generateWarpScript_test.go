@@ -0,0 +1,398 @@
+package tsl
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func parseInstructions(t *testing.T, query string) []Instruction {
+	t.Helper()
+
+	parser, err := NewParser(strings.NewReader(query), "http://127.0.0.1:8080", "TOKEN", 0, "", "", nil)
+	if err != nil {
+		t.Fatalf("unexpected parser error: %v", err)
+	}
+	parsed, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("unexpected parse error on %q: %v", query, err)
+	}
+
+	instructions := []Instruction{}
+	for _, instruction := range parsed.Statements {
+		instructions = append(instructions, *instruction)
+	}
+	return instructions
+}
+
+func TestTimeUnitTicks(t *testing.T) {
+	tests := []struct {
+		timeUnit string
+		ticks    int64
+	}{
+		{"ns", 1000000000},
+		{"us", 1000000},
+		{"ms", 1000},
+		{"", 1000000},
+	}
+
+	for _, test := range tests {
+		ticks, err := TimeUnitTicks(test.timeUnit)
+		if err != nil {
+			t.Fatalf("unexpected error for time unit %q: %v", test.timeUnit, err)
+		}
+		if ticks != test.ticks {
+			t.Errorf("time unit %q: expected %d ticks per second, got %d", test.timeUnit, test.ticks, ticks)
+		}
+	}
+
+	if _, err := TimeUnitTicks("s"); err == nil {
+		t.Error("expected an error for an unsupported time unit")
+	}
+}
+
+func TestGenerateWarpScriptTimeUnit(t *testing.T) {
+	tests := []struct {
+		timeUnit string
+		check    string
+	}{
+		{"ns", "STU 1000000000 != <% 'TSL expects a Warp 10 platform time unit in ns' MSGFAIL %> IFT\n"},
+		{"us", "STU 1000000 != <% 'TSL expects a Warp 10 platform time unit in us' MSGFAIL %> IFT\n"},
+		{"ms", "STU 1000 != <% 'TSL expects a Warp 10 platform time unit in ms' MSGFAIL %> IFT\n"},
+	}
+
+	for _, test := range tests {
+		instructions := parseInstructions(t, `select("cpu").from(1346846400000, to=1346850000000)`)
+
+		// The endpoint time unit overrides the default one
+		protoParser := ProtoParser{Name: "warp 10", TimeUnit: "us", EndpointTimeUnits: map[string]string{"http://127.0.0.1:8080": test.timeUnit}}
+		warpScript, err := protoParser.GenerateWarpScript(instructions, false)
+		if err != nil {
+			t.Fatalf("time unit %q: unexpected error: %v", test.timeUnit, err)
+		}
+		if !strings.HasPrefix(warpScript, test.check) {
+			t.Errorf("time unit %q: expected the script to start with %q, got %q", test.timeUnit, test.check, warpScript)
+		}
+
+		// Integer dates are platform ticks, and now and durations platform functions, whatever the unit
+		for _, expected := range []string{"NOW 'now' STORE", "1346846400000  ISO8601 1346850000000  ISO8601"} {
+			if !strings.Contains(warpScript, expected) {
+				t.Errorf("time unit %q: expected %q in %q", test.timeUnit, expected, warpScript)
+			}
+		}
+
+		// The default time unit applies to other endpoints
+		protoParser = ProtoParser{Name: "warp 10", TimeUnit: test.timeUnit, EndpointTimeUnits: map[string]string{"http://127.0.0.1:8081": "ns"}}
+		warpScript, err = protoParser.GenerateWarpScript(instructions, false)
+		if err != nil {
+			t.Fatalf("time unit %q: unexpected error: %v", test.timeUnit, err)
+		}
+		if !strings.HasPrefix(warpScript, test.check) {
+			t.Errorf("default time unit %q: expected the script to start with %q, got %q", test.timeUnit, test.check, warpScript)
+		}
+	}
+}
+
+func TestGenerateWarpScriptWithoutTimeUnit(t *testing.T) {
+	instructions := parseInstructions(t, `select("cpu").last(1h).timeclip(now, 30m)`)
+
+	protoParser := ProtoParser{Name: "warp 10"}
+	warpScript, err := protoParser.GenerateWarpScript(instructions, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(warpScript, "STU") {
+		t.Errorf("expected no time unit check without time unit, got %q", warpScript)
+	}
+	for _, expected := range []string{"1 h", "$now 30 m"} {
+		if !strings.Contains(warpScript, expected) {
+			t.Errorf("expected the platform duration %q in %q", expected, warpScript)
+		}
+	}
+}
+
+func TestGenerateWarpScriptUnsupportedTimeUnit(t *testing.T) {
+	instructions := parseInstructions(t, `select("cpu").last(1h)`)
+
+	protoParser := ProtoParser{Name: "warp 10", EndpointTimeUnits: map[string]string{"http://127.0.0.1:8080": "s"}}
+	if _, err := protoParser.GenerateWarpScript(instructions, false); err == nil {
+		t.Error("expected an error for an unsupported endpoint time unit")
+	}
+}
+
+func TestGenerateWarpScriptNow(t *testing.T) {
+	instructions := parseInstructions(t, `select("cpu").last(1h).sampleBy(1m, mean)`)
+
+	protoParser := ProtoParser{Name: "warp 10", Now: time.Date(2020, 1, 1, 12, 0, 0, 500000000, time.UTC)}
+	warpScript, err := protoParser.GenerateWarpScript(instructions, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(warpScript, "'2020-01-01T12:00:00.5Z' TOTIMESTAMP 'now' STORE\n") {
+		t.Errorf("expected the shared now to be stored, got %q", warpScript)
+	}
+}
+
+func TestGenerateWarpScriptGroupOperator(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{
+			`mul(select("http_requests").last(1h), select("instance_info").last(1h)).on("instance").groupLeft("version")`,
+			[]string{
+				"LIST-> DROP 'groupOne' STORE 'groupMany' STORE\n",
+				`<% LABELS 'groupMatchLabels' STORE [ "instance" ] <% DROP $groupMatchLabels SWAP GET`,
+				"'multiple matches for labels: many-to-one matching must be explicit (groupLeft)' MSGFAIL",
+				"[ [ $groupManySeries ] [ $groupOneSeries ] [] op.mul ] APPLY 0 GET\n",
+				"{ 'version' $groupOneLabels 'version' GET <% DUP ISNULL %> <% DROP '' %> IFT } RELABEL\n",
+			},
+		},
+		{
+			`mul(select("instance_info").last(1h), select("http_requests").last(1h)).ignoring("job").groupRight()`,
+			[]string{
+				"LIST-> DROP 'groupMany' STORE 'groupOne' STORE\n",
+				`$groupMatchLabels KEYLIST ->SET [ "job" ] ->SET DIFFERENCE`,
+				"[ [ $groupOneSeries ] [ $groupManySeries ] [] op.mul ] APPLY 0 GET\n",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		protoParser := ProtoParser{Name: "warp 10"}
+		warpScript, err := protoParser.GenerateWarpScript(parseInstructions(t, test.query), false)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.query, err)
+		}
+		for _, expected := range test.expected {
+			if !strings.Contains(warpScript, expected) {
+				t.Errorf("%s: expected %q in %q", test.query, expected, warpScript)
+			}
+		}
+	}
+
+	// Without group labels, the "one" side labels aren't copied
+	protoParser := ProtoParser{Name: "warp 10"}
+	warpScript, err := protoParser.GenerateWarpScript(parseInstructions(t, `mul(select("a").last(1h), select("b").last(1h)).on("host").groupLeft()`), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(warpScript, "groupOneLabels") {
+		t.Errorf("expected no group labels copy, got %q", warpScript)
+	}
+}
+
+func TestGenerateWarpScriptTrendOperators(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{
+			// Forecast samples series on one minute by default
+			`select("cpu").last(1h).forecast(1h)`,
+			[]string{
+				"[ $raw bucketizer.last $now 1 m  / 1 m  * 1 m  + 1 m  1 h 1 m  / ] BUCKETIZE",
+				"1 1 h $forecastBucketSpan /\n",
+			},
+		},
+		{
+			`select("cpu").last(1h).sampleBy(5m, mean).forecast(2h)`,
+			[]string{
+				"[ $raw bucketizer.mean $now 5 m  / 5 m  * 5 m  + 5 m  1 h 5 m  / ] BUCKETIZE",
+				"1 2 h $forecastBucketSpan /\n",
+			},
+		},
+		{
+			`select("cpu").last(1h).sampleBy(1m, last).deriv()`,
+			[]string{"[ $lrOrigin NaN NaN NaN $lrSlope ]", "[ SWAP $trendMapper 1 m  -1 * 0 0 ] MAP"},
+		},
+		{
+			`select("cpu").last(1h).sampleBy(1m, last).predictLinear(4h, 10m)`,
+			[]string{"$lrIntercept $lrSlope 4 h TODOUBLE 1 s / * +", "[ SWAP $trendMapper -10 m 0 0 ] MAP"},
+		},
+		{
+			`select("cpu").last(1h).sampleBy(1m, last).holtWinters(0.5, 0.3)`,
+			[]string{"0.5  'hwSmoothing' STORE\n", "0.3  'hwTrend' STORE\n", "[ SWAP $trendMapper 1 m  -1 * 0 0 ] MAP"},
+		},
+	}
+
+	for _, test := range tests {
+		protoParser := ProtoParser{Name: "warp 10"}
+		warpScript, err := protoParser.GenerateWarpScript(parseInstructions(t, test.query), false)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.query, err)
+		}
+		for _, expected := range test.expected {
+			if !strings.Contains(warpScript, expected) {
+				t.Errorf("%s: expected %q in %q", test.query, expected, warpScript)
+			}
+		}
+	}
+}
+
+func TestGenerateWarpScriptAnomalyOperators(t *testing.T) {
+	defaultSampler := "[ $raw bucketizer.last $now 1 m  / 1 m  * 1 m  + 1 m  1 h 1 m  / ] BUCKETIZE"
+	sampler := "[ $raw bucketizer.mean $now 5 m  / 5 m  * 5 m  + 5 m  1 h 5 m  / ] BUCKETIZE"
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{
+			`select("cpu").last(1h).zscore()`,
+			[]string{defaultSampler, "<% DROP [ SWAP mapper.todouble 0 0 0 ] MAP 0 GET false ZSCORE %> LMAP"},
+		},
+		{
+			`select("cpu").last(1h).sampleBy(5m, mean).zscore(1h)`,
+			[]string{sampler, "[ $anomalySeries mapper.mean -1 h 0 0 ] MAP 'anomalyMean' STORE", "[ $anomalyDeviation $anomalyStd [] op.div ] APPLY 0 GET"},
+		},
+		{
+			`select("cpu").last(1h).outliers("esd", 5)`,
+			[]string{defaultSampler, "$outlierSeries 5 false ESDTEST 'outlierTicks' STORE"},
+		},
+		{
+			`select("cpu").last(1h).sampleBy(5m, mean).outliers("mad", 3.5, true)`,
+			[]string{sampler, "[ $outlierSeries true ZSCORE mapper.abs 0 0 0 ] MAP 0 GET 3.5 THRESHOLDTEST", "[ $outlierSeries false mapper.replace 0 0 0 ] MAP 0 GET"},
+		},
+		{
+			`select("cpu").last(1h).bands(1h, 2)`,
+			[]string{defaultSampler, "[ $anomalyStd 2 mapper.mul 0 0 0 ] MAP 'anomalyDeviation' STORE", "{ 'band' 'upper' } RELABEL", "{ 'band' 'lower' } RELABEL"},
+		},
+		{
+			`select("cpu").last(1h).sampleBy(5m, mean).bands(1h, 2)`,
+			[]string{sampler, "[ $anomalySeries mapper.mean -1 h 0 0 ] MAP 'anomalyMean' STORE"},
+		},
+	}
+
+	for _, test := range tests {
+		protoParser := ProtoParser{Name: "warp 10"}
+		warpScript, err := protoParser.GenerateWarpScript(parseInstructions(t, test.query), false)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.query, err)
+		}
+		for _, expected := range test.expected {
+			if !strings.Contains(warpScript, expected) {
+				t.Errorf("%s: expected %q in %q", test.query, expected, warpScript)
+			}
+		}
+	}
+}
+
+func TestGenerateWarpScriptMathMappers(t *testing.T) {
+	macroMapper := func(function string) string {
+		return "[ SWAP <% 'mapping' STORE [ $mapping 0 GET NaN NaN NaN $mapping 7 GET 0 GET TODOUBLE " + function + " ] %> MACROMAPPER 0 0 0 ] MAP"
+	}
+
+	tests := []struct {
+		method   string
+		expected string
+	}{
+		{"pow(2)", "[ SWAP 2 mapper.pow 0 0 0 ] MAP"},
+		{"exp()", "[ SWAP e mapper.exp 0 0 0 ] MAP"},
+		{"sin()", macroMapper("SIN")},
+		{"cos()", macroMapper("COS")},
+		{"tan()", macroMapper("TAN")},
+		{"sgn()", macroMapper("SIGNUM")},
+		{"mod(60)", macroMapper("60  %")},
+		{"clamp(-1.5, 2)", "[ SWAP -1.5  mapper.max.x 0 0 0 ] MAP [ SWAP 2  mapper.min.x 0 0 0 ] MAP"},
+	}
+
+	for _, test := range tests {
+		protoParser := ProtoParser{Name: "warp 10"}
+		warpScript, err := protoParser.GenerateWarpScript(parseInstructions(t, `select("cpu").last(1h).`+test.method), false)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.method, err)
+		}
+		if !strings.Contains(warpScript, test.expected) {
+			t.Errorf("%s: expected %q in %q", test.method, test.expected, warpScript)
+		}
+	}
+}
+
+func TestGenerateWarpScriptTimezone(t *testing.T) {
+	protoParser := ProtoParser{Name: "warp 10"}
+	warpScript, err := protoParser.GenerateWarpScript(parseInstructions(t, `select("cpu").last(1h).sampleBy(1d, last, tz="Europe/Paris").hour(tz="Europe/Paris")`), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, expected := range []string{
+		"$now 1 d  / 1 d  * 1 d  + 'Europe/Paris' TSELEMENTS 0 3 SET 0 4 SET 0 5 SET 0 6 SET 'Europe/Paris' TSELEMENTS->",
+		"[ SWAP 'Europe/Paris' mapper.hour 0 0 0 ] MAP",
+	} {
+		if !strings.Contains(warpScript, expected) {
+			t.Errorf("expected %q in %q", expected, warpScript)
+		}
+	}
+
+	// The timezone header applies to calendar methods without timezone
+	parser, err := NewParserWithTimezone(strings.NewReader(`select("cpu").last(1h).day()`), "http://127.0.0.1:8080", "TOKEN", 0, "", "", "America/New_York", nil)
+	if err != nil {
+		t.Fatalf("unexpected parser error: %v", err)
+	}
+	parsed, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	warpScript, err = protoParser.GenerateWarpScript([]Instruction{*parsed.Statements[0]}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(warpScript, "[ SWAP 'America/New_York' mapper.day 0 0 0 ] MAP") {
+		t.Errorf("expected the header timezone in %q", warpScript)
+	}
+}
+
+func TestGenerateWarpScriptSharedFetches(t *testing.T) {
+	query := "select(\"cpu\").last(1h)\nselect(\"cpu\").last(1h).sampleBy(1m, max)\nselect(\"mem\").last(1h)"
+
+	protoParser := ProtoParser{Name: "warp 10"}
+	warpScript, err := protoParser.GenerateWarpScript(parseInstructions(t, query), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(warpScript, "'sharedFetch0' STORE\n") {
+		t.Errorf("expected the cpu fetch to be stored once, got %q", warpScript)
+	}
+	if strings.Contains(warpScript, "sharedFetch1") {
+		t.Errorf("expected only one shared fetch, got %q", warpScript)
+	}
+	if count := strings.Count(warpScript, "$sharedFetch0 <% DROP CLONE SWAP DROP %> LMAP"); count != 2 {
+		t.Errorf("expected both cpu statements to reuse a copy of the shared fetch, got %d in %q", count, warpScript)
+	}
+	if count := strings.Count(warpScript, "'cpu'"); count != 1 {
+		t.Errorf("expected the cpu series to be fetched once, got %d fetches in %q", count, warpScript)
+	}
+	if count := strings.Count(warpScript, "'mem'"); count != 1 {
+		t.Errorf("expected the mem select to keep its own fetch, got %d fetches in %q", count, warpScript)
+	}
+}
+
+func TestGenerateWarpScriptSharedFetchesNativeVariables(t *testing.T) {
+	query := "select(metric).last(1h)\nselect(metric).last(1h)"
+
+	parser, err := NewParser(strings.NewReader(query), "http://127.0.0.1:8080", "TOKEN", 0, "", "", []string{"metric"})
+	if err != nil {
+		t.Fatalf("unexpected parser error: %v", err)
+	}
+	parsed, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	instructions := []Instruction{}
+	for _, instruction := range parsed.Statements {
+		instructions = append(instructions, *instruction)
+	}
+
+	protoParser := ProtoParser{Name: "warp 10"}
+	warpScript, err := protoParser.GenerateWarpScript(instructions, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(warpScript, "sharedFetch") {
+		t.Errorf("expected no shared fetch for a select using a native variable, got %q", warpScript)
+	}
+	if count := strings.Count(warpScript, "$metric"); count != 2 {
+		t.Errorf("expected each statement to fetch its series, got %d fetches in %q", count, warpScript)
+	}
+}
@@ -16,6 +16,7 @@ const (
 	lineStartHeader     = "TSL-Line-Start"
 	queryRandeHeader    = "TSL-Query-Range"
 	samplersCountHeader = "TSL-Samplers"
+	timezoneHeader      = "TSL-Timezone"
 )
 
 var reZeroOnly = regexp.MustCompile(`^\s*0+\s*$`)
@@ -28,6 +29,12 @@ var reZeroOnly = regexp.MustCompile(`^\s*0+\s*$`)
 type ProtoParser struct {
 	LineStart int    // Reset line counter to lineStart
 	Name      string // Proto name
+	TimeUnit  string // Warp 10 platform time unit (ns, us or ms), unchecked when empty
+
+	EndpointTimeUnits map[string]string // Warp 10 platform time unit per endpoint, overriding TimeUnit
+	Now               time.Time         // Warp 10 now shared with other back-ends, the platform current time when zero
+
+	sharedFetches map[string]string // Fetches used by several statements and their WarpScript variable
 }
 
 // Parser represents a TSL parser
@@ -38,6 +45,8 @@ type Parser struct {
 	defaultURI    string
 	defaultToken  string
 	samplersCount string
+	timezone      string
+	now           time.Time
 	hasQueryRange bool
 	queryRange    *QueryRange
 }
@@ -52,6 +61,11 @@ type QueryRange struct {
 
 // NewParser returns a new instance of Parser
 func NewParser(r io.Reader, defaultURI, defaultToken string, lineHeader int, queryRange string, samplersCount string, variableList []string) (*Parser, error) {
+	return NewParserWithTimezone(r, defaultURI, defaultToken, lineHeader, queryRange, samplersCount, "", variableList)
+}
+
+// NewParserWithTimezone returns a new instance of Parser whose calendar methods and samplers default to a IANA timezone
+func NewParserWithTimezone(r io.Reader, defaultURI, defaultToken string, lineHeader int, queryRange string, samplersCount string, timezone string, variableList []string) (*Parser, error) {
 
 	hasQueryRange := false
 	parserQueryRange := &QueryRange{}
@@ -73,6 +87,12 @@ func NewParser(r io.Reader, defaultURI, defaultToken string, lineHeader int, que
 		}
 	}
 
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("Error in header %q, expects a valid IANA timezone", timezoneHeader)
+		}
+	}
+
 	variables := make(map[string]*Variable)
 
 	for _, variable := range variableList {
@@ -80,7 +100,7 @@ func NewParser(r io.Reader, defaultURI, defaultToken string, lineHeader int, que
 	}
 
 	return &Parser{s: newBufScanner(r), variables: variables, defaultURI: defaultURI, defaultToken: defaultToken, lineStart: lineHeader,
-		hasQueryRange: hasQueryRange, queryRange: parserQueryRange, samplersCount: lit}, nil
+		hasQueryRange: hasQueryRange, queryRange: parserQueryRange, samplersCount: lit, timezone: timezone, now: time.Now()}, nil
 }
 
 func (qr *QueryRange) queryRangeParser(queryRange string) error {
@@ -243,10 +263,6 @@ loop:
 			break loop
 		case CONNECT:
 
-			if internCall {
-				return nil, nil, fmt.Errorf("function %q isn't allowed in an operator at %d, char %d", CONNECT.String(), pos.Line+1, pos.Char+1)
-			}
-
 			if loadVariable {
 				return nil, nil, fmt.Errorf("function %q isn't allowed when declaring a variable at %d, char %d", CONNECT.String(), pos.Line+1, pos.Char+1)
 			}
@@ -605,7 +621,7 @@ loop:
 			}
 
 		case IGNORING:
-			if !instruction.globalOperator.isOn {
+			if instruction.globalOperator.isOn {
 				errMessage := fmt.Sprintf("Conflict with function %q, can't be applied with on function", tok.String())
 				return nil, p.NewTslError(errMessage, pos)
 			}
@@ -617,7 +633,7 @@ loop:
 
 		case GROUPLEFT, GROUPRIGHT:
 
-			if len(instruction.globalOperator.labels) == 0 && len(instruction.globalOperator.ignoring) == 0 {
+			if !instruction.globalOperator.isOn && !instruction.globalOperator.isIgnoring {
 				errMessage := fmt.Sprintf("Found function %q, this function expects to find on or ignoring function before on current operator", tok.String())
 				return nil, p.NewTslError(errMessage, pos)
 			}
@@ -626,6 +642,12 @@ loop:
 				return nil, p.NewTslError(errMessage, pos)
 			}
 
+			switch instruction.globalOperator.operator {
+			case ANDL, ORL, MASK, NEGMASK:
+				errMessage := fmt.Sprintf("Found function %q, a group method can't be applied on %q operator", tok.String(), instruction.globalOperator.operator.String())
+				return nil, p.NewTslError(errMessage, pos)
+			}
+
 			if tok == GROUPLEFT {
 				left := InternalField{tokenType: GROUPLEFT, lit: "group_left"}
 				instruction.globalOperator.group = left
@@ -797,13 +819,21 @@ loop:
 
 			hasSampling = true
 
-		case ADDSERIES, SUBSERIES, MULSERIES, DIVSERIES, EQUAL, MAXWITH, MINWITH, NOTEQUAL, GREATERTHAN, GREATEROREQUAL, LESSTHAN, LESSOREQUAL, LOGN, SHRINK, KEEPFIRSTVALUES, KEEPLASTVALUES, KEEPFIRSTVALUE, KEEPLASTVALUE, TIMESCALE:
+		case ADDSERIES, SUBSERIES, MULSERIES, DIVSERIES, EQUAL, MAXWITH, MINWITH, NOTEQUAL, GREATERTHAN, GREATEROREQUAL, LESSTHAN, LESSOREQUAL, LOGN, SHRINK, KEEPFIRSTVALUES, KEEPLASTVALUES, KEEPFIRSTVALUE, KEEPLASTVALUE, TIMESCALE,
+			CLAMP, MOD, POW:
 			instruction, err = p.parseSingleNumericOperator(tok, pos, lit, instruction)
 
 			if err != nil {
 				return nil, err
 			}
 
+		case HISTOGRAMQUANTILE, HISTOGRAMFRACTION:
+			instruction, err = p.parseHistogramOperator(tok, pos, lit, instruction)
+
+			if err != nil {
+				return nil, err
+			}
+
 		case TIMECLIP, TIMEMODULO, TIMESPLIT, QUANTIZE:
 			instruction, err = p.parseOperators(tok, pos, lit, instruction)
 
@@ -825,6 +855,20 @@ loop:
 				return nil, err
 			}
 
+		case DERIV, FORECAST, HOLTWINTERS, PREDICTLINEAR:
+			instruction, err = p.parseTrendOperator(tok, pos, lit, instruction, hasSampling)
+
+			if err != nil {
+				return nil, err
+			}
+
+		case BANDS, OUTLIERS, ZSCORE:
+			instruction, err = p.parseAnomalyOperator(tok, pos, lit, instruction, hasSampling)
+
+			if err != nil {
+				return nil, err
+			}
+
 		case DELTA, MEAN, MEDIAN, MIN, MAX, COUNT, STDDEV, STDVAR, SUM, JOIN, PERCENTILE, FINITE:
 			instruction, err = p.parseWindowOperator(tok, pos, lit, instruction, hasSampling)
 
@@ -832,13 +876,20 @@ loop:
 				return nil, err
 			}
 
-		case ADDNAMEPREFIX, ADDNAMESUFFIX, RENAME, RENAMEBY, RENAMETEMPLATE, STORE, FILTERBYNAME, FILTERBYLASTVALUE:
+		case ADDNAMEPREFIX, ADDNAMESUFFIX, RENAME, RENAMEBY, RENAMETEMPLATE, FILTERBYNAME, FILTERBYLASTVALUE:
 			instruction, err = p.parseNStringOperator(tok, pos, lit, 1, instruction)
 
 			if err != nil {
 				return nil, err
 			}
 
+		case STORE:
+			instruction, err = p.parseStore(tok, pos, lit, instruction)
+
+			if err != nil {
+				return nil, err
+			}
+
 		case REMOVELABELS, FILTERBYLABELS, FILTERWITHOUTLABELS:
 			instruction, err = p.parseNStringOperator(tok, pos, lit, -1, instruction)
 
@@ -867,7 +918,15 @@ loop:
 				return nil, err
 			}
 
-		case ABS, CEIL, CUMULATIVESUM, DAY, FLOOR, HOUR, LN, LOG2, LOG10, MINUTE, MONTH, ROUND, RESETS, SQRT, TIMESTAMP, WEEKDAY, YEAR, TOBOOLEAN, TODOUBLE, TOLONG, TOSTRING:
+		case DAY, HOUR, MINUTE, MONTH, WEEKDAY, YEAR:
+			instruction, err = p.parseCalendarOperator(tok, pos, lit, instruction)
+
+			if err != nil {
+				return nil, err
+			}
+
+		case ABS, CEIL, CUMULATIVESUM, FLOOR, LN, LOG2, LOG10, ROUND, RESETS, SQRT, TIMESTAMP, TOBOOLEAN, TODOUBLE, TOLONG, TOSTRING,
+			COS, EXP, SGN, SIN, TAN:
 			instruction, err = p.parseNoOperator(tok, pos, lit, instruction)
 
 			if err != nil {
@@ -1467,7 +1526,8 @@ func (p *Parser) parseIgnoringLabels(tok Token, pos Pos, lit string, instruction
 				fieldsString[k] = v.lit
 			}
 			// Append where result into instruction where
-			instruction.globalOperator.ignoring = append(instruction.globalOperator.labels, fieldsString...)
+			instruction.globalOperator.ignoring = append(instruction.globalOperator.ignoring, fieldsString...)
+			instruction.globalOperator.isIgnoring = true
 
 			return instruction, nil
 		}
@@ -1485,6 +1545,7 @@ func (p *Parser) parseIgnoringLabels(tok Token, pos Pos, lit string, instruction
 
 	// Append where result into instruction where
 	instruction.globalOperator.ignoring = append(instruction.globalOperator.ignoring, fieldsString...)
+	instruction.globalOperator.isIgnoring = true
 
 	return instruction, nil
 }
@@ -1516,6 +1577,7 @@ func (p *Parser) parseOnLabels(tok Token, pos Pos, lit string, instruction *Inst
 			}
 			// Append where result into instruction where
 			instruction.globalOperator.labels = append(instruction.globalOperator.labels, fieldsString...)
+			instruction.globalOperator.isOn = true
 
 			return instruction, nil
 		}
@@ -1533,6 +1595,7 @@ func (p *Parser) parseOnLabels(tok Token, pos Pos, lit string, instruction *Inst
 
 	// Append where result into instruction where
 	instruction.globalOperator.labels = append(instruction.globalOperator.labels, fieldsString...)
+	instruction.globalOperator.isOn = true
 
 	return instruction, nil
 }
@@ -1594,18 +1657,23 @@ func (p *Parser) getWhereField(lit string, pos Pos) (*WhereField, error) {
 func (p *Parser) parseFrom(tok Token, pos Pos, lit string, instruction *Instruction) (*Instruction, error) {
 
 	// Load from fields that can be empty or prefixed by "from=" or "to="
+	// Time expressions are accepted as NOW fields and evaluated as STRING dates
 	zeroFields := []InternalField{{tokenType: STRING, prefixName: FromFrom, hasPrefixName: true},
 		{tokenType: NUMBER, prefixName: FromFrom, hasPrefixName: true},
 		{tokenType: INTEGER, prefixName: FromFrom, hasPrefixName: true},
+		{tokenType: NOW, prefixName: FromFrom, hasPrefixName: true},
 		{tokenType: STRING},
 		{tokenType: NUMBER},
-		{tokenType: INTEGER}}
+		{tokenType: INTEGER},
+		{tokenType: NOW}}
 	oneFields := []InternalField{{tokenType: STRING, prefixName: FromTo, hasPrefixName: true},
 		{tokenType: NUMBER, prefixName: FromTo, hasPrefixName: true},
 		{tokenType: INTEGER, prefixName: FromTo, hasPrefixName: true},
+		{tokenType: NOW, prefixName: FromTo, hasPrefixName: true},
 		{tokenType: STRING},
 		{tokenType: NUMBER},
-		{tokenType: INTEGER}}
+		{tokenType: INTEGER},
+		{tokenType: NOW}}
 	fromFields := map[int][]InternalField{0: zeroFields, 1: oneFields}
 
 	fields, err := p.ParseFields(tok.String(), fromFields, 2)
@@ -1647,13 +1715,15 @@ func (p *Parser) parseLast(tok Token, pos Pos, lit string, instruction *Instruct
 		{tokenType: INTEGER, prefixName: LastTimestamp, hasPrefixName: true},
 		{tokenType: NUMBER, prefixName: LastTimestamp, hasPrefixName: true},
 		{tokenType: STRING, prefixName: LastDate, hasPrefixName: true},
+		{tokenType: NOW, prefixName: LastDate, hasPrefixName: true},
 		{tokenType: NATIVEVARIABLE, prefixName: LastShift, hasPrefixName: true},
 		{tokenType: NATIVEVARIABLE, prefixName: LastTimestamp, hasPrefixName: true},
 		{tokenType: NATIVEVARIABLE, prefixName: LastDate, hasPrefixName: true},
 		{tokenType: DURATIONVAL},
 		{tokenType: INTEGER},
 		{tokenType: NUMBER},
-		{tokenType: STRING}}
+		{tokenType: STRING},
+		{tokenType: NOW}}
 
 	// Create lastFields variable from generic first and alternative fields arrays
 	lastFields := map[int][]InternalField{0: zeroFields, 1: alternativeFields, 2: alternativeFields}
@@ -1706,6 +1776,190 @@ func (p *Parser) parseLast(tok Token, pos Pos, lit string, instruction *Instruct
 	return instruction, nil
 }
 
+// acceptsTimeExpression returns true when a NOW field is expected
+func acceptsTimeExpression(fields []InternalField) bool {
+	for _, field := range fields {
+		if field.tokenType == NOW {
+			return true
+		}
+	}
+	return false
+}
+
+// Time expression functions
+const (
+	startOfDay   = "startOfDay"
+	startOfWeek  = "startOfWeek"
+	startOfMonth = "startOfMonth"
+)
+
+// parseTimeExpression evaluates a time expression: now, a date string or a startOfDay, startOfWeek or startOfMonth function,
+// followed by durations to add or to subtract. An evaluated expression is returned as a STRING RFC3339 date,
+// a single now and other tokens are left unchanged. It also returns whether the evaluated date depends on now
+func (p *Parser) parseTimeExpression(function string, tok Token, pos Pos, lit string) (Token, string, bool, error) {
+	isExpression := tok == NOW || (tok == IDENT && (lit == startOfDay || lit == startOfWeek || lit == startOfMonth))
+
+	if !isExpression && tok != STRING {
+		return tok, lit, false, nil
+	}
+
+	next, _, nextLit := p.ScanIgnoreWhitespace()
+	p.Unscan()
+	hasDuration := next == DURATIONVAL || (next == ILLEGAL && (nextLit == "+" || nextLit == "-"))
+
+	// A single now is kept for the backends, a single date string is normalized to RFC3339 when it's a valid ISO8601 date
+	if tok == NOW && !hasDuration {
+		return tok, lit, false, nil
+	}
+	if tok == STRING && !hasDuration {
+		date, _, err := p.parseTimeTerm(function, tok, pos, lit)
+		if err != nil {
+			return tok, lit, false, nil
+		}
+		return STRING, date.UTC().Format(time.RFC3339Nano), false, nil
+	}
+
+	date, isRelative, err := p.parseTimeTerm(function, tok, pos, lit)
+	if err != nil {
+		return tok, lit, false, err
+	}
+
+	// Add or subtract durations
+	for {
+		tok, pos, lit = p.ScanIgnoreWhitespace()
+
+		sign := ""
+		if tok == ILLEGAL && (lit == "+" || lit == "-") {
+			sign = lit
+			tok, pos, lit = p.ScanIgnoreWhitespace()
+			if tok != DURATIONVAL || strings.HasPrefix(lit, "-") {
+				errMessage := fmt.Sprintf("Error in %q function, expects a duration after %q in time expression, got %q", function, sign, tokstr(tok, lit))
+				return tok, lit, false, p.NewTslError(errMessage, pos)
+			}
+		} else if tok != DURATIONVAL {
+			p.Unscan()
+			break
+		}
+
+		if sign == "-" {
+			lit = "-" + lit
+		}
+
+		date, err = addTimeDuration(date, lit)
+		if err != nil {
+			errMessage := fmt.Sprintf("Error in %q function, %s", function, err.Error())
+			return tok, lit, false, p.NewTslError(errMessage, pos)
+		}
+	}
+
+	return STRING, date.UTC().Format(time.RFC3339Nano), isRelative, nil
+}
+
+// parseTimeTerm evaluates the first term of a time expression and returns whether it depends on now
+func (p *Parser) parseTimeTerm(function string, tok Token, pos Pos, lit string) (time.Time, bool, error) {
+	location := time.UTC
+	if p.timezone != "" {
+		location, _ = time.LoadLocation(p.timezone)
+	}
+
+	switch tok {
+	case NOW:
+		return p.now, true, nil
+	case STRING:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+			if date, err := time.ParseInLocation(layout, lit, location); err == nil {
+				return date, false, nil
+			}
+		}
+		errMessage := fmt.Sprintf("Error in %q function, expects an ISO8601 date in time expression, got %q", function, lit)
+		return time.Time{}, false, p.NewTslError(errMessage, pos)
+	}
+
+	// Load startOf function parameter
+	if next, nextPos, nextLit := p.ScanIgnoreWhitespace(); next != LPAREN {
+		errMessage := fmt.Sprintf("Error in %q function, %q expects a (, got %q", function, lit, tokstr(next, nextLit))
+		return time.Time{}, false, p.NewTslError(errMessage, nextPos)
+	}
+
+	innerTok, innerPos, innerLit := p.ScanIgnoreWhitespace()
+	innerTok, innerLit, isRelative, err := p.parseTimeExpression(function, innerTok, innerPos, innerLit)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if innerTok == NOW {
+		innerTok, innerLit, isRelative = STRING, p.now.UTC().Format(time.RFC3339Nano), true
+	}
+
+	date, err := time.Parse(time.RFC3339Nano, innerLit)
+	if innerTok != STRING || err != nil {
+		errMessage := fmt.Sprintf("Error in %q function, %q expects a time expression, got %q", function, lit, tokstr(innerTok, innerLit))
+		return time.Time{}, false, p.NewTslError(errMessage, innerPos)
+	}
+
+	if next, nextPos, nextLit := p.ScanIgnoreWhitespace(); next != RPAREN {
+		errMessage := fmt.Sprintf("Error in %q function, %q expects a ), got %q", function, lit, tokstr(next, nextLit))
+		return time.Time{}, false, p.NewTslError(errMessage, nextPos)
+	}
+
+	date = date.In(location)
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, location)
+
+	switch lit {
+	case startOfWeek:
+		// Weeks start on monday
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset), isRelative, nil
+	case startOfMonth:
+		return time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, location), isRelative, nil
+	}
+	return day, isRelative, nil
+}
+
+// addTimeDuration adds a TSL duration to a date, months, weeks and days are added as calendar durations. A month is
+// clamped to the last day of the resulting month: "2020-03-31" - 1M is "2020-02-29"
+func addTimeDuration(date time.Time, duration string) (time.Time, error) {
+	unit := strings.TrimLeft(duration, "-0123456789.")
+	value, err := strconv.ParseFloat(strings.TrimSuffix(duration, unit), 64)
+	if err != nil {
+		return date, fmt.Errorf("unvalid duration %q", duration)
+	}
+
+	switch unit {
+	case "M", "w", "d":
+		if value != float64(int(value)) {
+			return date, fmt.Errorf("expects an integer number of %q in duration %q", unit, duration)
+		}
+
+		switch unit {
+		case "M":
+			month := time.Date(date.Year(), date.Month(), 1, date.Hour(), date.Minute(), date.Second(), date.Nanosecond(), date.Location()).AddDate(0, int(value), 0)
+			lastDay := month.AddDate(0, 1, -1).Day()
+			if date.Day() < lastDay {
+				lastDay = date.Day()
+			}
+			return month.AddDate(0, 0, lastDay-1), nil
+		case "w":
+			return date.AddDate(0, 0, 7*int(value)), nil
+		}
+		return date.AddDate(0, 0, int(value)), nil
+	}
+
+	units := map[string]time.Duration{
+		"h":  time.Hour,
+		"m":  time.Minute,
+		"s":  time.Second,
+		"ms": time.Millisecond,
+		"us": time.Microsecond,
+		"ns": time.Nanosecond,
+	}
+
+	factor, ok := units[unit]
+	if !ok {
+		return date, fmt.Errorf("unsupported unit %q in duration %q", unit, duration)
+	}
+	return date.Add(time.Duration(value * float64(factor))), nil
+}
+
 // TSL last fields validator
 func (p *Parser) verifyLastFieldsType(field InternalField, last *LastStatement, pos Pos) (*LastStatement, error) {
 
@@ -1753,6 +2007,7 @@ func (p *Parser) parseGlobalSeriesOp(tok Token, pos Pos, lit string, instruction
 	}
 
 	index := 0
+	var connects []Pos
 	for {
 		nextTok, nextPos, nextLit := p.ScanIgnoreWhitespace()
 
@@ -1768,6 +2023,9 @@ func (p *Parser) parseGlobalSeriesOp(tok Token, pos Pos, lit string, instruction
 			if err != nil {
 				return nil, err
 			}
+			if internalInstruction.connectStatement != instruction.connectStatement {
+				connects = append(connects, internalInstruction.connectStatement.pos)
+			}
 			statements = append(statements, internalInstruction)
 		}
 
@@ -1795,6 +2053,13 @@ func (p *Parser) parseGlobalSeriesOp(tok Token, pos Pos, lit string, instruction
 		}
 	}
 
+	for _, statement := range statements {
+		if sink := statement.GetStoreSink(); sink != nil {
+			errMessage := fmt.Sprintf("Operator %q parameters can't be stored to a %q sink, store the operator result", tok.String(), sink.Type)
+			return nil, p.NewTslError(errMessage, pos)
+		}
+	}
+
 	if len(statements) >= 2 {
 		gOp.instructions = statements
 	} else {
@@ -1804,6 +2069,11 @@ func (p *Parser) parseGlobalSeriesOp(tok Token, pos Pos, lit string, instruction
 
 	instruction.globalOperator = *gOp
 
+	// A connect in a parameter is only allowed to compute the operator between different back-ends
+	if len(connects) > 0 && len(instruction.getAPIs()) < 2 {
+		return nil, fmt.Errorf("function %q isn't allowed in an operator at %d, char %d, unless its parameters use different back-ends", CONNECT.String(), connects[0].Line+1, connects[0].Char+1)
+	}
+
 	return instruction, nil
 }
 
@@ -1847,6 +2117,7 @@ func (p *Parser) parseSampleBy(tok Token, pos Pos, lit string, instruction *Inst
 		{tokenType: TRUE, prefixName: SampleRelative, hasPrefixName: true},
 		{tokenType: FALSE, prefixName: SampleRelative, hasPrefixName: true},
 		{tokenType: STRING, prefixName: SampleFill, hasPrefixName: true},
+		{tokenType: STRING, prefixName: Timezone, hasPrefixName: true},
 		{tokenType: FILL, prefixName: SampleFill, hasPrefixName: true},
 		{tokenType: INTERNALLIST, prefixName: SampleFill, hasPrefixName: true},
 		{tokenType: INTEGER, prefixName: SampleAuto, hasPrefixName: true},
@@ -2001,6 +2272,11 @@ func (p *Parser) parseSampleBy(tok Token, pos Pos, lit string, instruction *Inst
 		sampler.attributes[SampleAuto] = InternalField{tokenType: INTEGER, lit: p.samplersCount}
 	}
 
+	err = p.setTimezone(sampler, tok, pos)
+	if err != nil {
+		return nil, err
+	}
+
 	instruction.selectStatement.frameworks = append(instruction.selectStatement.frameworks, *sampler)
 	return instruction, nil
 }
@@ -2361,6 +2637,8 @@ func (p *Parser) parseNStringOperator(tok Token, pos Pos, lit string, operatorCo
 		operatorCount = 1
 	} else if tok == REMOVELABELS {
 		operatorCount = 0
+	} else if tok == STORE {
+		operatorCount = 1
 	}
 
 	// Check field size number
@@ -2378,6 +2656,34 @@ func (p *Parser) parseNStringOperator(tok Token, pos Pos, lit string, operatorCo
 	return instruction, nil
 }
 
+// Store TSL method parser, expects a Warp 10 write token or a sink type and its destination
+func (p *Parser) parseStore(tok Token, pos Pos, lit string, instruction *Instruction) (*Instruction, error) {
+	instruction, err := p.parseNStringOperator(tok, pos, lit, 2, instruction)
+	if err != nil {
+		return nil, err
+	}
+
+	store := instruction.selectStatement.frameworks[len(instruction.selectStatement.frameworks)-1]
+	if len(store.unNamedAttributes) == 1 {
+		return instruction, nil
+	}
+
+	for _, field := range store.unNamedAttributes {
+		if field.tokenType != STRING {
+			errMessage := fmt.Sprintf("The %q function expects a sink type and a destination as %q, got %q", tok.String(), STRING.String(), field.lit)
+			return nil, p.NewTslError(errMessage, pos)
+		}
+	}
+
+	switch store.unNamedAttributes[0].lit {
+	case PrometheusSink, GTSSink, OpenMetricsSink:
+	default:
+		errMessage := fmt.Sprintf("The %q function expects a %q, a %q or an %q sink type, got %q", tok.String(), PrometheusSink, GTSSink, OpenMetricsSink, store.unNamedAttributes[0].lit)
+		return nil, p.NewTslError(errMessage, pos)
+	}
+	return instruction, nil
+}
+
 // TSL operator parser that include a single string as parameter
 func (p *Parser) parseRenameLabelValue(tok Token, pos Pos, lit string, instruction *Instruction) (*Instruction, error) {
 	op := &FrameworkStatement{}
@@ -2480,8 +2786,16 @@ func (p *Parser) parseSingleNumericOperator(tok Token, pos Pos, lit string, inst
 			{tokenType: INTEGER}}
 	}
 
+	paramsField := map[int][]InternalField{0: zeroFields}
+
+	// Clamp expects a min and a max value
+	if tok == CLAMP {
+		expectedField = 2
+		paramsField = map[int][]InternalField{0: zeroFields, 1: zeroFields}
+	}
+
 	// Load expected fields
-	fields, err := p.ParseFields(tok.String(), map[int][]InternalField{0: zeroFields}, 1)
+	fields, err := p.ParseFields(tok.String(), paramsField, expectedField)
 
 	if err != nil {
 		return nil, err
@@ -2490,9 +2804,32 @@ func (p *Parser) parseSingleNumericOperator(tok Token, pos Pos, lit string, inst
 	// Check field size number
 	if len(fields) < expectedField {
 		errMessage := fmt.Sprintf("The %q function expects at least one %q parameter", tok.String(), NUMBER.String())
+		if expectedField > 1 {
+			errMessage = fmt.Sprintf("The %q function expects %d %q parameters", tok.String(), expectedField, NUMBER.String())
+		}
 		return nil, p.NewTslError(errMessage, pos)
 	}
 
+	if tok == CLAMP {
+		min, minErr := strconv.ParseFloat(fields[0].lit, 64)
+		max, maxErr := strconv.ParseFloat(fields[1].lit, 64)
+		if minErr == nil && maxErr == nil && min > max {
+			errMessage := fmt.Sprintf("The %q function expects its min value to be lower or equal to its max value", tok.String())
+			return nil, p.NewTslError(errMessage, pos)
+		}
+
+		op.unNamedAttributes = map[int]InternalField{0: fields[0], 1: fields[1]}
+		instruction.selectStatement.frameworks = append(instruction.selectStatement.frameworks, *op)
+		return instruction, nil
+	}
+
+	if tok == MOD {
+		if value, err := strconv.ParseFloat(fields[0].lit, 64); err == nil && value == 0 {
+			errMessage := fmt.Sprintf("The %q function expects a non zero divisor", tok.String())
+			return nil, p.NewTslError(errMessage, pos)
+		}
+	}
+
 	// Validate all received fields
 	for _, field := range fields {
 		if !field.hasPrefixName {
@@ -2505,6 +2842,78 @@ func (p *Parser) parseSingleNumericOperator(tok Token, pos Pos, lit string, inst
 	return instruction, nil
 }
 
+// TSL histogram operator parser, histogramQuantile expects a quantile and histogramFraction a lower and an upper bound
+func (p *Parser) parseHistogramOperator(tok Token, pos Pos, lit string, instruction *Instruction) (*Instruction, error) {
+	op := &FrameworkStatement{}
+	op.pos = pos
+	op.operator = tok
+	op.attributes = make(map[PrefixAttributes]InternalField)
+	op.unNamedAttributes = make(map[int]InternalField)
+
+	expectedField := 1
+
+	// Load numeric bounds
+	zeroFields := []InternalField{
+		{tokenType: INTEGER},
+		{tokenType: NUMBER}}
+
+	paramsField := map[int][]InternalField{0: zeroFields}
+
+	if tok == HISTOGRAMFRACTION {
+		expectedField = 2
+		zeroFields = append(zeroFields, InternalField{tokenType: NEGINTEGER}, InternalField{tokenType: NEGNUMBER})
+		paramsField = map[int][]InternalField{0: zeroFields, 1: zeroFields}
+	}
+
+	// Load expected fields
+	fields, err := p.ParseFields(tok.String(), paramsField, expectedField)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Check field size number
+	if len(fields) < expectedField {
+		errMessage := fmt.Sprintf("The %q function expects %d %q parameter(s)", tok.String(), expectedField, NUMBER.String())
+		return nil, p.NewTslError(errMessage, pos)
+	}
+
+	bounds := make([]float64, len(fields))
+	for index, field := range fields {
+		if field.tokenType == NATIVEVARIABLE {
+			op.unNamedAttributes[index] = field
+			continue
+		}
+
+		value, err := strconv.ParseFloat(field.lit, 64)
+		if err != nil {
+			errMessage := fmt.Sprintf("The %q function expects a valid %q parameter, got %q", tok.String(), NUMBER.String(), field.lit)
+			return nil, p.NewTslError(errMessage, pos)
+		}
+		bounds[index] = value
+
+		if tok == HISTOGRAMQUANTILE && (value < 0 || value > 1) {
+			errMessage := fmt.Sprintf("The %q function expects its quantile parameter to be included in [0.0, 1.0]", tok.String())
+			return nil, p.NewTslError(errMessage, pos)
+		}
+
+		// Integers are converted into numbers
+		if field.tokenType == INTEGER || field.tokenType == NEGINTEGER {
+			field.lit += ".0"
+			field.tokenType = NUMBER
+		}
+		op.unNamedAttributes[index] = field
+	}
+
+	if tok == HISTOGRAMFRACTION && fields[0].tokenType != NATIVEVARIABLE && fields[1].tokenType != NATIVEVARIABLE && bounds[0] > bounds[1] {
+		errMessage := fmt.Sprintf("The %q function expects its lower bound to be lower or equal to its upper bound", tok.String())
+		return nil, p.NewTslError(errMessage, pos)
+	}
+
+	instruction.selectStatement.frameworks = append(instruction.selectStatement.frameworks, *op)
+	return instruction, nil
+}
+
 func (p *Parser) parseOperators(tok Token, pos Pos, lit string, instruction *Instruction) (*Instruction, error) {
 	op := &FrameworkStatement{}
 	op.pos = pos
@@ -2780,6 +3189,61 @@ func (p *Parser) parseNoOperator(tok Token, pos Pos, lit string, instruction *In
 	return instruction, nil
 }
 
+// TSL calendar operator parser, expects an optional timezone
+func (p *Parser) parseCalendarOperator(tok Token, pos Pos, lit string, instruction *Instruction) (*Instruction, error) {
+	op := &FrameworkStatement{}
+	op.pos = pos
+	op.operator = tok
+	op.attributes = make(map[PrefixAttributes]InternalField)
+
+	timezoneFields := []InternalField{
+		{tokenType: STRING, prefixName: Timezone, hasPrefixName: true},
+		{tokenType: STRING}}
+
+	// Load expected fields
+	fields, err := p.ParseFields(tok.String(), map[int][]InternalField{0: timezoneFields}, 1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range fields {
+		field.prefixName = Timezone
+		field.hasPrefixName = true
+		op.attributes[Timezone] = field
+	}
+
+	err = p.setTimezone(op, tok, pos)
+	if err != nil {
+		return nil, err
+	}
+
+	instruction.selectStatement.frameworks = append(instruction.selectStatement.frameworks, *op)
+	return instruction, nil
+}
+
+// setTimezone validates a framework timezone or sets the header one as default
+func (p *Parser) setTimezone(op *FrameworkStatement, tok Token, pos Pos) error {
+	timezone, hasTimezone := op.attributes[Timezone]
+
+	if !hasTimezone {
+		if p.timezone != "" {
+			op.attributes[Timezone] = InternalField{tokenType: STRING, prefixName: Timezone, hasPrefixName: true, lit: p.timezone}
+		}
+		return nil
+	}
+
+	if timezone.tokenType == NATIVEVARIABLE {
+		return nil
+	}
+
+	if _, err := time.LoadLocation(timezone.lit); err != nil {
+		errMessage := fmt.Sprintf("The %q function expects a valid IANA timezone, got %q", tok.String(), timezone.lit)
+		return p.NewTslError(errMessage, pos)
+	}
+	return nil
+}
+
 // TSL single operator parser
 func (p *Parser) parseAggregatorFunction(tok Token, pos Pos, lit string, instruction *Instruction) (*Instruction, error) {
 	op := &FrameworkStatement{}
@@ -2945,6 +3409,200 @@ func (p *Parser) parseTimeOperator(tok Token, pos Pos, lit string, instruction *
 	return instruction, nil
 }
 
+// TSL trend operator parser: deriv, predictLinear, holtWinters and forecast
+func (p *Parser) parseTrendOperator(tok Token, pos Pos, lit string, instruction *Instruction, hasSampling bool) (*Instruction, error) {
+	op := &FrameworkStatement{}
+	op.pos = pos
+	op.operator = tok
+	op.attributes = make(map[PrefixAttributes]InternalField)
+	op.unNamedAttributes = make(map[int]InternalField)
+
+	durationFields := []InternalField{
+		{tokenType: DURATIONVAL}}
+
+	numberFields := []InternalField{
+		{tokenType: NUMBER}}
+
+	// deriv([window]), predictLinear(duration, [window]), holtWinters(sf, tf, [window]) and forecast(span)
+	minSize := 0
+	maxSize := 1
+	paramsField := map[int][]InternalField{0: durationFields}
+	windowIndex := 0
+
+	switch tok {
+	case PREDICTLINEAR:
+		minSize = 1
+		maxSize = 2
+		paramsField = map[int][]InternalField{0: durationFields, 1: durationFields}
+		windowIndex = 1
+	case HOLTWINTERS:
+		minSize = 2
+		maxSize = 3
+		paramsField = map[int][]InternalField{0: numberFields, 1: numberFields, 2: durationFields}
+		windowIndex = 2
+	case FORECAST:
+		minSize = 1
+		windowIndex = -1
+	}
+
+	// Load expected fields
+	fields, err := p.ParseFields(tok.String(), paramsField, maxSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Check field size number
+	if len(fields) < minSize {
+		errMessage := fmt.Sprintf("The %q function expects at least %d parameter(s)", tok.String(), minSize)
+		return nil, p.NewTslError(errMessage, pos)
+	}
+
+	// Validate all received fields
+	for index, field := range fields {
+		if field.tokenType == DURATIONVAL && strings.HasPrefix(field.lit, "-") {
+			errMessage := fmt.Sprintf("The %q function expects a positive duration, got %q", tok.String(), field.lit)
+			return nil, p.NewTslError(errMessage, pos)
+		}
+
+		if field.tokenType == NUMBER {
+			factor, err := strconv.ParseFloat(field.lit, 64)
+			if err != nil || factor <= 0 || factor >= 1 {
+				errMessage := fmt.Sprintf("The %q function expects its smoothing and trend factors to be included in ]0.0, 1.0[, got %q", tok.String(), field.lit)
+				return nil, p.NewTslError(errMessage, pos)
+			}
+			field.lit = strconv.FormatFloat(factor, 'f', -1, 64)
+			op.unNamedAttributes[index] = field
+		} else if index == windowIndex {
+			field.prefixName = MapperSampling
+			field.hasPrefixName = true
+			op.attributes[MapperSampling] = field
+		} else {
+			field.prefixName = MapperValue
+			field.hasPrefixName = true
+			op.attributes[MapperValue] = field
+		}
+	}
+
+	// Forecast extends series on their sampling span: add a default sampler
+	if tok == FORECAST && !hasSampling {
+		sampler := &FrameworkStatement{}
+		sampler.pos = pos
+		sampler.operator = SAMPLEBY
+		sampler.attributes = make(map[PrefixAttributes]InternalField)
+		sampler.attributes[SampleAggregator] = InternalField{tokenType: LAST, lit: LAST.String()}
+		sampler.attributes[SampleSpan] = InternalField{tokenType: DURATIONVAL, lit: "1m"}
+
+		instruction.selectStatement.frameworks = append(instruction.selectStatement.frameworks, *sampler)
+	}
+
+	instruction.selectStatement.frameworks = append(instruction.selectStatement.frameworks, *op)
+	return instruction, nil
+}
+
+// TSL anomaly operator parser: zscore([window]), outliers(method, threshold, [asBoolean]) and bands(window, k)
+func (p *Parser) parseAnomalyOperator(tok Token, pos Pos, lit string, instruction *Instruction, hasSampling bool) (*Instruction, error) {
+	op := &FrameworkStatement{}
+	op.pos = pos
+	op.operator = tok
+	op.attributes = make(map[PrefixAttributes]InternalField)
+	op.unNamedAttributes = make(map[int]InternalField)
+
+	durationFields := []InternalField{
+		{tokenType: DURATIONVAL}}
+
+	numberFields := []InternalField{
+		{tokenType: INTEGER},
+		{tokenType: NUMBER}}
+
+	minSize := 0
+	maxSize := 1
+	paramsField := map[int][]InternalField{0: durationFields}
+
+	switch tok {
+	case OUTLIERS:
+		minSize = 2
+		maxSize = 3
+		paramsField = map[int][]InternalField{
+			0: {{tokenType: STRING}},
+			1: numberFields,
+			2: {{tokenType: TRUE}, {tokenType: FALSE}}}
+	case BANDS:
+		minSize = 2
+		maxSize = 2
+		paramsField = map[int][]InternalField{0: durationFields, 1: numberFields}
+	}
+
+	// Load expected fields
+	fields, err := p.ParseFields(tok.String(), paramsField, maxSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Check field size number
+	if len(fields) < minSize {
+		errMessage := fmt.Sprintf("The %q function expects at least %d parameter(s)", tok.String(), minSize)
+		return nil, p.NewTslError(errMessage, pos)
+	}
+
+	// Validate all received fields
+	for index, field := range fields {
+		switch field.tokenType {
+		case DURATIONVAL:
+			if strings.HasPrefix(field.lit, "-") {
+				errMessage := fmt.Sprintf("The %q function expects a positive window duration, got %q", tok.String(), field.lit)
+				return nil, p.NewTslError(errMessage, pos)
+			}
+			field.prefixName = MapperSampling
+			field.hasPrefixName = true
+			op.attributes[MapperSampling] = field
+
+		case STRING:
+			if field.lit != "esd" && field.lit != "mad" {
+				errMessage := fmt.Sprintf("The %q function expects its method to be \"esd\" or \"mad\", got %q", tok.String(), field.lit)
+				return nil, p.NewTslError(errMessage, pos)
+			}
+			op.unNamedAttributes[index] = field
+
+		case INTEGER, NUMBER:
+			value, err := strconv.ParseFloat(field.lit, 64)
+			if err != nil || value <= 0 {
+				errMessage := fmt.Sprintf("The %q function expects a strictly positive number, got %q", tok.String(), field.lit)
+				return nil, p.NewTslError(errMessage, pos)
+			}
+
+			// ESD test threshold is the maximum number of outliers to detect
+			if tok == OUTLIERS && fields[0].lit == "esd" && field.tokenType != INTEGER {
+				errMessage := fmt.Sprintf("The %q function expects an integer maximal number of outliers for the esd method, got %q", tok.String(), field.lit)
+				return nil, p.NewTslError(errMessage, pos)
+			}
+			field.lit = strconv.FormatFloat(value, 'f', -1, 64)
+			field.prefixName = MapperValue
+			field.hasPrefixName = true
+			op.attributes[MapperValue] = field
+
+		default:
+			op.unNamedAttributes[index] = field
+		}
+	}
+
+	// Anomalies are computed on sampled series: add a default sampler
+	if !hasSampling {
+		sampler := &FrameworkStatement{}
+		sampler.pos = pos
+		sampler.operator = SAMPLEBY
+		sampler.attributes = make(map[PrefixAttributes]InternalField)
+		sampler.attributes[SampleAggregator] = InternalField{tokenType: LAST, lit: LAST.String()}
+		sampler.attributes[SampleSpan] = InternalField{tokenType: DURATIONVAL, lit: "1m"}
+
+		instruction.selectStatement.frameworks = append(instruction.selectStatement.frameworks, *sampler)
+	}
+
+	instruction.selectStatement.frameworks = append(instruction.selectStatement.frameworks, *op)
+	return instruction, nil
+}
+
 //
 // Global fields parser method
 //
@@ -3024,6 +3682,16 @@ func (p *Parser) ParseFields(function string, internalFields map[int][]InternalF
 
 		okField = append(okField, InternalField{tokenType: NATIVEVARIABLE})
 
+		// Evaluate the from and last time expressions as STRING dates
+		isRelative := false
+		if (function == FROM.String() || function == LAST.String()) && acceptsTimeExpression(okField) {
+			var err error
+			tok, lit, isRelative, err = p.parseTimeExpression(function, tok, pos, lit)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		// Find the current field type
 		findType := false
 
@@ -3126,6 +3794,13 @@ func (p *Parser) ParseFields(function string, internalFields map[int][]InternalF
 			return nil, p.NewTslError(errMessage, pos)
 		}
 
+		// Tag dates evaluated from now: they change with each query
+		if isRelative {
+			field := res[index]
+			field.isRelative = true
+			res[index] = field
+		}
+
 		tok, pos, lit = p.ScanIgnoreWhitespace()
 
 		// If the next token is not a comma or a right ) return an error
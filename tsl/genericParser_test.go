@@ -0,0 +1,291 @@
+package tsl
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func parseError(t *testing.T, query string) error {
+	t.Helper()
+
+	parser, err := NewParser(strings.NewReader(query), "http://127.0.0.1:8080", "TOKEN", 0, "", "", nil)
+	if err != nil {
+		t.Fatalf("unexpected parser error: %v", err)
+	}
+	_, err = parser.Parse()
+	return err
+}
+
+func TestParseConnectInOperator(t *testing.T) {
+	valid := []string{
+		`add(select("a").last(1h), select("b").last(1h))`,
+		`add(select("a").last(1h), connect("prometheus","http://127.0.0.1:9090").select("b").last(1h))`,
+		`add(connect("warp10","http://127.0.0.1:8081","TOKEN").select("a").last(1h), select("b").last(1h))`,
+	}
+	for _, query := range valid {
+		parseInstructions(t, query)
+	}
+
+	// A connect to the operator back-end is rejected
+	invalid := []string{
+		`add(connect("warp10","http://127.0.0.1:8080","TOKEN").select("a").last(1h), select("b").last(1h))`,
+		`add(connect("warp10","http://127.0.0.1:8081","TOKEN").select("a").last(1h), connect("warp10","http://127.0.0.1:8081","TOKEN").select("b").last(1h))`,
+	}
+	for _, query := range invalid {
+		parser, err := NewParser(strings.NewReader(query), "http://127.0.0.1:8080", "TOKEN", 0, "", "", nil)
+		if err != nil {
+			t.Fatalf("unexpected parser error: %v", err)
+		}
+		if _, err := parser.Parse(); err == nil || !strings.Contains(err.Error(), `function "connect" isn't allowed in an operator`) {
+			t.Errorf("%s: expected a connect error, got %v", query, err)
+		}
+	}
+}
+
+func TestParseGroupOperatorErrors(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{`mul(select("a").last(1h), select("b").last(1h)).groupLeft()`, "expects to find on or ignoring function"},
+		{`and(select("a").last(1h), select("b").last(1h)).on("host").groupLeft()`, `a group method can't be applied on "and" operator`},
+		{`mul(select("a").last(1h), select("b").last(1h)).on("host").groupLeft().groupRight()`, "a group method was already defined"},
+		{`mul(select("a").last(1h), select("b").last(1h)).on("host").groupLeft("host")`, `label "host" must not occur in ON and GROUP clause at once`},
+	}
+
+	for _, test := range tests {
+		if err := parseError(t, test.query); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.query, test.expected, err)
+		}
+	}
+}
+
+func TestParseHistogramOperators(t *testing.T) {
+	for _, query := range []string{
+		`select("latency").last(1h).histogramQuantile(0.99)`,
+		`select("latency").last(1h).histogramQuantile(1)`,
+		`select("latency").last(1h).histogramFraction(-1, 0.5)`,
+		"bound = 0.5\nselect(\"latency\").last(1h).histogramFraction(0, bound)",
+	} {
+		parseInstructions(t, query)
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{`select("latency").last(1h).histogramQuantile(1.5)`, "expects its quantile parameter to be included in [0.0, 1.0]"},
+		{`select("latency").last(1h).histogramFraction(1)`, `expects 2 "NUMBER" parameter(s)`},
+		{`select("latency").last(1h).histogramFraction(1, 0.5)`, "expects its lower bound to be lower or equal to its upper bound"},
+		{"histogramQuantile = 0.5\nselect(\"latency\").last(1h)", "unexpected reserved keyword"},
+	}
+
+	for _, test := range tests {
+		if err := parseError(t, test.query); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.query, test.expected, err)
+		}
+	}
+}
+
+func TestParseTrendOperators(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{`select("cpu").last(1h).deriv(-1m)`, `expects a positive duration, got "-1m"`},
+		{`select("cpu").last(1h).predictLinear()`, "expects at least 1 parameter(s)"},
+		{`select("cpu").last(1h).holtWinters(0.5)`, "expects at least 2 parameter(s)"},
+		{`select("cpu").last(1h).holtWinters(1.5, 0.3)`, `smoothing and trend factors to be included in ]0.0, 1.0[, got "1.5"`},
+		{`select("cpu").last(1h).forecast()`, "expects at least 1 parameter(s)"},
+		{"deriv = 1m\nselect(\"cpu\").last(1h)", "unexpected reserved keyword"},
+	}
+
+	for _, test := range tests {
+		if err := parseError(t, test.query); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.query, test.expected, err)
+		}
+	}
+}
+
+func TestParseAnomalyOperators(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{`select("cpu").last(1h).zscore(-1h)`, `expects a positive window duration, got "-1h"`},
+		{`select("cpu").last(1h).outliers("esd")`, "expects at least 2 parameter(s)"},
+		{`select("cpu").last(1h).outliers("iqr", 3)`, `expects its method to be "esd" or "mad", got "iqr"`},
+		{`select("cpu").last(1h).outliers("esd", 2.5)`, `expects an integer maximal number of outliers for the esd method, got "2.5"`},
+		{`select("cpu").last(1h).bands(1h, 0)`, `expects a strictly positive number, got "0"`},
+		{"zscore = 2\nselect(\"cpu\").last(1h)", "unexpected reserved keyword"},
+	}
+
+	for _, test := range tests {
+		if err := parseError(t, test.query); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.query, test.expected, err)
+		}
+	}
+}
+
+func TestParseMathMappers(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{`select("cpu").last(1h).pow()`, `expects at least one "NUMBER" parameter`},
+		{`select("cpu").last(1h).mod(0)`, "expects a non zero divisor"},
+		{`select("cpu").last(1h).clamp(2)`, `expects 2 "NUMBER" parameters`},
+		{`select("cpu").last(1h).clamp(2, 1)`, "expects its min value to be lower or equal to its max value"},
+		{"exp = 2\nselect(\"cpu\").last(1h)", "unexpected reserved keyword"},
+		{"mod = 60\nselect(\"cpu\").last(1h)", "unexpected reserved keyword"},
+	}
+
+	for _, test := range tests {
+		if err := parseError(t, test.query); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.query, test.expected, err)
+		}
+	}
+}
+
+func TestParseTimezone(t *testing.T) {
+	for _, query := range []string{
+		`select("cpu").last(1h).hour(tz="Europe/Paris")`,
+		`select("cpu").last(1h).weekday("UTC")`,
+		`select("cpu").last(1h).sampleBy(1d, last, tz="Europe/Paris")`,
+		"tz = \"Europe/Paris\"\nselect(\"cpu\").last(1h).month(tz)",
+	} {
+		parseInstructions(t, query)
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{`select("cpu").last(1h).hour(tz="Mars/Olympus")`, `The "hour" function expects a valid IANA timezone, got "Mars/Olympus"`},
+		{`select("cpu").last(1h).sampleBy(1m, last, tz="Mars/Olympus")`, `The "sampleBy" function expects a valid IANA timezone, got "Mars/Olympus"`},
+	}
+
+	for _, test := range tests {
+		if err := parseError(t, test.query); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.query, test.expected, err)
+		}
+	}
+}
+
+func parseFromDates(t *testing.T, query string, now time.Time, timezone string) (InternalField, InternalField) {
+	t.Helper()
+
+	parser, err := NewParserWithTimezone(strings.NewReader(query), "http://127.0.0.1:8080", "TOKEN", 0, "", "", timezone, nil)
+	if err != nil {
+		t.Fatalf("unexpected parser error: %v", err)
+	}
+	parser.now = now
+	parsed, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("unexpected parse error on %q: %v", query, err)
+	}
+	from := parsed.Statements[0].selectStatement.from
+	return from.from, from.to
+}
+
+func TestParseTimeExpression(t *testing.T) {
+	// A tuesday
+	now := time.Date(2020, 3, 31, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		query    string
+		timezone string
+		from     string
+		to       string
+		relative bool
+	}{
+		{`select("cpu").from(now - 7d, to=now - 1d)`, "", "2020-03-24T10:30:00Z", "2020-03-30T10:30:00Z", true},
+		{`select("cpu").from(startOfDay(now), to=now + 90m)`, "", "2020-03-31T00:00:00Z", "2020-03-31T12:00:00Z", true},
+		{`select("cpu").from(startOfWeek(now - 1w), to=startOfWeek(now))`, "", "2020-03-23T00:00:00Z", "2020-03-30T00:00:00Z", true},
+		{`select("cpu").from(startOfMonth(now) - 1M, to=startOfMonth(now))`, "", "2020-02-01T00:00:00Z", "2020-03-01T00:00:00Z", true},
+		// Months are clamped to the end of shorter months
+		{`select("cpu").from(now - 1M, to=now - 13M)`, "", "2020-02-29T10:30:00Z", "2019-02-28T10:30:00Z", true},
+		{`select("cpu").from("2020-01-31" + 1M, to="2020-01-31T12:00:00Z" + 3M)`, "", "2020-02-29T00:00:00Z", "2020-04-30T12:00:00Z", false},
+		// A single date is normalized and dates without offset use the timezone
+		{`select("cpu").from("2020-01-01", to="2020-01-02T00:00:00+01:00")`, "Europe/Paris", "2019-12-31T23:00:00Z", "2020-01-01T23:00:00Z", false},
+		// Days follow the calendar across daylight saving time changes, hours don't
+		{`select("cpu").from(startOfDay("2020-03-29T12:00:00Z"), to=startOfDay("2020-03-29T12:00:00Z") + 1d)`, "Europe/Paris", "2020-03-28T23:00:00Z", "2020-03-29T22:00:00Z", false},
+		{`select("cpu").from(startOfDay("2020-03-29T12:00:00Z"), to=startOfDay("2020-03-29T12:00:00Z") + 24h)`, "Europe/Paris", "2020-03-28T23:00:00Z", "2020-03-29T23:00:00Z", false},
+		{`select("cpu").from(startOfDay(now) - 1d, to=startOfDay(now))`, "Europe/Paris", "2020-03-29T22:00:00Z", "2020-03-30T22:00:00Z", true},
+	}
+
+	for _, test := range tests {
+		from, to := parseFromDates(t, test.query, now, test.timezone)
+		if from.tokenType != STRING || from.lit != test.from {
+			t.Errorf("%s: expected the %q from date, got %q", test.query, test.from, from.lit)
+		}
+		if to.tokenType != STRING || to.lit != test.to {
+			t.Errorf("%s: expected the %q to date, got %q", test.query, test.to, to.lit)
+		}
+		if from.isRelative != test.relative || to.isRelative != test.relative {
+			t.Errorf("%s: expected dates relative to now to be %v, got %v and %v", test.query, test.relative, from.isRelative, to.isRelative)
+		}
+	}
+
+	// A single now is left to the back-end
+	from, _ := parseFromDates(t, `select("cpu").from(now)`, now, "")
+	if from.tokenType != NOW || from.isRelative {
+		t.Errorf("expected a single now field, got %+v", from)
+	}
+
+	errors := []struct {
+		query    string
+		expected string
+	}{
+		{`select("cpu").from(now - 1.5d)`, `expects a duration after "-" in time expression, got "1.5"`},
+		{`select("cpu").from(now - )`, `expects a duration after "-" in time expression`},
+		{`select("cpu").from("yesterday" - 1d)`, `expects an ISO8601 date in time expression, got "yesterday"`},
+		{`select("cpu").from(startOfDay("yesterday"))`, `"startOfDay" expects a time expression, got "yesterday"`},
+		{`select("cpu").from(startOfDay(now, to=now)`, `"startOfDay" expects a ), got ","`},
+	}
+	for _, test := range errors {
+		if err := parseError(t, test.query); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.query, test.expected, err)
+		}
+	}
+}
+
+func TestAddTimeDuration(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatalf("unexpected location error: %v", err)
+	}
+
+	tests := []struct {
+		date     time.Time
+		duration string
+		expected time.Time
+	}{
+		{time.Date(2020, 1, 31, 0, 0, 0, 0, time.UTC), "1M", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2020, 3, 31, 0, 0, 0, 0, time.UTC), "-1M", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2020, 5, 15, 0, 0, 0, 0, time.UTC), "-14M", time.Date(2019, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2020, 12, 31, 0, 0, 0, 0, time.UTC), "2M", time.Date(2021, 2, 28, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "2w", time.Date(2020, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2020, 10, 24, 12, 0, 0, 0, paris), "1d", time.Date(2020, 10, 25, 12, 0, 0, 0, paris)},
+		{time.Date(2020, 10, 24, 12, 0, 0, 0, paris), "24h", time.Date(2020, 10, 25, 11, 0, 0, 0, paris)},
+		{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "-90m", time.Date(2019, 12, 31, 22, 30, 0, 0, time.UTC)},
+		{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "1500ms", time.Date(2020, 1, 1, 0, 0, 1, 500000000, time.UTC)},
+	}
+
+	for _, test := range tests {
+		date, err := addTimeDuration(test.date, test.duration)
+		if err != nil {
+			t.Fatalf("%s + %s: unexpected error: %v", test.date, test.duration, err)
+		}
+		if !date.Equal(test.expected) {
+			t.Errorf("%s + %s: expected %s, got %s", test.date, test.duration, test.expected, date)
+		}
+	}
+
+	for _, duration := range []string{"1.5M", "2y"} {
+		if _, err := addTimeDuration(time.Now(), duration); err == nil {
+			t.Errorf("expected an error for duration %q", duration)
+		}
+	}
+}
@@ -33,12 +33,212 @@ type Instruction struct {
 
 // GetConnectType return instruction connect type
 func (i Instruction) GetConnectType() string {
-	return i.connectStatement.connectType
+	return i.getConnectStatement().connectType
 }
 
 // GetConnectAPI return instruction api
 func (i Instruction) GetConnectAPI() string {
-	return i.connectStatement.api
+	return i.getConnectStatement().api
+}
+
+// An operator whose operands all connect to a same back-end is executed on it
+func (i Instruction) getConnectStatement() ConnectStatement {
+	if i.isGlobalOperator && len(i.globalOperator.instructions) > 0 && len(i.getAPIs()) == 1 {
+		return i.globalOperator.instructions[0].getConnectStatement()
+	}
+	return i.connectStatement
+}
+
+// GetBackendInstructions return the single back-end instructions of an instruction: itself or its operators operands
+func (i Instruction) GetBackendInstructions() []Instruction {
+	if !i.isGlobalOperator {
+		return []Instruction{i}
+	}
+
+	instructions := []Instruction{}
+	for _, operand := range i.globalOperator.instructions {
+		instructions = append(instructions, operand.GetBackendInstructions()...)
+	}
+	return instructions
+}
+
+// CrossBackendOperator represents a metrics sets operator whose operands are executed on different back-ends
+type CrossBackendOperator struct {
+	Operator   Token
+	Operands   []Instruction
+	Labels     []string
+	Ignoring   []string
+	IsOn       bool
+	IsIgnoring bool
+}
+
+// GetCrossBackendOperator return the metrics sets operator of an instruction when its operands use different back-ends, nil otherwise
+func (i Instruction) GetCrossBackendOperator() *CrossBackendOperator {
+	if !i.isGlobalOperator || len(i.getAPIs()) < 2 {
+		return nil
+	}
+
+	operands := make([]Instruction, len(i.globalOperator.instructions))
+	for index, operand := range i.globalOperator.instructions {
+		operands[index] = *operand
+	}
+
+	return &CrossBackendOperator{
+		Operator:   i.globalOperator.operator,
+		Operands:   operands,
+		Labels:     i.globalOperator.labels,
+		Ignoring:   i.globalOperator.ignoring,
+		IsOn:       i.globalOperator.isOn,
+		IsIgnoring: i.globalOperator.isIgnoring,
+	}
+}
+
+// IsMeta return if the instruction returns series meta-data instead of series
+func (i Instruction) IsMeta() bool {
+	return i.isMeta && !(i.hasSelect && i.selectStatement.isVariable)
+}
+
+// HasGroup return if a metrics sets operator uses a groupLeft or a groupRight matching
+func (i Instruction) HasGroup() bool {
+	return i.globalOperator.group.lit != ""
+}
+
+// HasFrameworks return if operators are applied on the instruction result, a final store to a sink excepted
+func (i Instruction) HasFrameworks() bool {
+	if i.GetStoreSink() != nil {
+		return len(i.selectStatement.frameworks) > 1
+	}
+	return len(i.selectStatement.frameworks) > 0
+}
+
+// HasStore return if the instruction or one of its metrics sets stores its series in the back-end
+func (i Instruction) HasStore() bool {
+	for _, framework := range i.selectStatement.frameworks {
+		if framework.operator == STORE && !isSinkStore(framework) {
+			return true
+		}
+	}
+
+	if i.isGlobalOperator {
+		for _, operand := range i.globalOperator.instructions {
+			if operand.HasStore() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Store sinks types, written by TSL instead of the back-end
+const (
+	PrometheusSink  = "prometheus"
+	GTSSink         = "gts"
+	OpenMetricsSink = "openmetrics"
+)
+
+// StoreSink is the destination of a store method written by TSL: a remote write URL or a file path, or the connected
+// Prometheus back-end of a store with a token
+type StoreSink struct {
+	Type        string
+	Destination string
+	Backend     string
+	Token       string
+}
+
+// GetStoreSink return the sink of an instruction ending by a store to a sink or by a store on Prometheus, nil otherwise
+func (i Instruction) GetStoreSink() *StoreSink {
+	frameworks := i.selectStatement.frameworks
+	if len(frameworks) == 0 || frameworks[len(frameworks)-1].operator != STORE {
+		return nil
+	}
+
+	store := frameworks[len(frameworks)-1]
+	if isSinkStore(store) {
+		return &StoreSink{Type: store.unNamedAttributes[0].lit, Destination: store.unNamedAttributes[1].lit}
+	}
+
+	// Prometheus has no store, the series are sent to its remote write API
+	if i.GetConnectType() == PROMETHEUS.String() {
+		return &StoreSink{Type: PrometheusSink, Backend: i.GetConnectAPI(), Token: store.unNamedAttributes[0].lit}
+	}
+	return nil
+}
+
+// Check if a framework is a store to a sink
+func isSinkStore(framework FrameworkStatement) bool {
+	return framework.operator == STORE && len(framework.unNamedAttributes) == 2
+}
+
+// Get all back-ends APIs used by an instruction
+func (i Instruction) getAPIs() map[string]bool {
+	if !i.isGlobalOperator {
+		return map[string]bool{i.connectStatement.api: true}
+	}
+
+	apis := make(map[string]bool)
+	for _, operand := range i.globalOperator.instructions {
+		for api := range operand.getAPIs() {
+			apis[api] = true
+		}
+	}
+	return apis
+}
+
+// SetConnectTokens set the token of each instruction back-end connected without token, from a token map per API
+func (i *Instruction) SetConnectTokens(tokens map[string]string) {
+	if token, ok := tokens[i.connectStatement.api]; ok && i.connectStatement.token == "" {
+		i.connectStatement.token = token
+	}
+
+	if i.isGlobalOperator {
+		for _, operand := range i.globalOperator.instructions {
+			operand.SetConnectTokens(tokens)
+		}
+	}
+}
+
+// Normalized return the AST of an instruction without its positions in the query, identical for identical instructions
+func (i Instruction) Normalized() string {
+	operands := make([]string, len(i.globalOperator.instructions))
+	for index, operand := range i.globalOperator.instructions {
+		operands[index] = operand.Normalized()
+	}
+
+	series := make([]string, len(i.createStatement.createSeries))
+	for index, create := range i.createStatement.createSeries {
+		series[index] = create.normalized()
+	}
+
+	i.connectStatement.pos = Pos{}
+	i.createStatement = CreateStatement{}
+	i.globalOperator.instructions = nil
+	i.globalOperator.pos = Pos{}
+	i.selectStatement.pos = Pos{}
+	i.selectStatement.last.pos = Pos{}
+	i.selectStatement.from.pos = Pos{}
+	i.selectStatement.frameworks = append([]FrameworkStatement{}, i.selectStatement.frameworks...)
+	for index := range i.selectStatement.frameworks {
+		i.selectStatement.frameworks[index].pos = Pos{}
+	}
+
+	// Print the fields values rather than the statements strings, maps being sorted by keys
+	return fmt.Sprintf("%#v create:%q operands:%q", i, series, operands)
+}
+
+// Get a create series without its points pointers
+func (c CreateSeries) normalized() string {
+	points := make([]string, len(c.values))
+	for index, point := range c.values {
+		points[index] = fmt.Sprintf("%#v", []interface{}{normalizedField(point.tick), normalizedField(point.value)})
+	}
+	return fmt.Sprintf("%#v %#v %q %#v", c.metric, c.where, points, normalizedField(c.end))
+}
+
+func normalizedField(field *InternalField) interface{} {
+	if field == nil {
+		return nil
+	}
+	return *field
 }
 
 // Variable represents a TSL variable
@@ -154,6 +354,7 @@ type InternalField struct {
 	hasPrefixName bool
 	lit           string
 	fieldList     []InternalField
+	isRelative    bool
 }
 
 // AttributePolicy is an enum to validate select attribute policy.
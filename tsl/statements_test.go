@@ -0,0 +1,49 @@
+package tsl
+
+import (
+	"testing"
+)
+
+func TestInstructionNormalized(t *testing.T) {
+	normalized := func(query string) string {
+		return parseInstructions(t, query)[0].Normalized()
+	}
+
+	query := `add(select("cpu").where("host=a").from("2020-01-01T00:00:00Z", to="2020-01-02T00:00:00Z").sampleBy(1m, mean), select("mem").last(1h))`
+	spaced := "add(\n  select(\"cpu\")\n    .where(\"host=a\")\n    .from(\"2020-01-01T00:00:00Z\", to=\"2020-01-02T00:00:00Z\")\n    .sampleBy(1m, mean),\n  select(\"mem\").last(1h)\n)"
+
+	if normalized(query) != normalized(spaced) {
+		t.Errorf("expected identical instructions to have the same AST:\n%s\n%s", normalized(query), normalized(spaced))
+	}
+
+	for _, other := range []string{
+		`add(select("cpu").where("host=b").from("2020-01-01T00:00:00Z", to="2020-01-02T00:00:00Z").sampleBy(1m, mean), select("mem").last(1h))`,
+		`add(select("cpu").where("host=a").from("2020-01-01T00:00:00Z", to="2020-01-03T00:00:00Z").sampleBy(1m, mean), select("mem").last(1h))`,
+		`add(select("cpu").where("host=a").from("2020-01-01T00:00:00Z", to="2020-01-02T00:00:00Z").sampleBy(1m, max), select("mem").last(1h))`,
+		`connect("warp10", "http://127.0.0.1:8080", "OTHER").add(select("cpu").where("host=a").from("2020-01-01T00:00:00Z", to="2020-01-02T00:00:00Z").sampleBy(1m, mean), select("mem").last(1h))`,
+	} {
+		if normalized(query) == normalized(other) {
+			t.Errorf("expected different instructions to have different ASTs: %s", other)
+		}
+	}
+}
+
+func TestGetStoreSink(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected *StoreSink
+	}{
+		{`select("cpu").last(1h).store("TOKEN")`, nil},
+		{`select("cpu").last(1h).store("gts", "cpu.gts")`, &StoreSink{Type: GTSSink, Destination: "cpu.gts"}},
+		{`connect("prometheus", "http://127.0.0.1:9090").select("cpu").last(1h).sampleBy(1m, last).store("TOKEN")`, &StoreSink{Type: PrometheusSink, Backend: "http://127.0.0.1:9090", Token: "TOKEN"}},
+		{`connect("prometheus", "http://127.0.0.1:9090").select("cpu").last(1h).sampleBy(1m, last).store("openmetrics", "cpu.prom")`, &StoreSink{Type: OpenMetricsSink, Destination: "cpu.prom"}},
+		{`connect("prometheus", "http://127.0.0.1:9090").select("cpu").last(1h).sampleBy(1m, last)`, nil},
+	}
+
+	for _, test := range tests {
+		sink := parseInstructions(t, test.query)[0].GetStoreSink()
+		if (sink == nil) != (test.expected == nil) || (sink != nil && *sink != *test.expected) {
+			t.Errorf("%s: expected the sink %+v, got %+v", test.query, test.expected, sink)
+		}
+	}
+}
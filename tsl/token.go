@@ -59,18 +59,23 @@ const (
 	ANDL
 	ATTRIBUTEPOLICY
 	ATTRIBUTES
+	BANDS
 	BOTTOMN
 	BOTTOMNBY
 	CEIL
+	CLAMP
 	CONNECT
+	COS
 	COUNT
 	CREATE
 	CUMULATIVE
 	CUMULATIVESUM
 	DAY
 	DELTA
+	DERIV
 	DIVSERIES
 	EQUAL
+	EXP
 	FILL
 	FILTERBYLABELS
 	FILTERBYNAME
@@ -79,6 +84,7 @@ const (
 	FINITE
 	FIRST
 	FLOOR
+	FORECAST
 	FROM
 	GREATEROREQUAL
 	GREATERTHAN
@@ -87,6 +93,9 @@ const (
 	GROUPRIGHT
 	GROUPBY
 	GROUPWITHOUT
+	HISTOGRAMFRACTION
+	HISTOGRAMQUANTILE
+	HOLTWINTERS
 	HOUR
 	IGNORING
 	JOIN
@@ -110,6 +119,7 @@ const (
 	MIN
 	MINWITH
 	MINUTE
+	MOD
 	MONTH
 	MULSERIES
 	NAMES
@@ -118,7 +128,10 @@ const (
 	NOW
 	ON
 	ORL
+	OUTLIERS
 	PERCENTILE
+	POW
+	PREDICTLINEAR
 	PROM
 	PROMETHEUS
 	QUANTIZE
@@ -140,8 +153,10 @@ const (
 	SETLABELFROMNAME
 	SETLABELS
 	SETVALUES
+	SGN
 	SHIFT
 	SHRINK
+	SIN
 	SORT
 	SORTBY
 	SORTDESC
@@ -152,6 +167,7 @@ const (
 	STORE
 	SUBSERIES
 	SUM
+	TAN
 	TIMECLIP
 	TIMEMODULO
 	TIMESTAMP
@@ -168,6 +184,7 @@ const (
 	WHERE
 	WINDOW
 	YEAR
+	ZSCORE
 	keywordEnd
 )
 
@@ -206,18 +223,23 @@ var tokens = [...]string{
 	ANDL:                "and",
 	ATTRIBUTEPOLICY:     "attributePolicy",
 	ATTRIBUTES:          "attributes",
+	BANDS:               "bands",
 	BOTTOMN:             "bottomN",
 	BOTTOMNBY:           "bottomNBy",
 	CEIL:                "ceil",
+	CLAMP:               "clamp",
 	CONNECT:             "connect",
+	COS:                 "cos",
 	COUNT:               "count",
 	CREATE:              "create",
 	CUMULATIVE:          "cumulative",
 	CUMULATIVESUM:       "cumulativeSum",
 	DAY:                 "day",
 	DELTA:               "delta",
+	DERIV:               "deriv",
 	DIVSERIES:           "div",
 	EQUAL:               "equal",
+	EXP:                 "exp",
 	FILL:                "fill",
 	FILTERBYLABELS:      "filterByLabels",
 	FILTERBYNAME:        "filterByName",
@@ -226,6 +248,7 @@ var tokens = [...]string{
 	FINITE:              "finite",
 	FIRST:               "first",
 	FLOOR:               "floor",
+	FORECAST:            "forecast",
 	FROM:                "from",
 	GREATEROREQUAL:      "greaterOrEqual",
 	GREATERTHAN:         "greaterThan",
@@ -234,6 +257,9 @@ var tokens = [...]string{
 	GROUPRIGHT:          "groupRight",
 	GROUPBY:             "groupBy",
 	GROUPWITHOUT:        "groupWithout",
+	HISTOGRAMFRACTION:   "histogramFraction",
+	HISTOGRAMQUANTILE:   "histogramQuantile",
+	HOLTWINTERS:         "holtWinters",
 	HOUR:                "hour",
 	IGNORING:            "ignoring",
 	JOIN:                "join",
@@ -257,6 +283,7 @@ var tokens = [...]string{
 	MIN:                 "min",
 	MINWITH:             "minWith",
 	MINUTE:              "minute",
+	MOD:                 "mod",
 	MONTH:               "month",
 	MULSERIES:           "mul",
 	NEGMASK:             "negmask",
@@ -265,7 +292,10 @@ var tokens = [...]string{
 	NAMES:               "names",
 	ON:                  "on",
 	ORL:                 "or",
+	OUTLIERS:            "outliers",
 	PERCENTILE:          "percentile",
+	POW:                 "pow",
+	PREDICTLINEAR:       "predictLinear",
 	PROM:                "prom",
 	PROMETHEUS:          "prometheus",
 	QUANTIZE:            "quantize",
@@ -287,8 +317,10 @@ var tokens = [...]string{
 	SETLABELFROMNAME:    "setLabelFromName",
 	SETLABELS:           "setLabels",
 	SETVALUES:           "setValues",
+	SGN:                 "sgn",
 	SHIFT:               "shift",
 	SHRINK:              "shrink",
+	SIN:                 "sin",
 	SORT:                "sort",
 	SORTBY:              "sortBy",
 	SORTDESC:            "sortDesc",
@@ -299,6 +331,7 @@ var tokens = [...]string{
 	STORE:               "store",
 	SUBSERIES:           "sub",
 	SUM:                 "sum",
+	TAN:                 "tan",
 	TOBOOLEAN:           "toboolean",
 	TODOUBLE:            "todouble",
 	TOLONG:              "tolong",
@@ -315,6 +348,7 @@ var tokens = [...]string{
 	WHERE:               "where",
 	WINDOW:              "window",
 	YEAR:                "year",
+	ZSCORE:              "zscore",
 }
 
 var keywords map[string]Token
@@ -385,6 +419,7 @@ const (
 	KeepDistinct
 	GroupIsWithout
 	NowValue
+	Timezone
 	Unknown
 )
 
@@ -410,6 +445,7 @@ func (m PrefixAttributes) String() string {
 		KeepDistinct:     "keepDistinct",
 		NValue:           "n",
 		NowValue:         "now",
+		Timezone:         "tz",
 		Unknown:          "unknown",
 	}
 	if str, ok := typeToStr[m]; ok {